@@ -0,0 +1,150 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/agent"
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/git"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+func newAgentCmd(out io.Writer) *cobra.Command {
+	var (
+		storageFlags  *storageFlags
+		network       string
+		wgInterface   string
+		output        string
+		headerFile    string
+		reloadCommand string
+		interval      time.Duration
+		once          bool
+		debug         bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Starts the smorgasbord agent deriving the wireguard server configuration.",
+		Long: `Starts the smorgasbord agent deriving the wireguard server configuration.
+
+The agent periodically reads all entries from the storage and derives the
+[Peer] sections of the server. If --wg-interface is provided, the peers of
+the interface are configured directly, e.g.:
+
+  smorgasbord agent --repository-url=... --wg-interface=wg0
+
+Otherwise the peers are written to the output file and the reload command
+is run, if the rendered configuration changed, e.g.:
+
+  smorgasbord agent --repository-url=... \
+    --header-file=/etc/wireguard/wg0.header \
+    --output=/etc/wireguard/wg0.conf \
+    --reload-command="wg syncconf wg0 /etc/wireguard/wg0.conf"
+
+The header should therefore only contain settings understood by wg, e.g.
+PrivateKey and ListenPort, but not wg-quick specific ones like Address.
+
+If the server manages multiple networks, each wireguard server runs its own
+agent selecting the network it serves using --network.`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			// Setup logger
+			log := zerolog.New(out).With().Timestamp().Logger()
+			zerolog.SetGlobalLevel(zerolog.InfoLevel)
+			if debug {
+				zerolog.SetGlobalLevel(zerolog.DebugLevel)
+			}
+			var header []byte
+			if headerFile != "" {
+				var err error
+				header, err = ioutil.ReadFile(headerFile)
+				if err != nil {
+					return fmt.Errorf("Failed to read header file: %w", err)
+				}
+			}
+			s, err := storageFlags.newStorage(git.LayoutAuto, nil)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = s.Close()
+			}()
+			var applier agent.Applier
+			switch {
+			case wgInterface != "" && output != "":
+				return fmt.Errorf("The --wg-interface and --output flags are mutually exclusive")
+			case wgInterface != "":
+				client, err := wgctrl.New()
+				if err != nil {
+					return fmt.Errorf("Failed to setup wireguard client: %w", err)
+				}
+				defer func() {
+					_ = client.Close()
+				}()
+				applier = &agent.DeviceApplier{Client: client, Name: wgInterface, Log: log}
+			case output != "":
+				applier = &agent.FileApplier{
+					Path:          output,
+					Header:        header,
+					ReloadCommand: reloadCommand,
+					Log:           log,
+				}
+			default:
+				return fmt.Errorf("Please provide either the --wg-interface or --output flag")
+			}
+			a, err := agent.New(&agent.Config{
+				Storage:  s,
+				Applier:  applier,
+				Network:  network,
+				Interval: interval,
+				Log:      log,
+			})
+			if err != nil {
+				return err
+			}
+			if once {
+				_, err := a.Sync(ctx)
+				return err
+			}
+			log.Info().Dur("interval", interval).Msg("agent starting")
+			return a.Run(ctx)
+		},
+	}
+
+	storageFlags = addStorageFlags(cmd)
+	flags := cmd.Flags()
+	flags.StringVar(&network, "network", storage.DefaultNetwork, "Network served by the wireguard server, only its entries are configured.")
+	flags.StringVar(&wgInterface, "wg-interface", "", "Wireguard interface, which peers are configured directly, e.g. wg0.")
+	flags.StringVarP(&output, "output", "o", "", "File the rendered configuration is written to, e.g. /etc/wireguard/wg0.conf.")
+	flags.StringVar(&headerFile, "header-file", "", "File prepended to the rendered peers, e.g. containing the [Interface] section.")
+	flags.StringVar(&reloadCommand, "reload-command", "", "Command run by sh after the configuration changed, e.g. 'wg syncconf wg0 /etc/wireguard/wg0.conf'.")
+	flags.DurationVar(&interval, "interval", time.Minute, "Interval in which the storage is checked for changes.")
+	flags.BoolVar(&once, "once", false, "Synchronize the configuration once and exit, e.g. when run by cron.")
+	flags.BoolVar(&debug, "debug", false, "Whether to use debug mode for the log.")
+
+	return cmd
+}
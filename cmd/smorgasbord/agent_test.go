@@ -0,0 +1,144 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/file"
+	"github.com/kubism/smorgasbord/pkg/storage/git"
+	"github.com/kubism/smorgasbord/pkg/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Agent", func() {
+	It("renders peers and runs reload command", func() {
+		s, err := git.NewStorage(&git.Options{RepositoryURL: repositoryURL})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("agent@test.com", storage.Entry{PublicKey: "agentkey"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		header := filepath.Join(tmpDir, "agent.header")
+		Expect(ioutil.WriteFile(header, []byte("[Interface]\nListenPort = 51820\n"), 0600)).To(Succeed())
+		output := filepath.Join(tmpDir, "agent.conf")
+		reloaded := filepath.Join(tmpDir, "agent.reloaded")
+		args := []string{
+			fmt.Sprintf("--repository-url=%s", repositoryURL),
+			fmt.Sprintf("--output=%s", output),
+			fmt.Sprintf("--header-file=%s", header),
+			fmt.Sprintf("--reload-command=touch %s", reloaded),
+			"--once",
+		}
+		_, err = executeCommandWithContext(context.Background(), newAgentCmd, args...)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadFile(output)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(HavePrefix("[Interface]\nListenPort = 51820\n"))
+		Expect(string(data)).To(ContainSubstring("PublicKey = agentkey"))
+		Expect(reloaded).To(BeAnExistingFile())
+	})
+	It("runs until cancelled", func() {
+		output := filepath.Join(tmpDir, "agent-run.conf")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		args := []string{
+			fmt.Sprintf("--repository-url=%s", repositoryURL),
+			fmt.Sprintf("--output=%s", output),
+			"--interval=100ms",
+		}
+		_, err := executeCommandWithContext(ctx, newAgentCmd, args...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(BeAnExistingFile())
+	})
+	It("reads the storage via ssh", func() {
+		sshServer, err := testutil.NewSSHGitServer(filepath.Join(tmpDir, "git"))
+		Expect(err).ToNot(HaveOccurred())
+		defer sshServer.Close()
+		keyFile := filepath.Join(tmpDir, "agent_ecdsa")
+		publicKey, err := testutil.GenerateSSHKey(keyFile, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		sshServer.AuthorizeKey(publicKey)
+		knownHosts := filepath.Join(tmpDir, "agent_known_hosts")
+		Expect(ioutil.WriteFile(knownHosts, []byte(sshServer.KnownHosts()+"\n"), 0600)).To(Succeed())
+		output := filepath.Join(tmpDir, "agent-ssh.conf")
+		args := []string{
+			// The ssh server serves the same repositories as the http server
+			fmt.Sprintf("--repository-url=ssh://git@%s/test.git", sshServer.GetAddr()),
+			fmt.Sprintf("--repository-ssh-key=%s", keyFile),
+			fmt.Sprintf("--repository-known-hosts=%s", knownHosts),
+			fmt.Sprintf("--output=%s", output),
+			"--once",
+		}
+		_, err = executeCommandWithContext(context.Background(), newAgentCmd, args...)
+		Expect(err).To(MatchError(ContainSubstring("Invalid repository credentials")))
+		_, err = executeCommandWithContext(context.Background(), newAgentCmd, append(args, "--repository-ssh-key-passphrase=secret")...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(BeAnExistingFile())
+	})
+	It("reads the storage from a local file", func() {
+		path := filepath.Join(tmpDir, "agent-file", "smorgasbord.json")
+		s, err := file.NewStorage(path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("agent@test.com", storage.Entry{PublicKey: "filekey"})).To(Succeed())
+		Expect(s.Add("agent@test.com", storage.Entry{PublicKey: "officekey", Network: "office"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		output := filepath.Join(tmpDir, "agent-file.conf")
+		args := []string{
+			"--storage-backend=file",
+			fmt.Sprintf("--storage-path=%s", path),
+			fmt.Sprintf("--output=%s", output),
+			"--once",
+		}
+		_, err = executeCommandWithContext(context.Background(), newAgentCmd, args...)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadFile(output)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("PublicKey = filekey"))
+		Expect(string(data)).ToNot(ContainSubstring("PublicKey = officekey"))
+		// Select the network served by the agent
+		_, err = executeCommandWithContext(context.Background(), newAgentCmd, append(args, "--network=office")...)
+		Expect(err).ToNot(HaveOccurred())
+		data, err = ioutil.ReadFile(output)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("PublicKey = officekey"))
+		Expect(string(data)).ToNot(ContainSubstring("PublicKey = filekey"))
+		_, err = executeCommandWithContext(context.Background(), newAgentCmd, append(args, fmt.Sprintf("--repository-url=%s", repositoryURL))...)
+		Expect(err).To(MatchError(ContainSubstring("only supported by the git backend")))
+		_, err = executeCommandWithContext(context.Background(), newAgentCmd, "--storage-backend=unknown", "--once", "--output=test")
+		Expect(err).To(MatchError(ContainSubstring("Unknown storage backend")))
+	})
+	It("fails without repository", func() {
+		_, err := executeCommandWithContext(context.Background(), newAgentCmd, "--once", "--output=test")
+		Expect(err).To(HaveOccurred())
+	})
+	It("fails without output or interface", func() {
+		args := []string{fmt.Sprintf("--repository-url=%s", repositoryURL), "--once"}
+		_, err := executeCommandWithContext(context.Background(), newAgentCmd, args...)
+		Expect(err).To(MatchError(ContainSubstring("--wg-interface")))
+		args = append(args, "--output=test", "--wg-interface=wg0")
+		_, err = executeCommandWithContext(context.Background(), newAgentCmd, args...)
+		Expect(err).To(MatchError(ContainSubstring("mutually exclusive")))
+	})
+})
@@ -0,0 +1,162 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kubism/smorgasbord/pkg/api"
+	cfg "github.com/kubism/smorgasbord/pkg/config"
+	"github.com/kubism/smorgasbord/pkg/keys"
+	"github.com/kubism/smorgasbord/pkg/util"
+	"github.com/kubism/smorgasbord/pkg/wireguard"
+
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func newConfigCmd(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manages the wireguard configuration of this machine.",
+		Long:  `Manages the wireguard configuration of this machine.`,
+	}
+	cmd.AddCommand(newConfigRenderCmd(out))
+	return cmd
+}
+
+func newConfigRenderCmd(out io.Writer) *cobra.Command {
+	var (
+		config  string
+		output  string
+		network string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "render",
+		Short: "Renders the wg-quick configuration for the local key.",
+		Long: `Renders the wg-quick configuration for the local key by combining the
+private key stored next to the configuration with the peer data provided
+by the server. The key has to be registered first, e.g. using
+'keys generate --register'. The configuration is rendered for the network
+the key was registered for.`,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Well, the output is meant to be consumed by the user, so let's
+			// properly setup the log output, both global and locally. The
+			// logger will not write to out, which might be used for the
+			// rendered configuration.
+			zlog.Logger = zlog.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+			log := zlog.Logger
+			// Make sure to expand env for config, e.g. $HOME in default
+			config = os.ExpandEnv(config)
+			c, err := cfg.FromFile(config)
+			if err != nil {
+				return fmt.Errorf("Failed to load configuration: %w", err)
+			}
+			if c.BaseURL == "" || c.Token == "" {
+				return fmt.Errorf("Rendering the configuration requires the setup and login commands to be run first")
+			}
+			privateKey, err := keys.ReadPrivateKey(c.PrivateKeyPath())
+			if err != nil {
+				return fmt.Errorf("Failed to read private key, make sure to generate one first: %w", err)
+			}
+			publicKey := privateKey.PublicKey().String()
+			client := api.NewClient(c.BaseURL, c.Token)
+			if network == "" {
+				network, err = registeredNetwork(client, publicKey)
+				if err != nil {
+					return err
+				}
+			}
+			res, err := client.GetConfig(network)
+			if err != nil {
+				return fmt.Errorf("Failed to retrieve configuration: %w", err)
+			}
+			wgConfig, err := newClientConfig(res, privateKey)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err := wgConfig.Render(&buf); err != nil {
+				return fmt.Errorf("Failed to render configuration: %w", err)
+			}
+			if output == "" || output == "-" {
+				_, err := out.Write(buf.Bytes())
+				return err
+			}
+			if err := util.WriteFileAtomic(output, buf.Bytes(), 0600); err != nil {
+				return fmt.Errorf("Failed to write configuration: %w", err)
+			}
+			log.Info().Str("output", output).Str("publicKey", publicKey).Msg("Wrote configuration")
+			return nil
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&config, "config", "c", "$HOME/.smorgasbord", "Configuration next to which the private key is stored.")
+	flags.StringVarP(&output, "output", "o", "", "File the configuration is written to, e.g. /etc/wireguard/wg0.conf (defaults to stdout).")
+	flags.StringVar(&network, "network", "", "Network the configuration is rendered for (defaults to the network the key was registered for).")
+
+	return cmd
+}
+
+// registeredNetwork returns the network the public key was registered for.
+func registeredNetwork(client *api.Client, publicKey string) (string, error) {
+	entries, err := client.ListPeers()
+	if err != nil {
+		return "", fmt.Errorf("Failed to retrieve peers: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.PublicKey == publicKey {
+			return entry.NetworkName(), nil
+		}
+	}
+	return "", fmt.Errorf("Public key %s is not registered, use 'keys generate --register' first", publicKey)
+}
+
+// newClientConfig combines the data provided by the server with the local
+// private key.
+func newClientConfig(res *api.ConfigResponse, privateKey keys.Key) (*wireguard.Config, error) {
+	publicKey := privateKey.PublicKey().String()
+	for _, entry := range res.Peers {
+		if entry.PublicKey != publicKey {
+			continue
+		}
+		if entry.AllowedIP == "" {
+			return nil, fmt.Errorf("No address was assigned to public key %s", publicKey)
+		}
+		return &wireguard.Config{
+			Interface: &wireguard.Interface{
+				PrivateKey: privateKey.String(),
+				Address:    wireguard.SplitList(entry.AllowedIP),
+				DNS:        res.Server.DNS,
+			},
+			Peers: []wireguard.Peer{{
+				PublicKey:           res.Server.PublicKey,
+				Endpoint:            res.Server.Endpoint,
+				AllowedIPs:          res.Server.AllowedIPs,
+				PersistentKeepalive: res.Server.PersistentKeepalive,
+			}},
+		}, nil
+	}
+	return nil, fmt.Errorf("Public key %s is not registered, use 'keys generate --register' first", publicKey)
+}
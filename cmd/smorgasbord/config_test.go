@@ -0,0 +1,88 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	cfg "github.com/kubism/smorgasbord/pkg/config"
+	"github.com/kubism/smorgasbord/pkg/keys"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	Context("with running server", func() {
+		var stopServer func()
+		BeforeEach(func() {
+			stopServer = startServer()
+		})
+		AfterEach(func() {
+			stopServer()
+		})
+		It("renders configuration of registered key", func() {
+			login()
+			args := append([]string{"generate", "--register", "--force"}, validLoginArgs()...)
+			_, err := executeCommandWithContext(context.Background(), newKeysCmd, args...)
+			Expect(err).ToNot(HaveOccurred())
+			privateKey, err := keys.ReadPrivateKey((&cfg.Config{Path: filepath.Join(tmpDir, "config")}).PrivateKeyPath())
+			Expect(err).ToNot(HaveOccurred())
+			// Render to stdout
+			args = append([]string{"render"}, validLoginArgs()...)
+			output, err := executeCommandWithContext(context.Background(), newConfigCmd, args...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output).To(ContainSubstring("PrivateKey = " + privateKey.String()))
+			Expect(output).To(ContainSubstring("Endpoint = vpn.example.com:51820"))
+			Expect(output).To(ContainSubstring("PersistentKeepalive = 25"))
+			// Render to file
+			path := filepath.Join(tmpDir, "wg0.conf")
+			args = append(args, fmt.Sprintf("--output=%s", path))
+			_, err = executeCommandWithContext(context.Background(), newConfigCmd, args...)
+			Expect(err).ToNot(HaveOccurred())
+			fi, err := os.Stat(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			data, err := ioutil.ReadFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal(output))
+		})
+		It("renders configuration for the network of the key", func() {
+			login()
+			args := append([]string{"generate", "--register", "--force", "--network=office"}, validLoginArgs()...)
+			_, err := executeCommandWithContext(context.Background(), newKeysCmd, args...)
+			Expect(err).ToNot(HaveOccurred())
+			args = append([]string{"render"}, validLoginArgs()...)
+			output, err := executeCommandWithContext(context.Background(), newConfigCmd, args...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output).To(ContainSubstring("Endpoint = office.example.com:51820"))
+			Expect(output).To(ContainSubstring("AllowedIPs = 10.1.0.0/24"))
+			// The key is not registered for the default network
+			_, err = executeCommandWithContext(context.Background(), newConfigCmd, append(args, "--network=default")...)
+			Expect(err).To(MatchError(ContainSubstring("is not registered")))
+		})
+	})
+	It("fails without configuration", func() {
+		args := []string{"render", fmt.Sprintf("--config=%s", filepath.Join(tmpDir, "doesnotexist"))}
+		_, err := executeCommandWithContext(context.Background(), newConfigCmd, args...)
+		Expect(err).To(HaveOccurred())
+	})
+})
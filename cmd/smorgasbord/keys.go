@@ -0,0 +1,132 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kubism/smorgasbord/pkg/api"
+	cfg "github.com/kubism/smorgasbord/pkg/config"
+	"github.com/kubism/smorgasbord/pkg/keys"
+
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func newKeysCmd(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Manages the wireguard keys of this machine.",
+		Long:  `Manages the wireguard keys of this machine.`,
+	}
+	cmd.AddCommand(newKeysGenerateCmd(out))
+	return cmd
+}
+
+func newKeysGenerateCmd(out io.Writer) *cobra.Command {
+	var (
+		config   string
+		register bool
+		force    bool
+		name     string
+		network  string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generates a new wireguard key pair.",
+		Long: `Generates a new wireguard key pair and stores the private key next to the
+configuration. The private key never leaves this machine, only the public key
+is registered with the server if requested.`,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Well, the output is meant to be consumed by the user, so let's
+			// properly setup the log output, both global and locally
+			zlog.Logger = zlog.Output(zerolog.ConsoleWriter{Out: os.Stdout})
+			log := zerolog.New(zerolog.ConsoleWriter{Out: out}).With().Timestamp().Logger()
+			// Make sure to expand env for config, e.g. $HOME in default
+			config = os.ExpandEnv(config)
+			c, err := cfg.FromFile(config)
+			if os.IsNotExist(err) {
+				c = &cfg.Config{Path: config}
+			} else if err != nil {
+				return fmt.Errorf("Failed to load configuration: %w", err)
+			}
+			if register && (c.BaseURL == "" || c.Token == "") {
+				return fmt.Errorf("Registering the key requires the setup and login commands to be run first")
+			}
+			path := c.PrivateKeyPath()
+			if _, err := os.Stat(path); err == nil && !force {
+				return fmt.Errorf("Private key %s already exists, use --force to replace it", path)
+			}
+			privateKey, err := keys.GeneratePrivateKey()
+			if err != nil {
+				return fmt.Errorf("Failed to generate private key: %w", err)
+			}
+			// If the key is registered, it is stored next to an existing key
+			// first, so it is not lost if writing it fails after the
+			// registration, and only replaces it once the registration
+			// succeeded
+			target := path
+			if register {
+				target = path + ".new"
+			}
+			if err := keys.WritePrivateKey(target, privateKey); err != nil {
+				return fmt.Errorf("Failed to write private key: %w", err)
+			}
+			publicKey := privateKey.PublicKey().String()
+			if register {
+				entry, err := api.NewClient(c.BaseURL, c.Token).AddPeer(&api.AddPeerRequest{
+					PublicKey: publicKey,
+					Network:   network,
+					Name:      name,
+				})
+				if err != nil {
+					_ = os.Remove(target)
+					return fmt.Errorf("Failed to register public key: %w", err)
+				}
+				log.Info().Str("name", entry.Name).Str("network", entry.NetworkName()).Str("allowedIP", entry.AllowedIP).Msg("Registered public key")
+				if err := keys.WritePrivateKey(path, privateKey); err != nil {
+					return fmt.Errorf("Failed to replace private key, the registered private key is kept at %s: %w", target, err)
+				}
+				_ = os.Remove(target)
+			}
+			log.Info().Str("path", path).Str("publicKey", publicKey).Msg("Generated key pair and stored private key")
+			fmt.Fprintln(out, publicKey)
+			return nil
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&config, "config", "c", "$HOME/.smorgasbord", "Configuration next to which the private key is stored.")
+	flags.BoolVarP(&register, "register", "r", false, "Whether to register the public key with the server.")
+	flags.BoolVarP(&force, "force", "f", false, "Whether to replace an existing private key.")
+	flags.StringVarP(&name, "name", "n", hostname(), "Name of the device the key is registered for.")
+	flags.StringVar(&network, "network", "", "Network the key is registered for (defaults to the default network), see 'networks' for the available ones.")
+
+	return cmd
+}
+
+// hostname returns the hostname of the machine or an empty string if it can
+// not be determined.
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
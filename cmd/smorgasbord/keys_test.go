@@ -0,0 +1,102 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	cfg "github.com/kubism/smorgasbord/pkg/config"
+	"github.com/kubism/smorgasbord/pkg/keys"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Keys", func() {
+	It("generates key pair and stores private key", func() {
+		config := filepath.Join(tmpDir, "keysconfig")
+		args := []string{"generate", fmt.Sprintf("--config=%s", config)}
+		output, err := executeCommandWithContext(context.Background(), newKeysCmd, args...)
+		Expect(err).ToNot(HaveOccurred())
+		path := (&cfg.Config{Path: config}).PrivateKeyPath()
+		fi, err := os.Stat(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		privateKey, err := keys.ReadPrivateKey(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(ContainSubstring(privateKey.PublicKey().String()))
+		Expect(output).ToNot(ContainSubstring(privateKey.String()))
+		// Existing keys are only replaced if forced
+		_, err = executeCommandWithContext(context.Background(), newKeysCmd, args...)
+		Expect(err).To(MatchError(ContainSubstring("already exists")))
+		_, err = executeCommandWithContext(context.Background(), newKeysCmd, append(args, "--force")...)
+		Expect(err).ToNot(HaveOccurred())
+	})
+	It("fails to register without login", func() {
+		config := filepath.Join(tmpDir, "keysconfignologin")
+		args := []string{"generate", fmt.Sprintf("--config=%s", config), "--register"}
+		_, err := executeCommandWithContext(context.Background(), newKeysCmd, args...)
+		Expect(err).To(HaveOccurred())
+	})
+	Context("with running server", func() {
+		var stopServer func()
+		BeforeEach(func() {
+			stopServer = startServer()
+		})
+		AfterEach(func() {
+			stopServer()
+		})
+		It("registers public key", func() {
+			login()
+			args := append([]string{"generate", "--register", "--force", "--name=test-laptop"}, validLoginArgs()...)
+			output, err := executeCommandWithContext(context.Background(), newKeysCmd, args...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output).To(ContainSubstring("Registered public key"))
+			Expect(output).To(ContainSubstring("test-laptop"))
+		})
+		It("registers public key for network", func() {
+			login()
+			args := append([]string{"generate", "--register", "--force", "--network=office"}, validLoginArgs()...)
+			output, err := executeCommandWithContext(context.Background(), newKeysCmd, args...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output).To(ContainSubstring("office"))
+			Expect(output).To(ContainSubstring("10.1.0."))
+			path := (&cfg.Config{Path: filepath.Join(tmpDir, "config")}).PrivateKeyPath()
+			privateKey, err := keys.ReadPrivateKey(path)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = os.Stat(path + ".new")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			args = append([]string{"generate", "--register", "--force", "--network=unknown"}, validLoginArgs()...)
+			_, err = executeCommandWithContext(context.Background(), newKeysCmd, args...)
+			Expect(err).To(MatchError(ContainSubstring("unknown network")))
+			// The existing key is kept, if the registration failed
+			Expect(keys.ReadPrivateKey(path)).To(Equal(privateKey))
+			_, err = os.Stat(path + ".new")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+		It("lists networks", func() {
+			login()
+			output, err := executeCommandWithContext(context.Background(), newNetworksCmd, validLoginArgs()...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output).To(MatchRegexp(`office\s+office.example.com:51820\s+10.1.0.0/24`))
+			Expect(output).To(MatchRegexp(`default\s+vpn.example.com:51820\s+10.0.0.0/24`))
+		})
+	})
+})
@@ -36,13 +36,16 @@ var openURL = browser.OpenURL
 
 func newLoginCmd(out io.Writer) *cobra.Command {
 	var (
-		config string
+		config    string
+		noBrowser bool
+		device    bool
+		timeout   time.Duration
 	)
 
 	cmd := &cobra.Command{
-		Use:           "setup",
-		Short:         "Configures the environment for subsequent commands.",
-		Long:          `Configures the environment for subsequent commands.`,
+		Use:           "login",
+		Short:         "Logs in to the configured smorgasbord server.",
+		Long:          `Logs in to the configured smorgasbord server using OpenID Connect and stores the received token in the configuration.`,
 		SilenceErrors: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
@@ -58,29 +61,21 @@ func newLoginCmd(out io.Writer) *cobra.Command {
 			} else if err != nil {
 				return fmt.Errorf("Failed to load configuration: %w", err)
 			}
+			if c.BaseURL == "" {
+				return fmt.Errorf("No server configured in %s, please run the setup command with --base-url first", config)
+			}
 			client := auth.NewClient(c.BaseURL)
-			if err := client.StartCallbackServer(); err != nil {
-				return fmt.Errorf("Failed to start callback server: %w", err)
+			if device {
+				err = loginWithDevice(ctx, out, log, client, timeout)
+			} else {
+				err = loginWithCallback(ctx, out, log, client, timeout, noBrowser)
 			}
-			defer func() {
-				_ = client.StopCallbackServer()
-			}()
-			authCodeURL, err := client.GetAuthCodeURL()
 			if err != nil {
-				return fmt.Errorf("Failed to retrieve auth code URL: %w", err)
-			}
-			if err := openURL(authCodeURL); err != nil {
-				return fmt.Errorf("Failed to open auth code URL in browser: %w", err)
-			}
-			log.Info().Msg("Waiting up to 120 seconds for token response...")
-			ctx, cancel := context.WithTimeout(ctx, 120*time.Second)
-			defer cancel()
-			if err := client.WaitUntilTokenReceived(ctx); err != nil {
-				return fmt.Errorf("Failed to receive token: %w", err)
+				return err
 			}
 			c.Token = client.GetToken()
 			if err := c.Save(); err != nil {
-				return fmt.Errorf("failed to save configuration: %w", err)
+				return fmt.Errorf("Failed to save configuration: %w", err)
 			}
 			log.Info().Str("config", config).Msg("Login successful. Writing changes to configuration.")
 			return nil
@@ -89,6 +84,58 @@ func newLoginCmd(out io.Writer) *cobra.Command {
 
 	flags := cmd.Flags()
 	flags.StringVarP(&config, "config", "c", "$HOME/.smorgasbord", "Configuration which is to login.")
+	flags.BoolVar(&noBrowser, "no-browser", false, "Print the login URL instead of opening it in a browser, e.g. when connected via SSH.")
+	flags.BoolVar(&device, "device", false, "Use the device authorization grant, which does not require a browser on this machine.")
+	flags.DurationVarP(&timeout, "timeout", "t", 120*time.Second, "How long to wait for the login to complete.")
 
 	return cmd
 }
+
+// loginWithCallback will run the OIDC flow in the browser and wait for the
+// token to be received by the local callback server.
+func loginWithCallback(ctx context.Context, out io.Writer, log zerolog.Logger, client *auth.Client, timeout time.Duration, noBrowser bool) error {
+	if err := client.StartCallbackServer(); err != nil {
+		return fmt.Errorf("Failed to start callback server: %w", err)
+	}
+	defer func() {
+		_ = client.StopCallbackServer()
+	}()
+	authCodeURL, err := client.GetAuthCodeURL()
+	if err != nil {
+		return fmt.Errorf("Failed to retrieve auth code URL: %w", err)
+	}
+	if noBrowser {
+		// The final redirect will target the callback server on this
+		// machine, e.g. forward the port if connected via SSH
+		fmt.Fprintf(out, "Please open the following URL in your browser:\n\n%s\n\n", authCodeURL)
+	} else if err := openURL(authCodeURL); err != nil {
+		return fmt.Errorf("Failed to open auth code URL in browser: %w", err)
+	}
+	log.Info().Msgf("Waiting up to %s for token response...", timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := client.WaitUntilTokenReceived(ctx); err != nil {
+		return fmt.Errorf("Failed to receive token: %w", err)
+	}
+	return nil
+}
+
+// loginWithDevice will use the device authorization grant, so the user can
+// authorize this machine using a browser on any other device.
+func loginWithDevice(ctx context.Context, out io.Writer, log zerolog.Logger, client *auth.Client, timeout time.Duration) error {
+	deviceAuth, err := client.StartDeviceAuth()
+	if err != nil {
+		return fmt.Errorf("Failed to start device authorization: %w", err)
+	}
+	fmt.Fprintf(out, "Please open %s in your browser and enter the code:\n\n%s\n\n", deviceAuth.VerificationURI, deviceAuth.UserCode)
+	if deviceAuth.VerificationURIComplete != "" {
+		fmt.Fprintf(out, "Alternatively open the following URL directly:\n\n%s\n\n", deviceAuth.VerificationURIComplete)
+	}
+	log.Info().Msgf("Waiting up to %s for authorization...", timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := client.WaitUntilDeviceAuthorized(ctx, deviceAuth); err != nil {
+		return fmt.Errorf("Failed to receive token: %w", err)
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -42,21 +43,41 @@ var testOpenURL = func(url string) error {
 }
 
 var _ = Describe("Login", func() {
-	It("works with if properly setup", func() {
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		go func() {
-			_, err := executeCommandWithContext(ctx, newServerCmd, validServerArgs()...)
+	Context("with running server", func() {
+		var stopServer func()
+		BeforeEach(func() {
+			stopServer = startServer()
+		})
+		AfterEach(func() {
+			stopServer()
+		})
+		It("works if properly setup", func() {
+			openURL = testOpenURL
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			output, err := executeCommandWithContext(ctx, newLoginCmd, validLoginArgs()...)
 			Expect(err).ToNot(HaveOccurred())
-		}()
-		_, err := executeCommandWithContext(context.Background(), newSetupCmd, validSetupArgs()...)
-		Expect(err).ToNot(HaveOccurred())
-		Expect(waitUntilServerReady()).To(Succeed())
-		openURL = testOpenURL
-		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		output, err := executeCommandWithContext(ctx, newLoginCmd, validLoginArgs()...)
-		Expect(err).ToNot(HaveOccurred())
-		Expect(output).To(ContainSubstring("Login successful"))
+			Expect(output).To(ContainSubstring("Login successful"))
+		})
+		It("prints URL without browser and times out", func() {
+			openURL = func(string) error {
+				return fmt.Errorf("browser should not be opened")
+			}
+			args := append(validLoginArgs(), "--no-browser", "--timeout=500ms")
+			output, err := executeCommandWithContext(context.Background(), newLoginCmd, args...)
+			Expect(err).To(MatchError(ContainSubstring("Failed to receive token")))
+			Expect(output).To(ContainSubstring(dex.GetIssuerURL()))
+		})
+		It("prints user code for device authorization", func() {
+			args := append(validLoginArgs(), "--device", "--timeout=500ms")
+			output, err := executeCommandWithContext(context.Background(), newLoginCmd, args...)
+			Expect(err).To(MatchError(ContainSubstring("Failed to receive token")))
+			Expect(output).To(ContainSubstring("enter the code"))
+		})
+	})
+	It("fails if server is not configured", func() {
+		args := []string{fmt.Sprintf("--config=%s", filepath.Join(tmpDir, "doesnotexist"))}
+		_, err := executeCommandWithContext(context.Background(), newLoginCmd, args...)
+		Expect(err).To(MatchError(ContainSubstring("setup")))
 	})
 })
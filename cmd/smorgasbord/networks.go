@@ -0,0 +1,68 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kubism/smorgasbord/pkg/api"
+	cfg "github.com/kubism/smorgasbord/pkg/config"
+
+	"github.com/spf13/cobra"
+)
+
+func newNetworksCmd(out io.Writer) *cobra.Command {
+	var config string
+
+	cmd := &cobra.Command{
+		Use:   "networks",
+		Short: "Lists the networks keys can be registered for.",
+		Long: `Lists the networks of the configured smorgasbord server, which the logged
+in user may register keys for using 'keys generate --register --network=...'.`,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Make sure to expand env for config, e.g. $HOME in default
+			config = os.ExpandEnv(config)
+			c, err := cfg.FromFile(config)
+			if err != nil {
+				return fmt.Errorf("Failed to load configuration: %w", err)
+			}
+			if c.BaseURL == "" || c.Token == "" {
+				return fmt.Errorf("Listing the networks requires the setup and login commands to be run first")
+			}
+			infos, err := api.NewClient(c.BaseURL, c.Token).ListNetworks()
+			if err != nil {
+				return fmt.Errorf("Failed to retrieve networks: %w", err)
+			}
+			w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NETWORK\tENDPOINTS\tALLOWED IPS")
+			for _, info := range infos {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", info.Network, strings.Join(info.Endpoints, ","), strings.Join(info.AllowedIPs, ","))
+			}
+			return w.Flush()
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&config, "config", "c", "$HOME/.smorgasbord", "Configuration containing the server and token.")
+
+	return cmd
+}
@@ -44,6 +44,18 @@ func main() {
 	rootCmd.AddCommand(serverCmd)
 	setupCmd := newSetupCmd(os.Stdout)
 	rootCmd.AddCommand(setupCmd)
+	loginCmd := newLoginCmd(os.Stdout)
+	rootCmd.AddCommand(loginCmd)
+	keysCmd := newKeysCmd(os.Stdout)
+	rootCmd.AddCommand(keysCmd)
+	configCmd := newConfigCmd(os.Stdout)
+	rootCmd.AddCommand(configCmd)
+	networksCmd := newNetworksCmd(os.Stdout)
+	rootCmd.AddCommand(networksCmd)
+	agentCmd := newAgentCmd(os.Stdout)
+	rootCmd.AddCommand(agentCmd)
+	storageCmd := newStorageCmd(os.Stdout)
+	rootCmd.AddCommand(storageCmd)
 	// Make sure to cancel the context if a signal was received
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -18,12 +18,19 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"time"
 
+	"github.com/kubism/smorgasbord/pkg/api"
 	"github.com/kubism/smorgasbord/pkg/auth"
+	"github.com/kubism/smorgasbord/pkg/deactivation"
+	"github.com/kubism/smorgasbord/pkg/network"
+	"github.com/kubism/smorgasbord/pkg/policy"
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/git"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/logger"
@@ -32,6 +39,9 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// defaultNetworkFlags are the flags configuring the default network.
+var defaultNetworkFlags = []string{"cidr", "reserved-ip", "wg-public-key", "wg-endpoint", "wg-dns", "wg-allowed-ips", "wg-keepalive", "network-groups"}
+
 func newServerCmd(out io.Writer) *cobra.Command {
 	var (
 		addr                string
@@ -41,6 +51,19 @@ func newServerCmd(out io.Writer) *cobra.Command {
 		redirectURL         string
 		authCodeURLAppendix string
 		nonce               string
+		groupsClaim         string
+		identityClaim       string
+		allowedEmailDomains []string
+		callbackOrigins     []string
+		handoffSecret       string
+		storageFlags        *storageFlags
+		storageLayout       string
+		networksFile        string
+		defaultNetwork      network.Network
+		policyFile          string
+		tokenStore          string
+		tokenEncryptionKey  string
+		deactivationConfig  deactivation.Config
 		debug               bool
 	)
 
@@ -65,20 +88,75 @@ func newServerCmd(out io.Writer) *cobra.Command {
 			if debug {
 				zerolog.SetGlobalLevel(zerolog.DebugLevel)
 			}
+			// Setup networks, which allocate allowed IPs of new entries
+			networks, err := newNetworks(networksFile, &defaultNetwork, cmd.Flags().Changed)
+			if err != nil {
+				return err
+			}
+			// Setup policy, which decides who may register keys
+			p, err := newPolicy(policyFile, networks)
+			if err != nil {
+				return err
+			}
+			layout, err := git.ParseLayout(storageLayout)
+			if err != nil {
+				return err
+			}
+			s, err := storageFlags.newStorage(layout, networks)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = s.Close()
+			}()
 			// Setup auth.Handler which handles the OIDC flows
 			config := &auth.HandlerConfig{
-				ClientID:           clientID,
-				ClientSecret:       clientSecret,
-				IssuerURL:          issuerURL,
-				AuthCodeURLMutator: authCodeURLMutator,
-				RedirectURL:        redirectURL,
-				Nonce:              nonce,
-				OfflineAsScope:     false,
+				ClientID:               clientID,
+				ClientSecret:           clientSecret,
+				IssuerURL:              issuerURL,
+				AuthCodeURLMutator:     authCodeURLMutator,
+				RedirectURL:            redirectURL,
+				Nonce:                  nonce,
+				GroupsClaim:            groupsClaim,
+				IdentityClaim:          identityClaim,
+				AllowedEmailDomains:    allowedEmailDomains,
+				AllowedCallbackOrigins: callbackOrigins,
+				HandoffSecret:          handoffSecret,
+				OfflineAsScope:         false,
+			}
+			// Replicas sharing the handoff secret have to share the
+			// redemptions of handoff codes as well
+			if redemptions, ok := s.(auth.Redemptions); ok {
+				config.Redemptions = redemptions
+			} else if handoffSecret != "" {
+				return fmt.Errorf("The --handoff-secret flag is only supported by the sql backend, which shares redeemed codes between replicas")
 			}
 			handler, err := auth.NewHandler(config)
 			if err != nil {
 				return err
 			}
+			// Setup automatic deactivation of users, whose refresh tokens are
+			// rejected by the identity provider
+			if tokenStore != "" {
+				tokens, err := deactivation.NewTokenStore(tokenStore, tokenEncryptionKey)
+				if err != nil {
+					return fmt.Errorf("Failed to setup token store: %w", err)
+				}
+				deactivationConfig.Storage = s
+				deactivationConfig.Tokens = tokens
+				deactivationConfig.Refresher = handler
+				deactivationConfig.Log = log
+				deactivator, err := deactivation.New(&deactivationConfig)
+				if err != nil {
+					return fmt.Errorf("Failed to setup deactivation: %w", err)
+				}
+				// The handler only reads the callback during logins, so it
+				// can be set after the handler was created
+				config.OnLogin = deactivator.OnLogin
+				go func() {
+					_ = deactivator.Run(ctx)
+				}()
+			}
 			// Setup gin with logger
 			if !debug {
 				gin.SetMode(gin.ReleaseMode)
@@ -91,6 +169,7 @@ func newServerCmd(out io.Writer) *cobra.Command {
 				UTC:    true,
 			}))
 			auth.Register(engine, handler)
+			api.Register(engine, handler, s, networks, p)
 			// Create the http server and listen on address
 			server := &http.Server{Addr: addr, Handler: engine}
 			log.Info().Str("addr", addr).Msg("starting listener")
@@ -116,6 +195,7 @@ func newServerCmd(out io.Writer) *cobra.Command {
 		},
 	}
 
+	storageFlags = addStorageFlags(cmd)
 	flags := cmd.Flags()
 	flags.StringVarP(&addr, "addr", "a", "0.0.0.0:8080", "Which address the server will listen on.")
 	flags.StringVarP(&clientID, "client-id", "c", "", "OIDC/OAuth2 client ID used for OIDC flow.")
@@ -124,7 +204,72 @@ func newServerCmd(out io.Writer) *cobra.Command {
 	flags.StringVarP(&redirectURL, "redirect-url", "r", "", "Public redirect URL pointing to the callback of the server as configured for the client.")
 	flags.StringVarP(&authCodeURLAppendix, "auth-code-url-appendix", "x", "", "Some OIDC providers will not return the full auth code URL, this flag can be used to append to the URL (e.g. for dex connector selection).")
 	flags.StringVarP(&nonce, "nonce", "n", "", "Nonce used to hash state during redirect flow (keep it secret).")
+	flags.StringVar(&groupsClaim, "groups-claim", auth.DefaultGroupsClaim, "Claim of the ID token containing the groups of users, nested claims can be separated by dots.")
+	flags.StringVar(&identityClaim, "identity-claim", auth.DefaultIdentityClaim, "Claim of the ID token identifying users in the storage, e.g. sub, email, preferred_username or a custom claim (changing it orphans existing entries).")
+	flags.StringSliceVar(&allowedEmailDomains, "allowed-email-domains", nil, "Email domains of users, which may use the service (defaults to all domains).")
+	flags.StringSliceVar(&callbackOrigins, "allowed-callback-origins", nil, "Origins (scheme://host[:port]) of web applications, which may receive tokens after logins in addition to loopback callbacks of the CLI.")
+	flags.StringVar(&handoffSecret, "handoff-secret", "", "Secret used to encrypt the codes handing off tokens after logins, which has to be the same for all replicas and requires the sql backend (defaults to a random secret, which only works with a single replica).")
+	flags.StringVar(&storageLayout, "storage-layout", "auto", "Layout of the repository, either single-file, per-user or auto to detect the layout of existing repositories.")
+	flags.StringVar(&networksFile, "networks-file", "", "JSON file containing a list of networks, each with name, cidrs, reservedIPs, publicKey, endpoints, dns, allowedIPs, persistentKeepalive and groups.")
+	flags.StringSliceVar(&defaultNetwork.CIDRs, "cidr", nil, "CIDRs of the default network (at most one per address family), which allowed IPs of new peers are allocated from.")
+	flags.StringSliceVar(&defaultNetwork.ReservedIPs, "reserved-ip", nil, "Addresses, prefixes or ranges (e.g. 10.0.0.1-10.0.0.9) of the default network, which will not be allocated.")
+	flags.StringVar(&defaultNetwork.PublicKey, "wg-public-key", "", "Public key of the wireguard server of the default network, which is required to render client configurations.")
+	flags.StringSliceVar(&defaultNetwork.Endpoints, "wg-endpoint", nil, "Public endpoints (host:port) of the wireguard servers of the default network.")
+	flags.StringSliceVar(&defaultNetwork.DNS, "wg-dns", nil, "DNS servers clients of the default network should use while connected.")
+	flags.StringSliceVar(&defaultNetwork.AllowedIPs, "wg-allowed-ips", nil, "Routes clients of the default network should send through the VPN (defaults to its CIDRs).")
+	flags.IntVar(&defaultNetwork.PersistentKeepalive, "wg-keepalive", 0, "Persistent keepalive interval in seconds clients of the default network should use (0 disables it).")
+	flags.StringSliceVar(&defaultNetwork.Groups, "network-groups", nil, "Groups of users, which may use the default network (defaults to all users).")
+	flags.StringVar(&policyFile, "policy-file", "", "JSON file containing rules, each with group, networks and maxDevices per network, which decide who may register keys (defaults to all users).")
+	flags.StringVar(&tokenStore, "token-store", "", "File the encrypted refresh tokens of users are stored in, which enables the automatic deactivation of users.")
+	flags.StringVar(&tokenEncryptionKey, "token-encryption-key", "", "Secret used to encrypt the stored refresh tokens (keep it secret).")
+	flags.DurationVar(&deactivationConfig.Interval, "deactivation-interval", time.Hour, "Interval in which the refresh tokens of all users are checked.")
+	flags.DurationVar(&deactivationConfig.GracePeriod, "deactivation-grace-period", 72*time.Hour, "Time refresh tokens have to be rejected before the entries of the user are deactivated.")
+	flags.BoolVar(&deactivationConfig.DryRun, "deactivation-dry-run", false, "Only log the users, which would be deactivated.")
+	flags.StringSliceVar(&deactivationConfig.RejectionCodes, "deactivation-error-codes", deactivation.DefaultRejectionCodes, "Error codes of the token endpoint, which indicate that a refresh token was rejected.")
 	flags.BoolVar(&debug, "debug", false, "Whether to use debug mode for the server and log.")
 
 	return cmd
 }
+
+// newNetworks loads the networks of the file, if provided, and adds the
+// default network configured by flags. The default network is always added
+// without file, so a single network can be set up using flags only.
+func newNetworks(path string, defaultNetwork *network.Network, changed func(name string) bool) (*network.Networks, error) {
+	var networks []network.Network
+	if path != "" {
+		var err error
+		networks, err = network.Load(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load networks: %w", err)
+		}
+	}
+	useDefault := path == ""
+	for _, name := range defaultNetworkFlags {
+		useDefault = useDefault || changed(name)
+	}
+	if useDefault {
+		defaultNetwork.Name = storage.DefaultNetwork
+		networks = append(networks, *defaultNetwork)
+	}
+	n, err := network.New(networks)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid networks: %w", err)
+	}
+	return n, nil
+}
+
+// newPolicy loads the policy of the file, if provided, and validates it
+// against the networks.
+func newPolicy(path string, networks *network.Networks) (*policy.Policy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	p, err := policy.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load policy: %w", err)
+	}
+	if err := p.Validate(networks.Names()); err != nil {
+		return nil, fmt.Errorf("Invalid policy: %w", err)
+	}
+	return p, nil
+}
@@ -19,8 +19,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"time"
 
+	"github.com/kubism/smorgasbord/pkg/deactivation"
 	"github.com/kubism/smorgasbord/pkg/util"
 
 	. "github.com/onsi/ginkgo"
@@ -42,8 +45,44 @@ var _ = Describe("Server", func() {
 		Expect(err).ToNot(HaveOccurred())
 		Expect(output).ToNot(Equal(""))
 	})
+	It("stores refresh tokens of users", func() {
+		stopServer := startServer()
+		defer stopServer()
+		login()
+		tokens, err := deactivation.NewTokenStore(filepath.Join(tmpDir, "tokens.json"), "test")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tokens.IDs()).ToNot(BeEmpty())
+		_, refreshToken, err := tokens.Get(tokens.IDs()[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshToken).ToNot(BeEmpty())
+	})
 	It("fails without proper flags", func() {
 		_, err := executeCommandWithContext(context.Background(), newServerCmd)
 		Expect(err).To(HaveOccurred())
 	})
+	It("fails with invalid networks", func() {
+		args := append(validServerArgs(), "--networks-file=doesnotexist.json")
+		_, err := executeCommandWithContext(context.Background(), newServerCmd, args...)
+		Expect(err).To(MatchError(ContainSubstring("Failed to load networks")))
+		path := filepath.Join(tmpDir, "networks-default.json")
+		Expect(ioutil.WriteFile(path, []byte(`[{ "name": "default", "cidrs": ["10.2.0.0/24"] }]`), 0644)).To(Succeed())
+		args = append(validServerArgs(), fmt.Sprintf("--networks-file=%s", path))
+		_, err = executeCommandWithContext(context.Background(), newServerCmd, args...)
+		Expect(err).To(MatchError(ContainSubstring("defined twice")))
+	})
+	It("fails with invalid policy", func() {
+		args := append(validServerArgs(), "--policy-file=doesnotexist.json")
+		_, err := executeCommandWithContext(context.Background(), newServerCmd, args...)
+		Expect(err).To(MatchError(ContainSubstring("Failed to load policy")))
+		path := filepath.Join(tmpDir, "policy-unknown.json")
+		Expect(ioutil.WriteFile(path, []byte(`{ "rules": [{ "group": "*", "networks": ["unknown"] }] }`), 0644)).To(Succeed())
+		args = append(validServerArgs(), fmt.Sprintf("--policy-file=%s", path))
+		_, err = executeCommandWithContext(context.Background(), newServerCmd, args...)
+		Expect(err).To(MatchError(ContainSubstring("unknown network")))
+	})
+	It("fails with invalid repository credentials", func() {
+		args := append(validServerArgs(), "--repository-ssh-key=id_ecdsa")
+		_, err := executeCommandWithContext(context.Background(), newServerCmd, args...)
+		Expect(err).To(MatchError(ContainSubstring("Invalid repository credentials")))
+	})
 })
@@ -0,0 +1,165 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/git"
+	"github.com/kubism/smorgasbord/pkg/util"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+func newStorageCmd(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "storage",
+		Short: "Manages the storage of the entries.",
+		Long:  `Manages the storage of the entries.`,
+	}
+	cmd.AddCommand(newStorageMigrateCmd(out))
+	cmd.AddCommand(newStorageExportCmd(out))
+	return cmd
+}
+
+func newStorageMigrateCmd(out io.Writer) *cobra.Command {
+	var (
+		storageFlags  *storageFlags
+		storageLayout string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrates the storage to the current schema version.",
+		Long: `Migrates the storage to the current schema version.
+
+Older schema versions are migrated on the fly while reading, but only
+persisted once the entries are modified. This command rewrites the
+repository using the current schema version in a single commit, so it
+is no longer readable by older versions of smorgasbord.
+
+If --storage-layout is provided, the repository is converted to the
+layout as part of the same commit.`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			log := zerolog.New(zerolog.ConsoleWriter{Out: out}).With().Timestamp().Logger()
+			layout, err := git.ParseLayout(storageLayout)
+			if err != nil {
+				return err
+			}
+			s, err := storageFlags.newStorage(layout, nil)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = s.Close()
+			}()
+			migrator, ok := s.(storage.Migrator)
+			if !ok {
+				return fmt.Errorf("Storage does not support migrations")
+			}
+			version, changed, err := migrator.Migrate()
+			if err != nil {
+				return fmt.Errorf("Failed to migrate storage: %w", err)
+			}
+			if !changed {
+				log.Info().Int("version", version).Msg("Storage already uses current schema version and layout")
+				return nil
+			}
+			if err := s.Save(); err != nil {
+				return fmt.Errorf("Failed to save migrated storage: %w", err)
+			}
+			log.Info().Int("from", version).Int("to", storage.CurrentVersion).Msg("Migrated storage")
+			return nil
+		},
+	}
+
+	storageFlags = addStorageFlags(cmd)
+	flags := cmd.Flags()
+	flags.StringVar(&storageLayout, "storage-layout", "auto", "Layout the repository is converted to, either single-file, per-user or auto to keep the current layout.")
+
+	return cmd
+}
+
+func newStorageExportCmd(out io.Writer) *cobra.Command {
+	var (
+		storageFlags *storageFlags
+		output       string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Exports all entries of the storage as JSON.",
+		Long: `Exports all entries of the storage as JSON.
+
+The export uses the format of the file and git backend, so it can be used as
+backup or to move the entries to another backend. If --output is omitted,
+the export is written to stdout.`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := storageFlags.newStorage(git.LayoutAuto, nil)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = s.Close()
+			}()
+			var buf bytes.Buffer
+			if err := export(s, &buf); err != nil {
+				return fmt.Errorf("Failed to export storage: %w", err)
+			}
+			if output == "" {
+				_, err = out.Write(buf.Bytes())
+				return err
+			}
+			if err := util.WriteFileAtomic(output, buf.Bytes(), 0644); err != nil {
+				return fmt.Errorf("Failed to write export: %w", err)
+			}
+			return nil
+		},
+	}
+
+	storageFlags = addStorageFlags(cmd)
+	flags := cmd.Flags()
+	flags.StringVarP(&output, "output", "o", "", "File the export is written to.")
+
+	return cmd
+}
+
+// export writes the state of the storage to w. Storages, which can export a
+// consistent snapshot themselves, are preferred.
+func export(s storage.Storage, w io.Writer) error {
+	if exporter, ok := s.(storage.Exporter); ok {
+		return exporter.Export(w)
+	}
+	st, err := s.ListAll()
+	if err != nil {
+		return err
+	}
+	data, err := storage.Encode(st)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/bolt"
+	"github.com/kubism/smorgasbord/pkg/storage/file"
+	"github.com/kubism/smorgasbord/pkg/storage/git"
+	"github.com/kubism/smorgasbord/pkg/storage/sql"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	backendGit  = "git"
+	backendFile = "file"
+	backendBolt = "bolt"
+	backendSQL  = "sql"
+)
+
+// storageFlags contains the options of the storage, which are shared by all
+// commands operating on it.
+type storageFlags struct {
+	backend     string
+	path        string
+	exportPath  string
+	sqlDriver   string
+	options     git.Options
+	credentials git.Credentials
+}
+
+// addStorageFlags adds the flags configuring the storage to the command.
+func addStorageFlags(cmd *cobra.Command) *storageFlags {
+	f := &storageFlags{}
+	flags := cmd.Flags()
+	flags.StringVar(&f.backend, "storage-backend", backendGit, "Storage backend, either git, file to store the entries in a local file shared by the server and agent, bolt to store them in an embedded database or sql to store them in a SQL database.")
+	flags.StringVar(&f.path, "storage-path", "", "Path of the file or database used as storage by the file and bolt backend or data source name of the sql backend.")
+	flags.StringVar(&f.sqlDriver, "storage-sql-driver", sql.DriverSQLite, "Driver of the database used by the sql backend.")
+	flags.StringVar(&f.exportPath, "storage-export-path", "", "File the entries are exported to by the bolt backend after every change, which can be read by the agent using the file backend.")
+	flags.StringVar(&f.options.RepositoryURL, "repository-url", "", "URL of the git repository used as storage.")
+	flags.StringVar(&f.options.Branch, "repository-branch", "", "Branch of the git repository used as storage (defaults to the default branch).")
+	flags.StringVar(&f.options.Subdirectory, "repository-subdirectory", "", "Subdirectory of the git repository the entries are stored in (defaults to the root).")
+	flags.StringVar(&f.options.AuthorName, "commit-author-name", "smorgasbord", "Name of the author of commits.")
+	flags.StringVar(&f.options.AuthorEmail, "commit-author-email", "smorgasbord@localhost", "Email of the author of commits.")
+	flags.StringVar(&f.options.CommitterName, "commit-committer-name", "", "Name of the committer of commits (defaults to the author).")
+	flags.StringVar(&f.options.CommitterEmail, "commit-committer-email", "", "Email of the committer of commits (defaults to the author).")
+	flags.StringVar(&f.credentials.Username, "repository-username", "", "Username used to authenticate against the git repository (defaults to the user of the URL or git).")
+	flags.StringVar(&f.credentials.Password, "repository-password", "", "Password or access token used to authenticate against the git repository via HTTPS or SSH (keep it secret).")
+	flags.StringVar(&f.credentials.SSHKeyFile, "repository-ssh-key", "", "PEM encoded private key used to authenticate against the git repository via SSH.")
+	flags.StringVar(&f.credentials.SSHKeyPassphrase, "repository-ssh-key-passphrase", "", "Passphrase of the encrypted private key (keep it secret).")
+	flags.BoolVar(&f.credentials.SSHAgent, "repository-ssh-agent", false, "Whether to authenticate via SSH using the agent at SSH_AUTH_SOCK, which is the default if neither key nor password are provided.")
+	flags.StringVar(&f.credentials.KnownHostsFile, "repository-known-hosts", "", "Known hosts file used to verify the host key of the SSH server (defaults to SSH_KNOWN_HOSTS or ~/.ssh/known_hosts).")
+	flags.BoolVar(&f.credentials.InsecureIgnoreHostKey, "repository-insecure-ignore-host-key", false, "Whether to skip the verification of the host key of the SSH server (insecure).")
+	return f
+}
+
+// newStorage validates the flags and sets up the storage using the optional
+// allocator. The layout is only supported by the git backend.
+func (f *storageFlags) newStorage(layout git.Layout, allocator storage.Allocator) (storage.Storage, error) {
+	switch f.backend {
+	case backendGit, backendFile, backendBolt, backendSQL:
+	default:
+		return nil, fmt.Errorf("Unknown storage backend %q", f.backend)
+	}
+	if f.backend == backendGit {
+		if f.path != "" || f.exportPath != "" {
+			return nil, fmt.Errorf("The --storage-path and --storage-export-path flags are not supported by the git backend")
+		}
+		return f.newGitStorage(layout, allocator)
+	}
+	if f.options.RepositoryURL != "" || layout != git.LayoutAuto {
+		return nil, fmt.Errorf("The --repository-url and --storage-layout flags are only supported by the git backend")
+	}
+	if f.path == "" {
+		return nil, fmt.Errorf("Please provide the --storage-path flag to setup the storage")
+	}
+	if f.exportPath != "" && f.backend != backendBolt {
+		return nil, fmt.Errorf("The --storage-export-path flag is only supported by the bolt backend")
+	}
+	var s storage.Storage
+	var err error
+	switch f.backend {
+	case backendFile:
+		s, err = file.NewStorage(f.path, allocator)
+	case backendBolt:
+		s, err = bolt.NewStorage(&bolt.Options{
+			Path:       f.path,
+			Allocator:  allocator,
+			ExportPath: f.exportPath,
+		})
+	case backendSQL:
+		s, err = sql.NewStorage(&sql.Options{
+			Driver:    f.sqlDriver,
+			DSN:       f.path,
+			Allocator: allocator,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to setup storage: %w", err)
+	}
+	return s, nil
+}
+
+func (f *storageFlags) newGitStorage(layout git.Layout, allocator storage.Allocator) (storage.Storage, error) {
+	if f.options.RepositoryURL == "" {
+		return nil, fmt.Errorf("Please provide the --repository-url flag to setup the storage")
+	}
+	auth, err := f.credentials.AuthMethod(f.options.RepositoryURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid repository credentials: %w", err)
+	}
+	opts := f.options
+	opts.Auth = auth
+	opts.Layout = layout
+	opts.Allocator = allocator
+	s, err := git.NewStorage(&opts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to setup storage: %w", err)
+	}
+	return s, nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/bolt"
+	"github.com/kubism/smorgasbord/pkg/storage/sql"
+	"github.com/kubism/smorgasbord/pkg/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Storage", func() {
+	It("migrates legacy repository", func() {
+		url := fmt.Sprintf("http://%s/migrate.git", gitServer.GetAddr())
+		Expect(testutil.InitRepository(url, map[string]string{
+			"smorgasbord.json": `{ "legacy@test.com": [{ "publicKey": "legacy", "allowedIP": "10.0.0.1/32" }] }`,
+		})).To(Succeed())
+		args := []string{"migrate", fmt.Sprintf("--repository-url=%s", url)}
+		output, err := executeCommandWithContext(context.Background(), newStorageCmd, args...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(ContainSubstring("Migrated storage"))
+		output, err = executeCommandWithContext(context.Background(), newStorageCmd, args...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(ContainSubstring("already uses current schema version"))
+		// Convert layout
+		output, err = executeCommandWithContext(context.Background(), newStorageCmd, append(args, "--storage-layout=per-user")...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(ContainSubstring("Migrated storage"))
+		_, err = executeCommandWithContext(context.Background(), newStorageCmd, append(args, "--storage-layout=invalid")...)
+		Expect(err).To(HaveOccurred())
+	})
+	It("migrates legacy file", func() {
+		path := filepath.Join(tmpDir, "migrate.json")
+		Expect(ioutil.WriteFile(path, []byte(`{ "legacy@test.com": [{ "publicKey": "legacy", "allowedIP": "10.0.0.1/32" }] }`), 0644)).To(Succeed())
+		args := []string{"migrate", "--storage-backend=file", fmt.Sprintf("--storage-path=%s", path)}
+		output, err := executeCommandWithContext(context.Background(), newStorageCmd, args...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(ContainSubstring("Migrated storage"))
+		_, err = executeCommandWithContext(context.Background(), newStorageCmd, append(args, "--storage-layout=per-user")...)
+		Expect(err).To(MatchError(ContainSubstring("only supported by the git backend")))
+	})
+	It("exports entries", func() {
+		path := filepath.Join(tmpDir, "export.db")
+		exportPath := filepath.Join(tmpDir, "export.json")
+		s, err := bolt.NewStorage(&bolt.Options{Path: path})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Add("export@test.com", storage.Entry{PublicKey: "export"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+		args := []string{"export", "--storage-backend=bolt", fmt.Sprintf("--storage-path=%s", path)}
+		output, err := executeCommandWithContext(context.Background(), newStorageCmd, append(args, fmt.Sprintf("--output=%s", exportPath))...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(BeEmpty())
+		data, err := ioutil.ReadFile(exportPath)
+		Expect(err).ToNot(HaveOccurred())
+		st, _, err := storage.Decode(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).To(HaveKey("export@test.com"))
+		// Export of the file backend to stdout
+		output, err = executeCommandWithContext(context.Background(), newStorageCmd, "export", "--storage-backend=file", fmt.Sprintf("--storage-path=%s", exportPath))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(Equal(string(data)))
+	})
+	It("exports entries of the sql backend", func() {
+		path := filepath.Join(tmpDir, "export-sql.db")
+		s, err := sql.NewStorage(&sql.Options{DSN: path})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Add("sql@test.com", storage.Entry{PublicKey: "sql"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+		args := []string{"export", "--storage-backend=sql", fmt.Sprintf("--storage-path=%s", path)}
+		output, err := executeCommandWithContext(context.Background(), newStorageCmd, args...)
+		Expect(err).ToNot(HaveOccurred())
+		st, _, err := storage.Decode([]byte(output))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).To(HaveKey("sql@test.com"))
+		_, err = executeCommandWithContext(context.Background(), newStorageCmd, append(args, "--storage-export-path=export.json")...)
+		Expect(err).To(MatchError(ContainSubstring("only supported by the bolt backend")))
+		_, err = executeCommandWithContext(context.Background(), newStorageCmd, append(args, "--storage-sql-driver=unknown")...)
+		Expect(err).To(MatchError(ContainSubstring("unknown driver")))
+	})
+	It("validates repository options", func() {
+		args := []string{"migrate", fmt.Sprintf("--repository-url=%s", repositoryURL)}
+		_, err := executeCommandWithContext(context.Background(), newStorageCmd, append(args, "--repository-branch=a..b")...)
+		Expect(err).To(MatchError(ContainSubstring("invalid branch name")))
+		_, err = executeCommandWithContext(context.Background(), newStorageCmd, append(args, "--repository-subdirectory=../vpn")...)
+		Expect(err).To(MatchError(ContainSubstring("outside of the repository")))
+		_, err = executeCommandWithContext(context.Background(), newStorageCmd, append(args, "--commit-author-email=invalid")...)
+		Expect(err).To(MatchError(ContainSubstring("invalid author email")))
+	})
+	It("fails without repository", func() {
+		_, err := executeCommandWithContext(context.Background(), newStorageCmd, "migrate")
+		Expect(err).To(HaveOccurred())
+	})
+})
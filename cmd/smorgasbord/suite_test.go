@@ -39,10 +39,12 @@ import (
 )
 
 var (
-	dex         *testutil.Dex
-	serverAddr  string
-	redirectURL string
-	tmpDir      string // Used to store temporary config for CLI, e.g. setup command
+	dex           *testutil.Dex
+	gitServer     *testutil.GitServer
+	serverAddr    string
+	redirectURL   string
+	repositoryURL string
+	tmpDir        string // Used to store temporary config for CLI, e.g. setup command
 )
 
 func TestSmorgasbord(t *testing.T) {
@@ -61,6 +63,18 @@ var _ = BeforeSuite(func(done Done) {
 	Expect(dex).ToNot(BeNil())
 	tmpDir, err = ioutil.TempDir("", "smorgasbord")
 	Expect(err).ToNot(HaveOccurred())
+	gitServer, err = testutil.NewGitServer(filepath.Join(tmpDir, "git"))
+	Expect(err).ToNot(HaveOccurred())
+	repositoryURL = fmt.Sprintf("http://%s/test.git", gitServer.GetAddr())
+	Expect(testutil.InitRepository(repositoryURL, map[string]string{
+		"README.md": "# Test",
+	})).To(Succeed())
+	Expect(ioutil.WriteFile(filepath.Join(tmpDir, "networks.json"), []byte(`[{
+		"name": "office",
+		"cidrs": ["10.1.0.0/24"],
+		"publicKey": "mJ6fWr4XAbMSpdHTkxq7ajJhMkNZ7Ckx7sRgrQS4V0Y=",
+		"endpoints": ["office.example.com:51820"]
+	}]`), 0644)).To(Succeed())
 	close(done)
 }, 240)
 
@@ -68,6 +82,9 @@ var _ = AfterSuite(func() {
 	if dex != nil {
 		_ = dex.Close()
 	}
+	if gitServer != nil {
+		_ = gitServer.Close()
+	}
 	if tmpDir != "" {
 		_ = os.RemoveAll(tmpDir)
 	}
@@ -92,6 +109,15 @@ func validServerArgs() []string {
 		fmt.Sprintf("--redirect-url=%s", redirectURL),
 		"--auth-code-url-appendix=&connector_id=mock",
 		"--nonce=test",
+		fmt.Sprintf("--repository-url=%s", repositoryURL),
+		fmt.Sprintf("--networks-file=%s", filepath.Join(tmpDir, "networks.json")),
+		"--cidr=10.0.0.0/24",
+		"--wg-public-key=HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=",
+		"--wg-endpoint=vpn.example.com:51820",
+		"--wg-dns=10.0.0.1",
+		"--wg-keepalive=25",
+		fmt.Sprintf("--token-store=%s", filepath.Join(tmpDir, "tokens.json")),
+		"--token-encryption-key=test",
 	}
 }
 
@@ -108,6 +134,36 @@ func validLoginArgs() []string {
 	}
 }
 
+// startServer will start the server in the background and setup the CLI
+// configuration to use it. The returned function stops the server again and
+// waits until it is shutdown.
+func startServer() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer GinkgoRecover()
+		defer close(done)
+		_, err := executeCommandWithContext(ctx, newServerCmd, validServerArgs()...)
+		Expect(err).ToNot(HaveOccurred())
+	}()
+	_, err := executeCommandWithContext(context.Background(), newSetupCmd, validSetupArgs()...)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(waitUntilServerReady()).To(Succeed())
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// login will run the login command against a running server.
+func login() {
+	openURL = testOpenURL
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := executeCommandWithContext(ctx, newLoginCmd, validLoginArgs()...)
+	Expect(err).ToNot(HaveOccurred())
+}
+
 func waitUntilServerReady() error {
 	timeout := time.After(5 * time.Second)
 	tick := time.Tick(500 * time.Millisecond)
@@ -16,5 +16,9 @@ require (
 	github.com/prometheus/client_golang v1.4.0
 	github.com/rs/zerolog v1.19.0
 	github.com/spf13/cobra v1.0.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200205215550-e35592f146e4
+	modernc.org/sqlite v1.20.3
 )
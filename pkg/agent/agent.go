@@ -0,0 +1,145 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/wireguard"
+
+	"github.com/rs/zerolog"
+)
+
+// Applier applies the peers derived from the storage to the wireguard server.
+type Applier interface {
+	// Apply configures the server to use exactly the provided peers and
+	// returns whether anything changed.
+	Apply(ctx context.Context, peers []wireguard.Peer) (bool, error)
+}
+
+// Config configures the Agent.
+type Config struct {
+	// Storage the entries are read from
+	Storage storage.Storage
+	// Applier the derived peers are applied with, e.g. FileApplier or
+	// DeviceApplier
+	Applier Applier
+	// Network served by the wireguard server, defaults to
+	// storage.DefaultNetwork
+	Network string
+	// Interval between two synchronizations
+	Interval time.Duration
+	Log      zerolog.Logger
+}
+
+// Agent derives the configuration of a wireguard server from the entries of
+// the storage.
+type Agent struct {
+	config *Config
+}
+
+// New validates the configuration and returns a new Agent.
+func New(config *Config) (*Agent, error) {
+	if config.Storage == nil {
+		return nil, fmt.Errorf("storage is required")
+	}
+	if config.Applier == nil {
+		return nil, fmt.Errorf("applier is required")
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("interval has to be positive")
+	}
+	return &Agent{config: config}, nil
+}
+
+// Run synchronizes the configuration periodically until the context is
+// cancelled. Failed synchronizations are logged and retried.
+func (a *Agent) Run(ctx context.Context) error {
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.Sync(ctx); err != nil {
+			a.config.Log.Error().Err(err).Msg("synchronization failed")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync reads all entries and applies the derived peers. Returns whether the
+// configuration changed.
+func (a *Agent) Sync(ctx context.Context) (bool, error) {
+	st, err := a.config.Storage.ListAll()
+	if err != nil {
+		return false, fmt.Errorf("failed to list entries: %w", err)
+	}
+	peers := Peers(st, a.config.Network)
+	changed, err := a.config.Applier.Apply(ctx, peers)
+	if err != nil {
+		return changed, err
+	}
+	if changed {
+		a.config.Log.Info().Str("network", a.network()).Int("peers", len(peers)).Msg("configuration changed")
+	}
+	return changed, nil
+}
+
+func (a *Agent) network() string {
+	if a.config.Network == "" {
+		return storage.DefaultNetwork
+	}
+	return a.config.Network
+}
+
+// Peers converts the active entries of all users in the network to the
+// [Peer] sections of the server. The empty network refers to
+// storage.DefaultNetwork. The peers are sorted by user and public key, so
+// the result is stable.
+func Peers(st storage.State, network string) []wireguard.Peer {
+	if network == "" {
+		network = storage.DefaultNetwork
+	}
+	ids := make([]string, 0, len(st))
+	for id := range st {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	peers := []wireguard.Peer{}
+	for _, id := range ids {
+		entries := append([]storage.Entry{}, st[id]...)
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].PublicKey < entries[j].PublicKey
+		})
+		for _, entry := range entries {
+			if !entry.Active() || entry.NetworkName() != network {
+				continue
+			}
+			peers = append(peers, wireguard.Peer{
+				PublicKey:  entry.PublicKey,
+				AllowedIPs: wireguard.SplitList(entry.AllowedIP),
+			})
+		}
+	}
+	return peers
+}
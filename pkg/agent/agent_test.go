@@ -0,0 +1,121 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/wireguard"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeStorage only implements ListAll, which is all the agent requires.
+type fakeStorage struct {
+	storage.Storage
+	state storage.State
+}
+
+func (s *fakeStorage) ListAll() (storage.State, error) {
+	return s.state, nil
+}
+
+// recordingApplier records the applied peers.
+type recordingApplier struct {
+	peers [][]wireguard.Peer
+	err   error
+}
+
+func (a *recordingApplier) Apply(ctx context.Context, peers []wireguard.Peer) (bool, error) {
+	a.peers = append(a.peers, peers)
+	return true, a.err
+}
+
+func newTestState() storage.State {
+	return storage.State{
+		"b@test.com": {{PublicKey: "b", AllowedIP: "10.0.0.3/32"}},
+		"c@test.com": {
+			{PublicKey: "c", AllowedIP: "10.0.0.4/32", Deactivation: &storage.Deactivation{Reason: "test"}},
+			{PublicKey: "c2", AllowedIP: "10.1.0.2/32", Network: "office"},
+		},
+		"a@test.com": {
+			{PublicKey: "a2", AllowedIP: "10.0.0.2/32, fd00::2/128"},
+			{PublicKey: "a1", AllowedIP: "10.0.0.1/32"},
+		},
+	}
+}
+
+var _ = Describe("Agent", func() {
+	It("derives sorted peers of active entries", func() {
+		Expect(Peers(newTestState(), "")).To(Equal([]wireguard.Peer{
+			{PublicKey: "a1", AllowedIPs: []string{"10.0.0.1/32"}},
+			{PublicKey: "a2", AllowedIPs: []string{"10.0.0.2/32", "fd00::2/128"}},
+			{PublicKey: "b", AllowedIPs: []string{"10.0.0.3/32"}},
+		}))
+		Expect(Peers(newTestState(), storage.DefaultNetwork)).To(Equal(Peers(newTestState(), "")))
+	})
+	It("derives peers of the network", func() {
+		Expect(Peers(newTestState(), "office")).To(Equal([]wireguard.Peer{
+			{PublicKey: "c2", AllowedIPs: []string{"10.1.0.2/32"}},
+		}))
+		Expect(Peers(newTestState(), "unknown")).To(BeEmpty())
+	})
+	It("applies peers of storage", func() {
+		applier := &recordingApplier{}
+		a, err := New(&Config{
+			Storage:  &fakeStorage{state: newTestState()},
+			Applier:  applier,
+			Interval: time.Second,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		changed, err := a.Sync(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(applier.peers).To(HaveLen(1))
+		Expect(applier.peers[0]).To(HaveLen(3))
+		applier.err = errors.New("test")
+		_, err = a.Sync(context.Background())
+		Expect(err).To(MatchError("test"))
+	})
+	It("runs until context is cancelled", func() {
+		applier := &recordingApplier{}
+		a, err := New(&Config{
+			Storage:  &fakeStorage{state: newTestState()},
+			Applier:  applier,
+			Interval: 10 * time.Millisecond,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Expect(a.Run(ctx)).To(Succeed())
+		Expect(len(applier.peers)).To(BeNumerically(">", 1))
+	})
+	It("validates configuration", func() {
+		s := &fakeStorage{}
+		applier := &recordingApplier{}
+		_, err := New(&Config{Applier: applier, Interval: time.Second})
+		Expect(err).To(HaveOccurred())
+		_, err = New(&Config{Storage: s, Interval: time.Second})
+		Expect(err).To(HaveOccurred())
+		_, err = New(&Config{Storage: s, Applier: applier})
+		Expect(err).To(HaveOccurred())
+	})
+})
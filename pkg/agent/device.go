@@ -0,0 +1,153 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/wireguard"
+
+	"github.com/rs/zerolog"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Device is the subset of wgctrl.Client used by DeviceApplier, so it can be
+// replaced in tests, e.g. by testutil.FakeDevice.
+type Device interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+}
+
+// DeviceApplier configures the peers of a wireguard interface directly. Only
+// the differences between the current and desired peers are applied, so
+// existing sessions are not interrupted. Peers unknown to the storage are
+// removed.
+type DeviceApplier struct {
+	Client Device
+	// Name of the wireguard interface, e.g. wg0
+	Name string
+	Log  zerolog.Logger
+}
+
+// Apply will add, update and remove peers of the interface, so it matches the
+// provided peers. Peers with invalid public keys or allowed IPs are skipped.
+func (a *DeviceApplier) Apply(ctx context.Context, peers []wireguard.Peer) (bool, error) {
+	device, err := a.Client.Device(a.Name)
+	if err != nil {
+		return false, fmt.Errorf("failed to get device %s: %w", a.Name, err)
+	}
+	desired := make([]wgtypes.PeerConfig, 0, len(peers))
+	for _, peer := range peers {
+		config, err := peerConfig(peer)
+		if err != nil {
+			a.Log.Warn().Err(err).Str("publicKey", peer.PublicKey).Msg("skipping invalid peer")
+			continue
+		}
+		desired = append(desired, config)
+	}
+	changes := diffPeers(device.Peers, desired)
+	if len(changes) == 0 {
+		return false, nil
+	}
+	if err := a.Client.ConfigureDevice(a.Name, wgtypes.Config{
+		ReplacePeers: false,
+		Peers:        changes,
+	}); err != nil {
+		return false, fmt.Errorf("failed to configure device %s: %w", a.Name, err)
+	}
+	return true, nil
+}
+
+func peerConfig(peer wireguard.Peer) (wgtypes.PeerConfig, error) {
+	publicKey, err := wgtypes.ParseKey(peer.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, err
+	}
+	allowedIPs := make([]net.IPNet, len(peer.AllowedIPs))
+	for i, allowedIP := range peer.AllowedIPs {
+		_, prefix, err := net.ParseCIDR(allowedIP)
+		if err != nil {
+			return wgtypes.PeerConfig{}, err
+		}
+		allowedIPs[i] = *prefix
+	}
+	keepalive := time.Duration(peer.PersistentKeepalive) * time.Second
+	return wgtypes.PeerConfig{
+		PublicKey:                   publicKey,
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  allowedIPs,
+	}, nil
+}
+
+// diffPeers returns the peer configurations required to turn the current
+// peers into the desired ones. Unchanged peers are omitted, changed peers
+// are only updated and peers, which are not desired, removed.
+func diffPeers(current []wgtypes.Peer, desired []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	existing := make(map[wgtypes.Key]wgtypes.Peer, len(current))
+	for _, peer := range current {
+		existing[peer.PublicKey] = peer
+	}
+	changes := []wgtypes.PeerConfig{}
+	for _, config := range desired {
+		peer, ok := existing[config.PublicKey]
+		if !ok {
+			changes = append(changes, config)
+			continue
+		}
+		delete(existing, config.PublicKey)
+		if peer.PersistentKeepaliveInterval == *config.PersistentKeepaliveInterval &&
+			equalPrefixes(peer.AllowedIPs, config.AllowedIPs) {
+			continue
+		}
+		config.UpdateOnly = true
+		changes = append(changes, config)
+	}
+	// Iterate in the order of the current peers to keep the result stable
+	for _, peer := range current {
+		if _, ok := existing[peer.PublicKey]; ok {
+			changes = append(changes, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+		}
+	}
+	return changes
+}
+
+func equalPrefixes(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as, bs := prefixStrings(a), prefixStrings(b)
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func prefixStrings(prefixes []net.IPNet) []string {
+	values := make([]string, len(prefixes))
+	for i := range prefixes {
+		values[i] = prefixes[i].String()
+	}
+	sort.Strings(values)
+	return values
+}
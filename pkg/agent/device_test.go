@@ -0,0 +1,109 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+
+	"github.com/kubism/smorgasbord/pkg/testutil"
+	"github.com/kubism/smorgasbord/pkg/wireguard"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func newKey() string {
+	k, err := wgtypes.GeneratePrivateKey()
+	Expect(err).ToNot(HaveOccurred())
+	return k.PublicKey().String()
+}
+
+var _ = Describe("DeviceApplier", func() {
+	var (
+		device           *testutil.FakeDevice
+		a                *DeviceApplier
+		key1, key2, key3 string
+	)
+	BeforeEach(func() {
+		device = testutil.NewFakeDevice("wg0")
+		a = &DeviceApplier{Client: device, Name: "wg0"}
+		key1, key2, key3 = newKey(), newKey(), newKey()
+		changed, err := a.Apply(context.Background(), []wireguard.Peer{
+			{PublicKey: key1, AllowedIPs: []string{"10.0.0.1/32"}},
+			{PublicKey: key2, AllowedIPs: []string{"10.0.0.2/32", "fd00::2/128"}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+	})
+	It("adds peers", func() {
+		Expect(device.Peers("wg0")).To(Equal(map[string][]string{
+			key1: {"10.0.0.1/32"},
+			key2: {"10.0.0.2/32", "fd00::2/128"},
+		}))
+		Expect(device.Configs).To(HaveLen(1))
+		Expect(device.Configs[0].ReplacePeers).To(BeFalse())
+	})
+	It("does nothing if peers did not change", func() {
+		changed, err := a.Apply(context.Background(), []wireguard.Peer{
+			{PublicKey: key2, AllowedIPs: []string{"fd00::2/128", "10.0.0.2/32"}},
+			{PublicKey: key1, AllowedIPs: []string{"10.0.0.1/32"}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeFalse())
+		Expect(device.Configs).To(HaveLen(1))
+	})
+	It("only applies the difference", func() {
+		changed, err := a.Apply(context.Background(), []wireguard.Peer{
+			{PublicKey: key2, AllowedIPs: []string{"10.0.0.3/32"}},
+			{PublicKey: key3, AllowedIPs: []string{"10.0.0.4/32"}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(device.Peers("wg0")).To(Equal(map[string][]string{
+			key2: {"10.0.0.3/32"},
+			key3: {"10.0.0.4/32"},
+		}))
+		Expect(device.Configs).To(HaveLen(2))
+		config := device.Configs[1]
+		Expect(config.ReplacePeers).To(BeFalse())
+		Expect(config.Peers).To(HaveLen(3))
+		Expect(config.Peers[0].PublicKey.String()).To(Equal(key2))
+		Expect(config.Peers[0].UpdateOnly).To(BeTrue())
+		Expect(config.Peers[0].ReplaceAllowedIPs).To(BeTrue())
+		Expect(config.Peers[1].PublicKey.String()).To(Equal(key3))
+		Expect(config.Peers[1].UpdateOnly).To(BeFalse())
+		Expect(config.Peers[2].PublicKey.String()).To(Equal(key1))
+		Expect(config.Peers[2].Remove).To(BeTrue())
+	})
+	It("skips invalid peers", func() {
+		changed, err := a.Apply(context.Background(), []wireguard.Peer{
+			{PublicKey: "invalid", AllowedIPs: []string{"10.0.0.3/32"}},
+			{PublicKey: key3, AllowedIPs: []string{"invalid"}},
+			{PublicKey: key1, AllowedIPs: []string{"10.0.0.1/32"}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(device.Peers("wg0")).To(Equal(map[string][]string{
+			key1: {"10.0.0.1/32"},
+		}))
+	})
+	It("fails for unknown device", func() {
+		_, err := (&DeviceApplier{Client: device, Name: "wg1"}).Apply(context.Background(), nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/kubism/smorgasbord/pkg/util"
+	"github.com/kubism/smorgasbord/pkg/wireguard"
+
+	"github.com/rs/zerolog"
+)
+
+// FileApplier renders the peers to a file and runs a reload command, e.g.
+// `wg syncconf`, if the file changed.
+type FileApplier struct {
+	// Path of the file the rendered configuration is written to
+	Path string
+	// Header is prepended to the rendered [Peer] sections, e.g. to provide
+	// the [Interface] section of the server
+	Header []byte
+	// ReloadCommand is run using `sh -c` after the configuration changed,
+	// e.g. `wg syncconf wg0 /etc/wireguard/peers.conf`
+	ReloadCommand string
+	Log           zerolog.Logger
+	// reloadPending is set if the configuration was written, but the reload
+	// command failed, so it is retried during the next call to Apply
+	reloadPending bool
+}
+
+// Apply renders the configuration and writes it to the configured path. The
+// reload command is only run if the rendered configuration differs from the
+// existing file.
+func (a *FileApplier) Apply(ctx context.Context, peers []wireguard.Peer) (bool, error) {
+	if a.Path == "" {
+		return false, fmt.Errorf("path is required")
+	}
+	var buf bytes.Buffer
+	buf.Write(a.Header)
+	if len(a.Header) > 0 && len(peers) > 0 {
+		buf.WriteString("\n")
+	}
+	if err := (&wireguard.Config{Peers: peers}).Render(&buf); err != nil {
+		return false, fmt.Errorf("failed to render configuration: %w", err)
+	}
+	current, err := ioutil.ReadFile(a.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	changed := err != nil || !bytes.Equal(current, buf.Bytes())
+	if changed {
+		if err := util.WriteFileAtomic(a.Path, buf.Bytes(), 0600); err != nil {
+			return false, fmt.Errorf("failed to write configuration: %w", err)
+		}
+		a.reloadPending = true
+	}
+	if a.reloadPending {
+		if err := a.reload(ctx); err != nil {
+			return changed, err
+		}
+		a.reloadPending = false
+	}
+	return changed, nil
+}
+
+func (a *FileApplier) reload(ctx context.Context) error {
+	if a.ReloadCommand == "" {
+		return nil
+	}
+	output, err := exec.CommandContext(ctx, "sh", "-c", a.ReloadCommand).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("reload command failed: %w: %s", err, bytes.TrimSpace(output))
+	}
+	a.Log.Info().Str("command", a.ReloadCommand).Msg("reloaded configuration")
+	return nil
+}
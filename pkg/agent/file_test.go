@@ -0,0 +1,100 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileApplier", func() {
+	var tmpDir string
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		_ = os.RemoveAll(tmpDir)
+	})
+	newApplier := func(reloadCommand string) *FileApplier {
+		return &FileApplier{
+			Path:          filepath.Join(tmpDir, "peers.conf"),
+			Header:        []byte("[Interface]\nListenPort = 51820\n"),
+			ReloadCommand: reloadCommand,
+		}
+	}
+	readFile := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, name))
+		Expect(err).ToNot(HaveOccurred())
+		return string(data)
+	}
+	It("renders header and peers", func() {
+		changed, err := newApplier("").Apply(context.Background(), Peers(newTestState(), ""))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(readFile("peers.conf")).To(Equal(`[Interface]
+ListenPort = 51820
+
+[Peer]
+PublicKey = a1
+AllowedIPs = 10.0.0.1/32
+
+[Peer]
+PublicKey = a2
+AllowedIPs = 10.0.0.2/32, fd00::2/128
+
+[Peer]
+PublicKey = b
+AllowedIPs = 10.0.0.3/32
+`))
+	})
+	It("only reloads if configuration changed", func() {
+		a := newApplier("echo reload >> " + filepath.Join(tmpDir, "reloads"))
+		st := newTestState()
+		changed, err := a.Apply(context.Background(), Peers(st, ""))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		changed, err = a.Apply(context.Background(), Peers(st, ""))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeFalse())
+		Expect(strings.Count(readFile("reloads"), "reload")).To(Equal(1))
+		delete(st, "b@test.com")
+		changed, err = a.Apply(context.Background(), Peers(st, ""))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(strings.Count(readFile("reloads"), "reload")).To(Equal(2))
+		Expect(readFile("peers.conf")).ToNot(ContainSubstring("PublicKey = b"))
+	})
+	It("retries failed reloads", func() {
+		marker := filepath.Join(tmpDir, "fail")
+		Expect(ioutil.WriteFile(marker, nil, 0600)).To(Succeed())
+		a := newApplier("test ! -e " + marker)
+		_, err := a.Apply(context.Background(), Peers(newTestState(), ""))
+		Expect(err).To(HaveOccurred())
+		Expect(os.Remove(marker)).To(Succeed())
+		changed, err := a.Apply(context.Background(), Peers(newTestState(), ""))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeFalse())
+	})
+})
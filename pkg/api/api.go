@@ -0,0 +1,335 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/auth"
+	"github.com/kubism/smorgasbord/pkg/keys"
+	"github.com/kubism/smorgasbord/pkg/network"
+	"github.com/kubism/smorgasbord/pkg/policy"
+	"github.com/kubism/smorgasbord/pkg/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AddPeerRequest is the body expected when adding a peer. Besides the public
+// key all fields are optional.
+type AddPeerRequest struct {
+	PublicKey string            `json:"publicKey" binding:"required"`
+	Network   string            `json:"network,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// UpdatePeerRequest is the body expected when updating a peer. The fields
+// replace the current values, so omitted fields are cleared.
+type UpdatePeerRequest struct {
+	Name      string            `json:"name,omitempty"`
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+	Disabled  bool              `json:"disabled,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// ServerInfo describes the wireguard servers of a network peers connect to.
+type ServerInfo struct {
+	Network   string `json:"network"`
+	PublicKey string `json:"publicKey"`
+	// Endpoint is the first of the endpoints, which is used by default
+	Endpoint            string   `json:"endpoint"`
+	Endpoints           []string `json:"endpoints,omitempty"`
+	DNS                 []string `json:"dns,omitempty"`
+	AllowedIPs          []string `json:"allowedIPs"`
+	PersistentKeepalive int      `json:"persistentKeepalive,omitempty"`
+}
+
+// ConfigResponse contains everything required to render the wireguard
+// configurations of the peers of the user except the private keys.
+type ConfigResponse struct {
+	Server ServerInfo      `json:"server"`
+	Peers  []storage.Entry `json:"peers"`
+}
+
+// NewServerInfo returns the information about the network relevant to peers.
+func NewServerInfo(n *network.Network) ServerInfo {
+	info := ServerInfo{
+		Network:             n.Name,
+		PublicKey:           n.PublicKey,
+		Endpoints:           n.Endpoints,
+		DNS:                 n.DNS,
+		AllowedIPs:          n.AllowedIPs,
+		PersistentKeepalive: n.PersistentKeepalive,
+	}
+	if len(n.Endpoints) > 0 {
+		info.Endpoint = n.Endpoints[0]
+	}
+	return info
+}
+
+// ErrorResponse is the body returned if a request failed.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Register adds the routes of the API to the engine. All routes require a
+// valid bearer token and only operate on the entries of the authenticated user.
+// The networks are optional, if not provided only storage.DefaultNetwork
+// without wireguard server can be used. The policy is optional as well, if
+// not provided all users may register any number of keys.
+func Register(r *gin.Engine, h *auth.Handler, s storage.Storage, networks *network.Networks, p *policy.Policy) {
+	if networks == nil {
+		// A single network without CIDRs is always valid
+		networks, _ = network.New([]network.Network{{Name: storage.DefaultNetwork}})
+	}
+	v1 := r.Group("/api/v1", auth.Authenticate(h))
+	v1.GET("/networks", ListNetworks(networks, p))
+	v1.GET("/config", GetConfig(s, networks))
+	v1.GET("/peers", ListPeers(s))
+	v1.POST("/peers", AddPeer(s, networks, p))
+	v1.PUT("/peers/*publicKey", UpdatePeer(s))
+	v1.DELETE("/peers/*publicKey", DeletePeer(s))
+}
+
+// ListNetworks responds with the networks the user may register keys for.
+func ListNetworks(networks *network.Networks, p *policy.Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		infos := []ServerInfo{}
+		for _, n := range networks.List() {
+			if n.Allows(groups(c)) && p.AllowsNetwork(groups(c), n.Name) {
+				infos = append(infos, NewServerInfo(&n))
+			}
+		}
+		c.JSON(http.StatusOK, infos)
+	}
+}
+
+// GetConfig responds with the server info and peers of the network selected
+// by the query parameter, which defaults to storage.DefaultNetwork.
+func GetConfig(s storage.Storage, networks *network.Networks) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n, ok := lookupNetwork(c, networks, c.Query("network"), http.StatusNotFound)
+		if !ok {
+			return
+		}
+		if n.PublicKey == "" {
+			c.JSON(http.StatusNotFound, ErrorResponse{fmt.Sprintf("no wireguard server configured for network %q", n.Name)})
+			return
+		}
+		entries, err := s.List(identity(c))
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, &ConfigResponse{Server: NewServerInfo(n), Peers: filterNetwork(entries, n.Name)})
+	}
+}
+
+// ListPeers responds with the peers of the user, which can be filtered by
+// the network query parameter.
+func ListPeers(s storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		entries, err := s.List(identity(c))
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		if name, ok := c.GetQuery("network"); ok {
+			if name == "" {
+				name = storage.DefaultNetwork
+			}
+			entries = filterNetwork(entries, name)
+		}
+		c.JSON(http.StatusOK, entries)
+	}
+}
+
+// AddPeer adds the public key to the network of the request, which defaults
+// to storage.DefaultNetwork, if the policy allows the user to.
+func AddPeer(s storage.Storage, networks *network.Networks, p *policy.Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req AddPeerRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{fmt.Sprintf("invalid request: %v", err)})
+			return
+		}
+		key, err := keys.ParseKey(req.PublicKey)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{fmt.Sprintf("invalid public key: %v", err)})
+			return
+		}
+		// The canonical encoding is stored, so keys differing in whitespace
+		// or padding bits are detected as duplicates and can be looked up
+		publicKey := key.String()
+		n, ok := lookupNetwork(c, networks, req.Network, http.StatusBadRequest)
+		if !ok {
+			return
+		}
+		// Entries of the default network are stored without network, so
+		// they are compatible with previous versions
+		var entryNetwork string
+		if n.Name != storage.DefaultNetwork {
+			entryNetwork = n.Name
+		}
+		id := identity(c)
+		// The devices of the network are counted within the transaction, so
+		// concurrent requests can not exceed the limit of the policy
+		err = s.Transact(func() error {
+			entries, err := s.List(id)
+			if err != nil {
+				return err
+			}
+			if err := p.AuthorizeAdd(groups(c), n.Name, len(filterNetwork(entries, n.Name))); err != nil {
+				return err
+			}
+			return s.Add(id, storage.Entry{
+				PublicKey: publicKey,
+				Network:   entryNetwork,
+				Name:      req.Name,
+				CreatedBy: id,
+				ExpiresAt: req.ExpiresAt,
+				Labels:    req.Labels,
+			})
+		})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		respondWithEntry(c, s, id, publicKey, http.StatusCreated)
+	}
+}
+
+func UpdatePeer(s storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req UpdatePeerRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{fmt.Sprintf("invalid request: %v", err)})
+			return
+		}
+		id := identity(c)
+		publicKey := strings.TrimPrefix(c.Param("publicKey"), "/")
+		err := s.Transact(func() error {
+			return s.Update(id, storage.Entry{
+				PublicKey: publicKey,
+				Name:      req.Name,
+				ExpiresAt: req.ExpiresAt,
+				Disabled:  req.Disabled,
+				Labels:    req.Labels,
+			})
+		})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		respondWithEntry(c, s, id, publicKey, http.StatusOK)
+	}
+}
+
+func DeletePeer(s storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// The public key is base64 encoded and might therefore contain slashes,
+		// which is why a wildcard parameter is used
+		publicKey := strings.TrimPrefix(c.Param("publicKey"), "/")
+		err := s.Transact(func() error {
+			return s.Delete(identity(c), publicKey)
+		})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// respondWithEntry responds with the current state of the entry, e.g. after
+// it was modified.
+func respondWithEntry(c *gin.Context, s storage.Storage, id, publicKey string, status int) {
+	entries, err := s.List(id)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.PublicKey == publicKey {
+			c.JSON(status, entry)
+			return
+		}
+	}
+	// Can only happen if the entry was removed right after it was modified
+	abortWithError(c, storage.ErrKeyNotFound)
+}
+
+// lookupNetwork returns the network with the provided name, if the user may
+// use it. Otherwise the request is aborted, using the provided status if the
+// network is unknown.
+func lookupNetwork(c *gin.Context, networks *network.Networks, name string, unknownStatus int) (*network.Network, bool) {
+	n, ok := networks.Get(name)
+	if !ok {
+		if name == "" {
+			name = storage.DefaultNetwork
+		}
+		c.AbortWithStatusJSON(unknownStatus, ErrorResponse{fmt.Sprintf("unknown network %q", name)})
+		return nil, false
+	}
+	if !n.Allows(groups(c)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{fmt.Sprintf("not allowed to use network %q", n.Name)})
+		return nil, false
+	}
+	return n, true
+}
+
+// filterNetwork returns the entries of the network.
+func filterNetwork(entries []storage.Entry, name string) []storage.Entry {
+	result := []storage.Entry{}
+	for _, entry := range entries {
+		if entry.NetworkName() == name {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// groups returns the groups of the authenticated user.
+func groups(c *gin.Context) []string {
+	return auth.GetClaims(c).Groups
+}
+
+// identity returns the id of the authenticated user, which is used as key
+// in the storage.
+func identity(c *gin.Context) string {
+	return auth.GetClaims(c).ID
+}
+
+func abortWithError(c *gin.Context, err error) {
+	var conflictErr *storage.ConflictError
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, storage.ErrKeyExists), errors.Is(err, storage.ErrAllowedIPExists),
+		errors.As(err, &conflictErr):
+		status = http.StatusConflict
+	case errors.Is(err, storage.ErrKeyNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, policy.ErrForbidden):
+		status = http.StatusForbidden
+	}
+	c.AbortWithStatusJSON(status, ErrorResponse{err.Error()})
+}
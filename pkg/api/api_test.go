@@ -0,0 +1,259 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/api"
+	"github.com/kubism/smorgasbord/pkg/auth"
+	"github.com/kubism/smorgasbord/pkg/network"
+	"github.com/kubism/smorgasbord/pkg/policy"
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/bolt"
+	"github.com/kubism/smorgasbord/pkg/storage/file"
+
+	"github.com/gin-gonic/gin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func newPublicKey() string {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	Expect(err).ToNot(HaveOccurred())
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+var _ = Describe("API", func() {
+	It("can add, list and delete peers", func() {
+		c := api.NewClient(baseURL, token)
+		publicKey := newPublicKey()
+		entry, err := c.AddPeer(&api.AddPeerRequest{PublicKey: publicKey})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry.PublicKey).To(Equal(publicKey))
+		Expect(entry.AllowedIP).ToNot(BeEmpty())
+		entries, err := c.ListPeers()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(ContainElement(*entry))
+		Expect(c.DeletePeer(publicKey)).To(Succeed())
+		entries, err = c.ListPeers()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).ToNot(ContainElement(*entry))
+	})
+	It("returns configuration of peers", func() {
+		c := api.NewClient(baseURL, token)
+		entry, err := c.AddPeer(&api.AddPeerRequest{PublicKey: newPublicKey()})
+		Expect(err).ToNot(HaveOccurred())
+		config, err := c.GetConfig("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.Server).To(Equal(*serverInfo))
+		Expect(config.Peers).To(ContainElement(*entry))
+	})
+	It("scopes peers to networks", func() {
+		c := api.NewClient(baseURL, token)
+		entry, err := c.AddPeer(&api.AddPeerRequest{PublicKey: newPublicKey(), Network: "office"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry.Network).To(Equal("office"))
+		Expect(entry.AllowedIP).To(HavePrefix("10.1.0."))
+		// Entries of the default network are stored without network
+		defaultEntry, err := c.AddPeer(&api.AddPeerRequest{PublicKey: newPublicKey(), Network: storage.DefaultNetwork})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(defaultEntry.Network).To(BeEmpty())
+		Expect(defaultEntry.AllowedIP).To(HavePrefix("10.0.0."))
+		config, err := c.GetConfig("office")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.Server).To(Equal(*officeInfo))
+		Expect(config.Peers).To(ContainElement(*entry))
+		Expect(config.Peers).ToNot(ContainElement(*defaultEntry))
+		config, err = c.GetConfig(storage.DefaultNetwork)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.Peers).To(ContainElement(*defaultEntry))
+		Expect(config.Peers).ToNot(ContainElement(*entry))
+		_, err = c.GetConfig("unknown")
+		Expect(err).To(MatchError(ContainSubstring("404")))
+		_, err = c.AddPeer(&api.AddPeerRequest{PublicKey: newPublicKey(), Network: "unknown"})
+		Expect(err).To(MatchError(ContainSubstring("400")))
+	})
+	It("restricts networks to groups", func() {
+		c := api.NewClient(baseURL, token)
+		infos, err := c.ListNetworks()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(infos).To(Equal([]api.ServerInfo{*serverInfo, *officeInfo}))
+		_, err = c.AddPeer(&api.AddPeerRequest{PublicKey: newPublicKey(), Network: "restricted"})
+		Expect(err).To(MatchError(ContainSubstring("403")))
+		_, err = c.GetConfig("restricted")
+		Expect(err).To(MatchError(ContainSubstring("403")))
+	})
+	It("enforces the policy", func() {
+		c := api.NewClient(baseURL, token)
+		infos, err := c.ListNetworks()
+		Expect(err).ToNot(HaveOccurred())
+		for _, info := range infos {
+			Expect(info.Network).ToNot(Equal("lab"))
+		}
+		_, err = c.AddPeer(&api.AddPeerRequest{PublicKey: newPublicKey(), Network: "lab"})
+		Expect(err).To(MatchError(ContainSubstring("403")))
+		Expect(err).To(MatchError(ContainSubstring("may register keys for network")))
+	})
+	It("enforces the device limit for concurrent requests", func() {
+		s, err := file.NewStorage(filepath.Join(tmpDir, "limit", "smorgasbord.json"), nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		networks, err := network.New([]network.Network{{Name: storage.DefaultNetwork}})
+		Expect(err).ToNot(HaveOccurred())
+		p := &policy.Policy{Rules: []policy.Rule{{Group: policy.AllUsers, MaxDevices: 3}}}
+		engine := gin.New()
+		engine.POST("/peers", func(c *gin.Context) {
+			c.Set(auth.ClaimsKey, &auth.ExtraClaims{ID: "limit@test.com"})
+		}, api.AddPeer(s, networks, p))
+		const n = 10
+		var wg sync.WaitGroup
+		codes := make(chan int, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				body := fmt.Sprintf(`{"publicKey":%q}`, newPublicKey())
+				rec := httptest.NewRecorder()
+				engine.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/peers", strings.NewReader(body)))
+				codes <- rec.Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+		created := 0
+		for code := range codes {
+			if code == http.StatusCreated {
+				created++
+			} else {
+				Expect(code).To(Equal(http.StatusForbidden))
+			}
+		}
+		Expect(created).To(Equal(3))
+		Expect(s.List("limit@test.com")).To(HaveLen(3))
+	})
+	It("counts the devices of the network for the device limit", func() {
+		s, err := file.NewStorage(filepath.Join(tmpDir, "limit-networks", "smorgasbord.json"), nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		networks, err := network.New([]network.Network{{Name: storage.DefaultNetwork}, {Name: "office"}})
+		Expect(err).ToNot(HaveOccurred())
+		p := &policy.Policy{Rules: []policy.Rule{{Group: policy.AllUsers, MaxDevices: 1}}}
+		engine := gin.New()
+		engine.POST("/peers", func(c *gin.Context) {
+			c.Set(auth.ClaimsKey, &auth.ExtraClaims{ID: "limit-networks@test.com"})
+		}, api.AddPeer(s, networks, p))
+		codes := []int{}
+		for _, name := range []string{"", "office", "office", storage.DefaultNetwork} {
+			body := fmt.Sprintf(`{"publicKey":%q,"network":%q}`, newPublicKey(), name)
+			rec := httptest.NewRecorder()
+			engine.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/peers", strings.NewReader(body)))
+			codes = append(codes, rec.Code)
+		}
+		Expect(codes).To(Equal([]int{http.StatusCreated, http.StatusCreated, http.StatusForbidden, http.StatusForbidden}))
+		Expect(s.List("limit-networks@test.com")).To(HaveLen(2))
+	})
+	It("rejects allowed IPs already in use", func() {
+		s, err := bolt.NewStorage(&bolt.Options{
+			Path: filepath.Join(tmpDir, "allowed-ips", "smorgasbord.db"),
+			Allocator: storage.AllocatorFunc(func([]string) (string, error) {
+				return "10.0.0.1/32", nil
+			}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		networks, err := network.New([]network.Network{{Name: storage.DefaultNetwork}})
+		Expect(err).ToNot(HaveOccurred())
+		engine := gin.New()
+		engine.POST("/peers", func(c *gin.Context) {
+			c.Set(auth.ClaimsKey, &auth.ExtraClaims{ID: "allowed-ips@test.com"})
+		}, api.AddPeer(s, networks, nil))
+		codes := []int{}
+		for i := 0; i < 2; i++ {
+			body := fmt.Sprintf(`{"publicKey":%q}`, newPublicKey())
+			rec := httptest.NewRecorder()
+			engine.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/peers", strings.NewReader(body)))
+			codes = append(codes, rec.Code)
+		}
+		Expect(codes).To(Equal([]int{http.StatusCreated, http.StatusConflict}))
+	})
+	It("rejects duplicate and invalid public keys", func() {
+		c := api.NewClient(baseURL, token)
+		publicKey := newPublicKey()
+		_, err := c.AddPeer(&api.AddPeerRequest{PublicKey: publicKey})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = c.AddPeer(&api.AddPeerRequest{PublicKey: publicKey})
+		Expect(err).To(MatchError(ContainSubstring("409")))
+		// Keys are stored in their canonical encoding
+		_, err = c.AddPeer(&api.AddPeerRequest{PublicKey: " " + publicKey + "\n"})
+		Expect(err).To(MatchError(ContainSubstring("409")))
+		other := newPublicKey()
+		entry, err := c.AddPeer(&api.AddPeerRequest{PublicKey: " " + other + "\n"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry.PublicKey).To(Equal(other))
+		_, err = c.AddPeer(&api.AddPeerRequest{PublicKey: "invalid"})
+		Expect(err).To(MatchError(ContainSubstring("400")))
+	})
+	It("stores and updates metadata of peers", func() {
+		c := api.NewClient(baseURL, token)
+		publicKey := newPublicKey()
+		expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		entry, err := c.AddPeer(&api.AddPeerRequest{
+			PublicKey: publicKey,
+			Name:      "laptop",
+			ExpiresAt: &expiry,
+			Labels:    map[string]string{"os": "linux"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry.Name).To(Equal("laptop"))
+		Expect(entry.CreatedBy).ToNot(BeEmpty())
+		Expect(entry.CreatedAt).ToNot(BeNil())
+		Expect(entry.ExpiresAt.Equal(expiry)).To(BeTrue())
+		Expect(entry.Labels).To(HaveKeyWithValue("os", "linux"))
+		entry, err = c.UpdatePeer(publicKey, &api.UpdatePeerRequest{Name: "desktop", Disabled: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry.Name).To(Equal("desktop"))
+		Expect(entry.Disabled).To(BeTrue())
+		Expect(entry.ExpiresAt).To(BeNil())
+		Expect(entry.Labels).To(BeEmpty())
+		_, err = c.UpdatePeer(newPublicKey(), &api.UpdatePeerRequest{})
+		Expect(err).To(MatchError(ContainSubstring("404")))
+	})
+	It("fails to delete unknown peers", func() {
+		c := api.NewClient(baseURL, token)
+		Expect(c.DeletePeer(newPublicKey())).To(MatchError(ContainSubstring("404")))
+	})
+	It("rejects requests without valid token", func() {
+		res, err := http.Get(baseURL + "/api/v1/peers")
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		_, err = api.NewClient(baseURL, "invalid").ListPeers()
+		Expect(err).To(MatchError(ContainSubstring("401")))
+	})
+})
@@ -0,0 +1,139 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+)
+
+// Client is used to interact with the API of a smorgasbord server on behalf
+// of the user the token was issued to.
+type Client struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewClient creates a client for the server at baseURL. The token is expected
+// to be encoded as received by auth.Client.
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: baseURL,
+		token:   token,
+		client:  &http.Client{},
+	}
+}
+
+// ListNetworks returns the networks the user may use.
+func (c *Client) ListNetworks() ([]ServerInfo, error) {
+	infos := []ServerInfo{}
+	if err := c.do(http.MethodGet, "/api/v1/networks", nil, http.StatusOK, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// GetConfig returns the information about the wireguard server and the peers
+// of the user in the network required to render their configurations. The
+// empty network refers to the default network.
+func (c *Client) GetConfig(network string) (*ConfigResponse, error) {
+	config := &ConfigResponse{}
+	path := "/api/v1/config"
+	if network != "" {
+		path += "?network=" + url.QueryEscape(network)
+	}
+	if err := c.do(http.MethodGet, path, nil, http.StatusOK, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ListPeers returns all peers of the user.
+func (c *Client) ListPeers() ([]storage.Entry, error) {
+	entries := []storage.Entry{}
+	if err := c.do(http.MethodGet, "/api/v1/peers", nil, http.StatusOK, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// AddPeer registers the public key for the user and returns the resulting
+// entry including the assigned allowed IP.
+func (c *Client) AddPeer(req *AddPeerRequest) (*storage.Entry, error) {
+	entry := &storage.Entry{}
+	if err := c.do(http.MethodPost, "/api/v1/peers", req, http.StatusCreated, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// UpdatePeer replaces the metadata of the public key of the user and returns
+// the resulting entry.
+func (c *Client) UpdatePeer(publicKey string, req *UpdatePeerRequest) (*storage.Entry, error) {
+	entry := &storage.Entry{}
+	if err := c.do(http.MethodPut, "/api/v1/peers/"+url.PathEscape(publicKey), req, http.StatusOK, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// DeletePeer removes the public key of the user.
+func (c *Client) DeletePeer(publicKey string) error {
+	return c.do(http.MethodDelete, "/api/v1/peers/"+url.PathEscape(publicKey), nil, http.StatusNoContent, nil)
+}
+
+func (c *Client) do(method, path string, in interface{}, expectedStatus int, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != expectedStatus {
+		errRes := &ErrorResponse{}
+		if err := json.NewDecoder(res.Body).Decode(errRes); err != nil || errRes.Error == "" {
+			return fmt.Errorf("unexpected status code received: %d", res.StatusCode)
+		}
+		return fmt.Errorf("unexpected status code received: %d: %s", res.StatusCode, errRes.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/kubism/smorgasbord/internal/flags"
+	"github.com/kubism/smorgasbord/pkg/api"
+	"github.com/kubism/smorgasbord/pkg/auth"
+	"github.com/kubism/smorgasbord/pkg/network"
+	"github.com/kubism/smorgasbord/pkg/policy"
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/git"
+	"github.com/kubism/smorgasbord/pkg/testutil"
+	"github.com/kubism/smorgasbord/pkg/util"
+
+	"github.com/gin-gonic/gin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var (
+	serverInfo = &api.ServerInfo{
+		Network:    storage.DefaultNetwork,
+		PublicKey:  "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=",
+		Endpoint:   "vpn.example.com:51820",
+		Endpoints:  []string{"vpn.example.com:51820"},
+		AllowedIPs: []string{"10.0.0.0/24"},
+	}
+	officeInfo = &api.ServerInfo{
+		Network:    "office",
+		PublicKey:  "mJ6fWr4XAbMSpdHTkxq7ajJhMkNZ7Ckx7sRgrQS4V0Y=",
+		Endpoint:   "office.example.com:51820",
+		Endpoints:  []string{"office.example.com:51820", "office2.example.com:51820"},
+		AllowedIPs: []string{"10.1.0.0/24"},
+	}
+	dex       *testutil.Dex
+	gitServer *testutil.GitServer
+	server    *http.Server
+	serverLis net.Listener
+	baseURL   string
+	token     string
+	tmpDir    string
+)
+
+func TestAPI(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "pkg/api")
+}
+
+var _ = BeforeSuite(func(done Done) {
+	var err error
+	tmpDir, err = ioutil.TempDir("", "smorgasbord")
+	Expect(err).ToNot(HaveOccurred())
+	gitServer, err = testutil.NewGitServer(tmpDir)
+	Expect(err).ToNot(HaveOccurred())
+	repositoryURL := fmt.Sprintf("http://%s/test.git", gitServer.GetAddr())
+	Expect(testutil.InitRepository(repositoryURL, map[string]string{
+		"README.md": "# Test",
+	})).To(Succeed())
+	networks, err := network.New([]network.Network{{
+		Name:       storage.DefaultNetwork,
+		CIDRs:      []string{"10.0.0.0/24"},
+		PublicKey:  serverInfo.PublicKey,
+		Endpoints:  serverInfo.Endpoints,
+		AllowedIPs: serverInfo.AllowedIPs,
+	}, {
+		Name:      "office",
+		CIDRs:     []string{"10.1.0.0/24"},
+		PublicKey: officeInfo.PublicKey,
+		Endpoints: officeInfo.Endpoints,
+	}, {
+		Name:   "restricted",
+		CIDRs:  []string{"10.2.0.0/24"},
+		Groups: []string{"admins"},
+	}, {
+		Name:  "lab",
+		CIDRs: []string{"10.3.0.0/24"},
+	}})
+	Expect(err).ToNot(HaveOccurred())
+	// Keys may not be registered for the lab network by anyone
+	p := &policy.Policy{Rules: []policy.Rule{{
+		Group:    "authors",
+		Networks: []string{storage.DefaultNetwork, "office", "restricted"},
+	}}}
+	Expect(p.Validate(networks.Names())).To(Succeed())
+	s, err := git.NewStorage(&git.Options{RepositoryURL: repositoryURL, Allocator: networks})
+	Expect(err).ToNot(HaveOccurred())
+	serverPort, err := util.GetFreePort()
+	Expect(err).ToNot(HaveOccurred())
+	serverAddr := fmt.Sprintf("127.0.0.1:%d", serverPort)
+	baseURL = fmt.Sprintf("http://%s", serverAddr)
+	redirectURL := fmt.Sprintf("%s/auth/callback", baseURL)
+	dex, err = testutil.NewDex(redirectURL)
+	Expect(err).ToNot(HaveOccurred())
+	handler, err := auth.NewHandler(&auth.HandlerConfig{
+		ClientID:           testutil.DexClientID,
+		ClientSecret:       testutil.DexClientSecret,
+		IssuerURL:          dex.GetIssuerURL(),
+		AuthCodeURLMutator: dex.GetAuthCodeURLMutator(),
+		RedirectURL:        redirectURL,
+		Nonce:              "test",
+	})
+	Expect(err).ToNot(HaveOccurred())
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	auth.Register(engine, handler)
+	api.Register(engine, handler, s, networks, p)
+	server = &http.Server{Addr: serverAddr, Handler: engine}
+	serverLis, err = net.Listen("tcp", serverAddr)
+	Expect(err).ToNot(HaveOccurred())
+	go func() {
+		if err := server.Serve(serverLis); err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+	token = login()
+	close(done)
+}, 240)
+
+var _ = AfterSuite(func() {
+	if dex != nil {
+		_ = dex.Close()
+	}
+	if server != nil {
+		_ = server.Close()
+	}
+	if serverLis != nil {
+		_ = serverLis.Close()
+	}
+	if gitServer != nil {
+		_ = gitServer.Close()
+	}
+	if tmpDir != "" {
+		_ = os.RemoveAll(tmpDir)
+	}
+})
+
+// login runs the OIDC flow against dex and returns the token received by the
+// client. Dex's mock connector does not require any user interaction.
+func login() string {
+	client := auth.NewClient(baseURL)
+	defer client.Close()
+	Expect(client.StartCallbackServer()).To(Succeed())
+	authCodeURL, err := client.GetAuthCodeURL()
+	Expect(err).ToNot(HaveOccurred())
+	res, err := http.Get(authCodeURL)
+	Expect(err).ToNot(HaveOccurred())
+	defer res.Body.Close()
+	Expect(res.StatusCode).To(Equal(http.StatusOK))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	Expect(client.WaitUntilTokenReceived(ctx)).To(Succeed())
+	return client.GetToken()
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// CallbackPath is the only path loopback callbacks, e.g. of the CLI, may use.
+const CallbackPath = "/callback"
+
+// parseOrigins validates the allowed callback origins and normalizes them to
+// the form scheme://host[:port].
+func parseOrigins(origins []string) (map[string]bool, error) {
+	parsed := map[string]bool{}
+	for _, origin := range origins {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid callback origin %q: %v", origin, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil ||
+			(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("invalid callback origin %q: expected scheme://host[:port]", origin)
+		}
+		parsed[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+	return parsed, nil
+}
+
+// parseCallback returns the callback URL, if it either points to CallbackPath
+// of a loopback address or to one of the allowed origins. Any other callback
+// is rejected, as the token of the user is passed to it.
+func (h *Handler) parseCallback(callback string) (*url.URL, error) {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return nil, fmt.Errorf("invalid callback: %v", err)
+	}
+	if !u.IsAbs() || u.Host == "" || u.User != nil || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid callback %q: expected absolute URL", callback)
+	}
+	if u.Scheme == "http" && isLoopback(u.Hostname()) {
+		if u.Path != CallbackPath {
+			return nil, fmt.Errorf("callback %q is not allowed: loopback callbacks must use path %s", callback, CallbackPath)
+		}
+		return u, nil
+	}
+	if !h.callbackOrigins[strings.ToLower(u.Scheme+"://"+u.Host)] {
+		return nil, fmt.Errorf("callback %q is not allowed: origin is neither loopback nor configured", callback)
+	}
+	return u, nil
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
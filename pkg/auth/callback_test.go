@@ -0,0 +1,61 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Callback", func() {
+	It("allows loopback and configured callbacks only", func() {
+		origins, err := parseOrigins([]string{"https://app.example.com", "http://LOCAL.example.com:8080/"})
+		Expect(err).ToNot(HaveOccurred())
+		h := &Handler{callbackOrigins: origins}
+		for _, callback := range []string{
+			"http://127.0.0.1:12345/callback",
+			"http://[::1]:12345/callback?a=b",
+			"http://localhost:8000/callback",
+			"https://app.example.com/logged-in",
+			"http://local.example.com:8080/",
+		} {
+			_, err := h.parseCallback(callback)
+			Expect(err).ToNot(HaveOccurred(), callback)
+		}
+		for _, callback := range []string{
+			"",
+			"/callback",
+			"https://evil.example.com/callback",
+			"https://app.example.com.evil.com/callback",
+			"http://app.example.com/logged-in",
+			"http://127.0.0.1:12345/other",
+			"https://127.0.0.1:12345/callback",
+			"http://user@127.0.0.1:12345/callback",
+			"http://local.example.com/",
+			"//evil.example.com/callback",
+		} {
+			_, err := h.parseCallback(callback)
+			Expect(err).To(HaveOccurred(), callback)
+		}
+	})
+	It("validates origins", func() {
+		for _, origin := range []string{"app.example.com", "ftp://app.example.com", "https://app.example.com/path", "https://"} {
+			_, err := parseOrigins([]string{origin})
+			Expect(err).To(HaveOccurred(), origin)
+		}
+	})
+})
@@ -0,0 +1,43 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Groups", func() {
+	It("extracts groups of claims", func() {
+		raw := map[string]interface{}{
+			"groups":       []interface{}{"a", "b"},
+			"role":         "admin",
+			"realm_access": map[string]interface{}{"roles": []interface{}{"c"}},
+			"invalid":      []interface{}{1},
+			"number":       1.0,
+		}
+		Expect(extractGroups(raw, "groups")).To(Equal([]string{"a", "b"}))
+		Expect(extractGroups(raw, "role")).To(Equal([]string{"admin"}))
+		Expect(extractGroups(raw, "realm_access.roles")).To(Equal([]string{"c"}))
+		Expect(extractGroups(raw, "missing")).To(BeEmpty())
+		Expect(extractGroups(raw, "role.missing")).To(BeEmpty())
+		_, err := extractGroups(raw, "invalid")
+		Expect(err).To(HaveOccurred())
+		_, err = extractGroups(raw, "number")
+		Expect(err).To(HaveOccurred())
+	})
+})
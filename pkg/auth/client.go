@@ -18,9 +18,13 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/kubism/smorgasbord/pkg/util"
 
@@ -30,11 +34,14 @@ import (
 type Client struct {
 	baseURL     string
 	callbackURL string
-	client      *http.Client
-	server      *http.Server
-	serverLis   net.Listener
-	received    chan string
-	token       string
+	// challenge is derived from the verifier generated for each login via
+	// the callback server, which is required to redeem the handoff code
+	challenge string
+	client    *http.Client
+	server    *http.Server
+	serverLis net.Listener
+	received  chan string
+	token     string
 }
 
 func NewClient(baseURL string) *Client {
@@ -52,12 +59,22 @@ func NewClient(baseURL string) *Client {
 func (c *Client) StartCallbackServer() error {
 	// NOTE: the callback server basically consists of three components, which
 	// will be cleaned up by StopCallbackServer:
-	// server, serverLis and callbackURL
+	// server, serverLis, callbackURL and challenge
+	verifier, challenge, err := NewCodeVerifier()
+	if err != nil {
+		return err
+	}
+	c.challenge = challenge
 	engine := gin.New()
 	engine.GET("/callback", func(g *gin.Context) {
-		token := g.Query(QueryTokenKey)
-		if token == "" {
-			g.String(http.StatusBadRequest, "Did not receive token")
+		code := g.Query(QueryCodeKey)
+		if code == "" {
+			g.String(http.StatusBadRequest, "Did not receive handoff code")
+			return
+		}
+		token, err := c.redeemHandoff(code, verifier)
+		if err != nil {
+			g.String(http.StatusBadRequest, fmt.Sprintf("Failed to redeem handoff code: %v", err))
 			return
 		}
 		g.String(http.StatusOK, "Successfully logged in navigate to terminal.")
@@ -92,7 +109,8 @@ func (c *Client) GetAuthCodeURL() (string, error) {
 	if c.callbackURL == "" {
 		return "", fmt.Errorf("callback URL not available, make sure to start the callback server first")
 	}
-	res, err := c.client.Get(fmt.Sprintf("%s/auth/login?callback=%s", c.baseURL, c.callbackURL))
+	query := url.Values{"callback": {c.callbackURL}, "code_challenge": {c.challenge}}
+	res, err := c.client.Get(fmt.Sprintf("%s/auth/login?%s", c.baseURL, query.Encode()))
 	if err != nil {
 		return "", err
 	}
@@ -119,11 +137,106 @@ func (c *Client) WaitUntilTokenReceived(ctx context.Context) error {
 	return nil
 }
 
+// StartDeviceAuth initiates the device authorization grant via the server.
+// The user has to visit the verification URI and enter the user code of the
+// response, e.g. on another device with a browser. Afterwards the token can be
+// retrieved using WaitUntilDeviceAuthorized. The callback server is not
+// required for this flow.
+func (c *Client) StartDeviceAuth() (*DeviceAuthResponse, error) {
+	res, err := c.client.Post(fmt.Sprintf("%s/auth/device", c.baseURL), "application/x-www-form-urlencoded", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeDeviceTokenError(res)
+	}
+	deviceAuth := &DeviceAuthResponse{}
+	if err := json.NewDecoder(res.Body).Decode(deviceAuth); err != nil {
+		return nil, err
+	}
+	return deviceAuth, nil
+}
+
+// WaitUntilDeviceAuthorized will poll the server in the interval requested by
+// the issuer until either the token was received, the authorization failed or
+// the context is done.
+func (c *Client) WaitUntilDeviceAuthorized(ctx context.Context, deviceAuth *DeviceAuthResponse) error {
+	interval := time.Duration(deviceAuth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second // Default as defined by RFC 8628
+	}
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return fmt.Errorf("failed to receive token before context done")
+		}
+		token, err := c.pollDeviceToken(deviceAuth.DeviceCode)
+		var tokenErr *DeviceTokenError
+		if errors.As(err, &tokenErr) && tokenErr.Pending() {
+			if tokenErr.Code == DeviceErrSlowDown {
+				interval += 5 * time.Second
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		c.token = token
+		return nil
+	}
+}
+
+func (c *Client) pollDeviceToken(deviceCode string) (string, error) {
+	form := url.Values{"device_code": {deviceCode}}
+	res, err := c.client.PostForm(fmt.Sprintf("%s/auth/device/token", c.baseURL), form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", decodeDeviceTokenError(res)
+	}
+	tokenRes := &DeviceTokenResponse{}
+	if err := json.NewDecoder(res.Body).Decode(tokenRes); err != nil {
+		return "", err
+	}
+	return tokenRes.Token, nil
+}
+
+// redeemHandoff exchanges the handoff code received by the callback server
+// for the token using a direct request to the server.
+func (c *Client) redeemHandoff(code, verifier string) (string, error) {
+	form := url.Values{"code": {code}, "code_verifier": {verifier}}
+	res, err := c.client.PostForm(fmt.Sprintf("%s/auth/token", c.baseURL), form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", decodeDeviceTokenError(res)
+	}
+	handoffRes := &HandoffResponse{}
+	if err := json.NewDecoder(res.Body).Decode(handoffRes); err != nil {
+		return "", err
+	}
+	return handoffRes.Token, nil
+}
+
+func decodeDeviceTokenError(res *http.Response) error {
+	tokenErr := &DeviceTokenError{}
+	if err := json.NewDecoder(res.Body).Decode(tokenErr); err != nil || tokenErr.Code == "" {
+		return fmt.Errorf("unexpected status code received: %d", res.StatusCode)
+	}
+	return tokenErr
+}
+
 // StopCallbackServer will shutdown the server, which receives the token by
 // being the final redirect as part of the OIDC flow.
 func (c *Client) StopCallbackServer() error {
 	var err error
 	c.callbackURL = ""
+	c.challenge = ""
 	if c.server != nil {
 		err = c.server.Shutdown(context.Background())
 		c.server = nil
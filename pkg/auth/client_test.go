@@ -18,10 +18,17 @@ package auth_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"time"
 
+	"github.com/kubism/smorgasbord/pkg/auth"
+	"github.com/kubism/smorgasbord/pkg/testutil"
+
+	"golang.org/x/oauth2"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -48,6 +55,40 @@ var _ = Describe("Client", func() {
 		_, err = url.Parse(authCodeURL)
 		Expect(err).ToNot(HaveOccurred())
 	})
+	It("rejects callbacks, which are not allowed", func() {
+		c := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		for _, callback := range []string{"https://evil.example.com/callback", "http://127.0.0.1:1234/other", ""} {
+			res, err := c.Get(fmt.Sprintf("%s/auth/login?callback=%s", baseURL, url.QueryEscape(callback)))
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest), callback)
+		}
+	})
+	It("requires a challenge and verifier to hand off tokens", func() {
+		c := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		query := url.Values{"callback": {"http://127.0.0.1:1234/callback"}}
+		res, err := c.Get(fmt.Sprintf("%s/auth/login?%s", baseURL, query.Encode()))
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		query.Set("code_challenge", auth.CodeChallenge("verifier"))
+		res, err = c.Get(fmt.Sprintf("%s/auth/login?%s", baseURL, query.Encode()))
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusSeeOther))
+		res, err = c.PostForm(fmt.Sprintf("%s/auth/token", baseURL), url.Values{"code": {"unknown"}, "code_verifier": {"verifier"}})
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+	})
 	It("can log user in and retrieve token", func() {
 		Expect(client.StartCallbackServer()).To(Succeed())
 		authCodeURL, err := client.GetAuthCodeURL()
@@ -59,4 +100,72 @@ var _ = Describe("Client", func() {
 		Expect(client.GetToken()).ToNot(Equal(""))
 		Expect(client.StopCallbackServer()).To(Succeed())
 	})
+	It("passes refresh token of login to callback", func() {
+		Expect(client.StartCallbackServer()).To(Succeed())
+		defer func() {
+			Expect(client.StopCallbackServer()).To(Succeed())
+		}()
+		authCodeURL, err := client.GetAuthCodeURL()
+		Expect(err).ToNot(HaveOccurred())
+		simulateUserLoginInBrowser(authCodeURL)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Expect(client.WaitUntilTokenReceived(ctx)).To(Succeed())
+		token := lastLogin()
+		Expect(token).ToNot(BeNil())
+		Expect(token.RefreshToken).ToNot(BeEmpty())
+		refreshed, err := handler.Refresh(ctx, token.RefreshToken)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshed.AccessToken).ToNot(BeEmpty())
+		// Refresh tokens are rotated, so the previous one is rejected
+		_, err = handler.Refresh(ctx, token.RefreshToken)
+		Expect(err).To(HaveOccurred())
+		var retrieveErr *oauth2.RetrieveError
+		Expect(errors.As(err, &retrieveErr)).To(BeTrue())
+	})
+	It("can log user in using device authorization grant", func() {
+		deviceAuth, err := client.StartDeviceAuth()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(deviceAuth.UserCode).ToNot(BeEmpty())
+		Expect(deviceAuth.VerificationURIComplete).ToNot(BeEmpty())
+		simulateUserLoginInBrowser(deviceAuth.VerificationURIComplete)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		Expect(client.WaitUntilDeviceAuthorized(ctx, deviceAuth)).To(Succeed())
+		token, err := auth.DecodeToken(client.GetToken())
+		Expect(err).ToNot(HaveOccurred())
+		claims, err := handler.VerifyClaims(ctx, token)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(claims.Email).ToNot(BeEmpty())
+		Expect(claims.ID).To(Equal(claims.Email))
+		// The groups scope is requested, as dex supports it
+		Expect(claims.Groups).To(ContainElement("authors"))
+		// Other handlers of the same issuer can identify and restrict users
+		// differently
+		newHandler := func(config auth.HandlerConfig) *auth.Handler {
+			config.ClientID = testutil.DexClientID
+			config.IssuerURL = dex.GetIssuerURL()
+			h, err := auth.NewHandler(&config)
+			Expect(err).ToNot(HaveOccurred())
+			return h
+		}
+		claims, err = newHandler(auth.HandlerConfig{
+			IdentityClaim:       auth.SubjectClaim,
+			AllowedEmailDomains: []string{"KILGORE.trout"},
+		}).VerifyClaims(ctx, token)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(claims.ID).To(Equal(claims.Subject))
+		_, err = newHandler(auth.HandlerConfig{IdentityClaim: "missing"}).VerifyClaims(ctx, token)
+		Expect(err).To(MatchError(ContainSubstring("identity claim")))
+		_, err = newHandler(auth.HandlerConfig{AllowedEmailDomains: []string{"example.com"}}).VerifyClaims(ctx, token)
+		Expect(errors.Is(err, auth.ErrNotAllowed)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring(`email domain "kilgore.trout"`)))
+	})
+	It("stops polling if device authorization is not finished in time", func() {
+		deviceAuth, err := client.StartDeviceAuth()
+		Expect(err).ToNot(HaveOccurred())
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		defer cancel()
+		Expect(client.WaitUntilDeviceAuthorized(ctx, deviceAuth)).ToNot(Succeed())
+	})
 })
@@ -0,0 +1,162 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// DeviceCodeGrantType is the grant type used to poll the token endpoint as
+// part of the device authorization grant (RFC 8628).
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Error codes returned while polling for the token, which indicate that the
+// client should continue polling.
+const (
+	DeviceErrAuthorizationPending = "authorization_pending"
+	DeviceErrSlowDown             = "slow_down"
+)
+
+// DeviceAuthResponse is the response of the device authorization endpoint,
+// which is passed through to the client.
+type DeviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+// DeviceTokenError is returned if the token could not be retrieved using the
+// device code, e.g. because the user did not finish the authorization yet.
+type DeviceTokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *DeviceTokenError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// Pending returns true if the client should continue polling.
+func (e *DeviceTokenError) Pending() bool {
+	return e.Code == DeviceErrAuthorizationPending || e.Code == DeviceErrSlowDown
+}
+
+// StartDeviceAuth initiates the device authorization grant at the issuer.
+func (h *Handler) StartDeviceAuth(ctx context.Context) (*DeviceAuthResponse, error) {
+	if h.config.DeviceAuthURL == "" {
+		return nil, fmt.Errorf("issuer %q does not support the device authorization grant", h.config.IssuerURL)
+	}
+	form := url.Values{
+		"client_id": {h.config.ClientID},
+		"scope":     {strings.Join(h.getScopes(), " ")},
+	}
+	res, err := h.postForm(ctx, h.config.DeviceAuthURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device authorization failed with status code %d", res.StatusCode)
+	}
+	deviceAuth := &DeviceAuthResponse{}
+	if err := json.NewDecoder(res.Body).Decode(deviceAuth); err != nil {
+		return nil, fmt.Errorf("failed to decode device authorization response: %v", err)
+	}
+	return deviceAuth, nil
+}
+
+// ExchangeDeviceCode will try to retrieve the token for the device code. If
+// the user did not authorize the device yet, a *DeviceTokenError is returned.
+func (h *Handler) ExchangeDeviceCode(ctx context.Context, deviceCode string) (*oauth2.Token, error) {
+	form := url.Values{
+		"grant_type":  {DeviceCodeGrantType},
+		"device_code": {deviceCode},
+		"client_id":   {h.config.ClientID},
+	}
+	res, err := h.postForm(ctx, h.provider.Endpoint().TokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		tokenErr := &DeviceTokenError{}
+		if err := json.Unmarshal(data, tokenErr); err != nil || tokenErr.Code == "" {
+			return nil, fmt.Errorf("token request failed with status code %d", res.StatusCode)
+		}
+		return nil, tokenErr
+	}
+	var raw struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		IDToken      string `json:"id_token"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %v", err)
+	}
+	token := &oauth2.Token{
+		AccessToken:  raw.AccessToken,
+		TokenType:    raw.TokenType,
+		RefreshToken: raw.RefreshToken,
+	}
+	if raw.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(raw.ExpiresIn) * time.Second)
+	}
+	return token.WithExtra(map[string]interface{}{"id_token": raw.IDToken}), nil
+}
+
+func (h *Handler) postForm(ctx context.Context, endpoint string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(h.config.ClientID), url.QueryEscape(h.config.ClientSecret))
+	return h.httpClient.Do(req.WithContext(ctx))
+}
+
+func (h *Handler) getScopes() []string {
+	scopes := []string{oidc.ScopeOpenID, "profile", "email"}
+	if h.config.OfflineAsScope {
+		scopes = append(scopes, oidc.ScopeOfflineAccess)
+	}
+	if h.groupsScope {
+		scopes = append(scopes, "groups")
+	}
+	return scopes
+}
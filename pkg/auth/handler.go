@@ -22,8 +22,10 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc"
@@ -32,11 +34,39 @@ import (
 
 type State struct {
 	Callback string `form:"callback" json:"callback,omitempty"`
+	// Challenge is derived from the verifier of the client, which is
+	// required to redeem the handoff code passed to the callback
+	Challenge string `form:"code_challenge" json:"challenge,omitempty"`
 }
 
+// DefaultGroupsClaim is the claim containing the groups of the user, unless
+// configured otherwise.
+const DefaultGroupsClaim = "groups"
+
+// Common claims, which can be used to identify users. Any other claim
+// containing a string can be used as well.
+const (
+	SubjectClaim           = "sub"
+	EmailClaim             = "email"
+	PreferredUsernameClaim = "preferred_username"
+	// DefaultIdentityClaim is the claim identifying users, unless configured
+	// otherwise.
+	DefaultIdentityClaim = EmailClaim
+)
+
+// ErrNotAllowed is wrapped by all errors returned if a user, who was
+// successfully authenticated, is not allowed to use the service.
+var ErrNotAllowed = errors.New("not allowed")
+
 type ExtraClaims struct {
+	Subject       string `json:"sub"`
 	Email         string `json:"email"`
 	EmailVerified bool   `json:"email_verified"`
+	// ID is extracted from the configured identity claim and identifies the
+	// user, e.g. as key of the storage
+	ID string `json:"-"`
+	// Groups are extracted from the configured groups claim
+	Groups []string `json:"-"`
 }
 
 type HandlerConfig struct {
@@ -47,13 +77,50 @@ type HandlerConfig struct {
 	RedirectURL        string
 	Nonce              string
 	AuthCodeURLMutator func(string) string
+	// DeviceAuthURL is the device authorization endpoint of the issuer. If
+	// not set, it is discovered from the provider metadata.
+	DeviceAuthURL string
+	// OnLogin is called after a user successfully logged in, e.g. to store
+	// the refresh token of the user.
+	OnLogin func(ctx context.Context, claims *ExtraClaims, token *oauth2.Token)
+	// GroupsClaim is the claim of the ID token containing the groups of the
+	// user, defaults to DefaultGroupsClaim. Nested claims can be selected
+	// using dots, e.g. realm_access.roles.
+	GroupsClaim string
+	// IdentityClaim is the claim of the ID token identifying the user,
+	// defaults to DefaultIdentityClaim. As emails might change, the subject
+	// is the better choice for new installments. Nested claims can be
+	// selected using dots.
+	IdentityClaim string
+	// AllowedEmailDomains restricts the service to users with a verified
+	// email of one of the domains. All domains are allowed if empty.
+	AllowedEmailDomains []string
+	// AllowedCallbackOrigins are the origins (scheme://host[:port]) of web
+	// applications, which may receive tokens via the callback. Loopback
+	// callbacks on CallbackPath, e.g. of the CLI, are always allowed.
+	AllowedCallbackOrigins []string
+	// HandoffSecret is used to encrypt the handoff codes passed to the
+	// callback. All replicas have to use the same secret, so codes can be
+	// redeemed by any of them, which requires Redemptions. If empty, a random
+	// secret is used, which only works with a single replica.
+	HandoffSecret string
+	// Redemptions record the redeemed handoff codes and have to be shared by
+	// all replicas using the HandoffSecret. If nil, redemptions are recorded
+	// in memory, which is only allowed without HandoffSecret.
+	Redemptions Redemptions
 }
 
 type Handler struct {
-	httpClient *http.Client
-	verifier   *oidc.IDTokenVerifier
-	provider   *oidc.Provider
-	config     *HandlerConfig
+	// groupsScope is set if the provider supports the groups scope, which
+	// is requested to receive the groups claim
+	groupsScope bool
+	// callbackOrigins are the normalized AllowedCallbackOrigins
+	callbackOrigins map[string]bool
+	handoffs        *handoffStore
+	httpClient      *http.Client
+	verifier        *oidc.IDTokenVerifier
+	provider        *oidc.Provider
+	config          *HandlerConfig
 }
 
 func NewHandler(config *HandlerConfig) (*Handler, error) {
@@ -62,6 +129,14 @@ func NewHandler(config *HandlerConfig) (*Handler, error) {
 		config:     config,
 		httpClient: http.DefaultClient,
 	}
+	h.callbackOrigins, err = parseOrigins(config.AllowedCallbackOrigins)
+	if err != nil {
+		return nil, err
+	}
+	h.handoffs, err = newHandoffStore(config.HandoffSecret, config.Redemptions)
+	if err != nil {
+		return nil, err
+	}
 	ctx := oidc.ClientContext(context.Background(), h.httpClient)
 	h.provider, err = oidc.NewProvider(ctx, h.config.IssuerURL)
 	if err != nil {
@@ -71,10 +146,26 @@ func NewHandler(config *HandlerConfig) (*Handler, error) {
 	var scopes struct {
 		// See: https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
 		Supported []string `json:"scopes_supported"`
+		// See: https://tools.ietf.org/html/rfc8628#section-4
+		DeviceAuthURL string `json:"device_authorization_endpoint"`
 	}
 	if err := h.provider.Claims(&scopes); err != nil {
 		return nil, fmt.Errorf("failed to parse provider scopes_supported: %v", err)
 	}
+	if h.config.DeviceAuthURL == "" {
+		h.config.DeviceAuthURL = scopes.DeviceAuthURL
+	}
+	if h.config.GroupsClaim == "" {
+		h.config.GroupsClaim = DefaultGroupsClaim
+	}
+	if h.config.IdentityClaim == "" {
+		h.config.IdentityClaim = DefaultIdentityClaim
+	}
+	for _, scope := range scopes.Supported {
+		if scope == "groups" {
+			h.groupsScope = true
+		}
+	}
 	if len(scopes.Supported) == 0 {
 		// `scopes_supported` is a "RECOMMENDED" discovery claim, not a required
 		// one. If missing, assume that the provider follows the spec and has
@@ -97,7 +188,7 @@ func NewHandler(config *HandlerConfig) (*Handler, error) {
 }
 
 func (h *Handler) GetAuthCodeURL(state *State) (string, error) {
-	scopes := []string{oidc.ScopeOpenID, "profile", "email"}
+	scopes := h.getScopes()
 	encoded, err := encode(state)
 	if err != nil {
 		return "", err
@@ -106,7 +197,6 @@ func (h *Handler) GetAuthCodeURL(state *State) (string, error) {
 	// Construct authCodeURL
 	authCodeURL := ""
 	if h.config.OfflineAsScope {
-		scopes = append(scopes, oidc.ScopeOfflineAccess)
 		authCodeURL = h.getOauth2Config(scopes).AuthCodeURL(encoded, oidc.Nonce(nonce))
 	} else {
 		authCodeURL = h.getOauth2Config(scopes).AuthCodeURL(encoded, oidc.Nonce(nonce), oauth2.AccessTypeOffline)
@@ -152,16 +242,30 @@ func (h *Handler) VerifyStateAndClaims(ctx context.Context, token *oauth2.Token,
 		return nil, nil, fmt.Errorf("failed to decode state")
 	}
 
-	claims := &ExtraClaims{}
-	if err = idToken.Claims(claims); err != nil {
-		return nil, nil, fmt.Errorf("claims can not be unmarshalled: %v", err)
-	}
-	if !claims.EmailVerified {
-		return nil, nil, fmt.Errorf("email not verified")
+	claims, err := h.extractClaims(idToken)
+	if err != nil {
+		return nil, nil, err
 	}
 	return state, claims, nil
 }
 
+// VerifyClaims will verify the ID token contained in the token and return the
+// claims of the user, e.g. to authenticate API requests.
+func (h *Handler) VerifyClaims(ctx context.Context, token *oauth2.Token) (*ExtraClaims, error) {
+	idToken, err := h.Verify(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify ID token: %v", err)
+	}
+	return h.extractClaims(idToken)
+}
+
+// onLogin calls the OnLogin callback if configured.
+func (h *Handler) onLogin(ctx context.Context, claims *ExtraClaims, token *oauth2.Token) {
+	if h.config.OnLogin != nil {
+		h.config.OnLogin(ctx, claims, token)
+	}
+}
+
 func (h *Handler) getOauth2Config(scopes []string) *oauth2.Config {
 	return &oauth2.Config{
 		ClientID:     h.config.ClientID,
@@ -176,6 +280,123 @@ func (h *Handler) clientContext(ctx context.Context) context.Context {
 	return oidc.ClientContext(ctx, h.httpClient)
 }
 
+// encodedToken is the serialized form of a token, which preserves the
+// ID token, so it can be verified by the server later on.
+type encodedToken struct {
+	oauth2.Token
+	IDToken string `json:"id_token,omitempty"`
+}
+
+// EncodeToken encodes the token including its ID token, so it can be passed to
+// the client and be used by it to authenticate API requests.
+func EncodeToken(token *oauth2.Token) (string, error) {
+	idToken, _ := token.Extra("id_token").(string)
+	return encode(&encodedToken{Token: *token, IDToken: idToken})
+}
+
+// DecodeToken decodes a token previously encoded by EncodeToken.
+func DecodeToken(encoded string) (*oauth2.Token, error) {
+	raw := &encodedToken{}
+	if err := decode(encoded, raw); err != nil {
+		return nil, err
+	}
+	return raw.Token.WithExtra(map[string]interface{}{
+		"id_token": raw.IDToken,
+	}), nil
+}
+
+func (h *Handler) extractClaims(idToken *oidc.IDToken) (*ExtraClaims, error) {
+	claims := &ExtraClaims{}
+	if err := idToken.Claims(claims); err != nil {
+		return nil, fmt.Errorf("claims can not be unmarshalled: %v", err)
+	}
+	// The email is only relevant if it identifies the user or restricts
+	// who may use the service
+	if !claims.EmailVerified && (h.config.IdentityClaim == EmailClaim || len(h.config.AllowedEmailDomains) > 0) {
+		return nil, fmt.Errorf("%w: email not verified", ErrNotAllowed)
+	}
+	var raw map[string]interface{}
+	if err := idToken.Claims(&raw); err != nil {
+		return nil, fmt.Errorf("claims can not be unmarshalled: %v", err)
+	}
+	id, ok := lookupClaim(raw, h.config.IdentityClaim).(string)
+	if !ok || id == "" {
+		return nil, fmt.Errorf("identity claim %q is missing or not a string", h.config.IdentityClaim)
+	}
+	claims.ID = id
+	groups, err := extractGroups(raw, h.config.GroupsClaim)
+	if err != nil {
+		return nil, err
+	}
+	claims.Groups = groups
+	if err := h.checkAllowed(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkAllowed returns an error wrapping ErrNotAllowed, if the email domain
+// of the user is not allowed. The issuer is not checked, as the verifier only
+// accepts ID tokens of the configured issuer.
+func (h *Handler) checkAllowed(claims *ExtraClaims) error {
+	if len(h.config.AllowedEmailDomains) > 0 {
+		domain := ""
+		if i := strings.LastIndex(claims.Email, "@"); i >= 0 {
+			domain = claims.Email[i+1:]
+		}
+		if !containsFold(h.config.AllowedEmailDomains, domain) {
+			return fmt.Errorf("%w: users with email domain %q may not use this service", ErrNotAllowed, domain)
+		}
+	}
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupClaim returns the value of the claim, whose nested keys are separated
+// by dots, or nil if it is missing.
+func lookupClaim(raw map[string]interface{}, claim string) interface{} {
+	var value interface{} = raw
+	for _, key := range strings.Split(claim, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// extractGroups returns the groups contained in the claim, which is either a
+// list or a single string. Missing claims result in no groups.
+func extractGroups(raw map[string]interface{}, claim string) ([]string, error) {
+	switch v := lookupClaim(raw, claim).(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		groups := make([]string, 0, len(v))
+		for _, item := range v {
+			group, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("groups claim %q contains non-string value", claim)
+			}
+			groups = append(groups, group)
+		}
+		return groups, nil
+	default:
+		return nil, fmt.Errorf("groups claim %q is neither a string nor a list", claim)
+	}
+}
+
 func decode(encoded string, obj interface{}) error {
 	data, err := base64.RawURLEncoding.DecodeString(encoded)
 	if err != nil {
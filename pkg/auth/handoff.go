@@ -0,0 +1,242 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// HandoffCodeTTL is the time a handoff code can be redeemed after the login.
+const HandoffCodeTTL = time.Minute
+
+// ErrInvalidHandoff is returned if a handoff code is unknown, expired,
+// already redeemed or the verifier does not match the challenge.
+var ErrInvalidHandoff = errors.New("invalid or expired handoff code")
+
+// NewCodeVerifier returns a random verifier and the challenge derived from it.
+// The challenge is passed to the server when starting the login and the
+// verifier is required to redeem the handoff code, so only the client which
+// started the login can receive the token.
+func NewCodeVerifier() (verifier string, challenge string, err error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(data)
+	return verifier, CodeChallenge(verifier), nil
+}
+
+// CodeChallenge returns the S256 challenge of the verifier as used by PKCE
+// (RFC 7636).
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// validateChallenge checks whether the challenge could be derived from a
+// verifier using CodeChallenge.
+func validateChallenge(challenge string) error {
+	data, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || len(data) != sha256.Size {
+		return fmt.Errorf("invalid code challenge: expected S256 challenge")
+	}
+	return nil
+}
+
+// handoffSalt is used to derive the key encrypting handoff codes. It does not
+// have to be random, as the secret is unique per deployment, but it has to be
+// the same for all replicas.
+var handoffSalt = []byte("smorgasbord handoff")
+
+// handoff is the encrypted content of a handoff code.
+type handoff struct {
+	// Token is encoded using EncodeToken
+	Token     string `json:"token"`
+	Challenge string `json:"challenge"`
+	Expiry    int64  `json:"expiry"`
+}
+
+// Redemptions records redeemed handoff codes. If codes are redeemed by
+// several replicas, the redemptions have to be shared by all of them, so each
+// code can only be redeemed once. It is implemented by the SQL storage.
+type Redemptions interface {
+	// Redeem records the code until it expires and returns false if the code
+	// was already redeemed.
+	Redeem(code string, expiry time.Time) (bool, error)
+}
+
+// memoryRedemptions records the redemptions of a single replica.
+type memoryRedemptions struct {
+	mutex    sync.Mutex
+	redeemed map[string]time.Time
+	now      func() time.Time
+}
+
+func newMemoryRedemptions() *memoryRedemptions {
+	return &memoryRedemptions{
+		redeemed: map[string]time.Time{},
+		now:      time.Now,
+	}
+}
+
+func (r *memoryRedemptions) Redeem(code string, expiry time.Time) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := r.now()
+	for c, e := range r.redeemed {
+		if now.After(e) {
+			delete(r.redeemed, c)
+		}
+	}
+	if _, ok := r.redeemed[code]; ok {
+		return false, nil
+	}
+	r.redeemed[code] = expiry
+	return true, nil
+}
+
+// handoffStore creates handoff codes, which contain the token of the login
+// encrypted using AES-GCM, so they can be redeemed by any replica sharing the
+// secret. As the codes are not stored, redemptions are recorded until the
+// codes expire to invalidate them.
+type handoffStore struct {
+	aead        cipher.AEAD
+	redemptions Redemptions
+	now         func() time.Time
+}
+
+// newHandoffStore derives the key from the secret using scrypt. If the secret
+// is empty, a random key is used, so codes can only be redeemed by the same
+// replica. Redemptions are recorded in memory if none are provided, which is
+// only allowed with a random key.
+func newHandoffStore(secret string, redemptions Redemptions) (*handoffStore, error) {
+	if redemptions == nil {
+		if secret != "" {
+			return nil, fmt.Errorf("redemptions shared by all replicas are required with a handoff secret")
+		}
+		redemptions = newMemoryRedemptions()
+	}
+	var key []byte
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		key, err = scrypt.Key([]byte(secret), handoffSalt, 1<<15, 8, 1, 32)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive handoff key: %w", err)
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &handoffStore{
+		aead:        aead,
+		redemptions: redemptions,
+		now:         time.Now,
+	}, nil
+}
+
+// put returns the single-use code to redeem the token.
+func (s *handoffStore) put(token *oauth2.Token, challenge string) (string, error) {
+	encoded, err := EncodeToken(token)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&handoff{
+		Token:     encoded,
+		Challenge: challenge,
+		Expiry:    s.now().Add(HandoffCodeTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+// redeem returns the token of the code, if the verifier matches the challenge
+// of the login. The code is invalidated by the first attempt regardless of
+// its outcome.
+func (s *handoffStore) redeem(code, verifier string) (*oauth2.Token, error) {
+	data, err := base64.RawURLEncoding.DecodeString(code)
+	if err != nil {
+		return nil, ErrInvalidHandoff
+	}
+	h, err := s.open(data)
+	if err != nil {
+		return nil, ErrInvalidHandoff
+	}
+	expiry := time.Unix(h.Expiry, 0)
+	if s.now().After(expiry) {
+		return nil, ErrInvalidHandoff
+	}
+	// Only the hash is recorded, as the code contains the encrypted token.
+	// The decoded code is hashed, as the encoding ignores e.g. line breaks.
+	sum := sha256.Sum256(data)
+	ok, err := s.redemptions.Redeem(base64.RawURLEncoding.EncodeToString(sum[:]), expiry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record redemption: %w", err)
+	}
+	if !ok {
+		return nil, ErrInvalidHandoff
+	}
+	if subtle.ConstantTimeCompare([]byte(CodeChallenge(verifier)), []byte(h.Challenge)) != 1 {
+		return nil, ErrInvalidHandoff
+	}
+	return DecodeToken(h.Token)
+}
+
+// open decrypts the decoded code.
+func (s *handoffStore) open(data []byte) (*handoff, error) {
+	if len(data) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("code too short")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	h := &handoff{}
+	if err := json.Unmarshal(plaintext, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handoff", func() {
+	It("redeems codes once with the matching verifier", func() {
+		s, err := newHandoffStore("", nil)
+		Expect(err).ToNot(HaveOccurred())
+		verifier, challenge, err := NewCodeVerifier()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(validateChallenge(challenge)).To(Succeed())
+		token := &oauth2.Token{AccessToken: "test"}
+		code, err := s.put(token, challenge)
+		Expect(err).ToNot(HaveOccurred())
+		redeemed, err := s.redeem(code, verifier)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(redeemed.AccessToken).To(Equal("test"))
+		_, err = s.redeem(code, verifier)
+		Expect(err).To(Equal(ErrInvalidHandoff))
+		// Failed attempts invalidate the code as well
+		code, err = s.put(token, challenge)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = s.redeem(code, "wrong")
+		Expect(err).To(Equal(ErrInvalidHandoff))
+		_, err = s.redeem(code, verifier)
+		Expect(err).To(Equal(ErrInvalidHandoff))
+	})
+	It("expires codes", func() {
+		s, err := newHandoffStore("", nil)
+		Expect(err).ToNot(HaveOccurred())
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		redemptions := s.redemptions.(*memoryRedemptions)
+		redemptions.now = s.now
+		verifier, challenge, err := NewCodeVerifier()
+		Expect(err).ToNot(HaveOccurred())
+		code, err := s.put(&oauth2.Token{}, challenge)
+		Expect(err).ToNot(HaveOccurred())
+		now = now.Add(HandoffCodeTTL + time.Second)
+		_, err = s.redeem(code, verifier)
+		Expect(err).To(Equal(ErrInvalidHandoff))
+		// Redeemed codes are forgotten once they expired
+		for i := 0; i < 2; i++ {
+			code, err = s.put(&oauth2.Token{}, challenge)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = s.redeem(code, verifier)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(redemptions.redeemed).To(HaveLen(2))
+		now = now.Add(HandoffCodeTTL + time.Second)
+		code, err = s.put(&oauth2.Token{}, challenge)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = s.redeem(code, verifier)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(redemptions.redeemed).To(HaveLen(1))
+	})
+	It("redeems codes of other replicas sharing the secret", func() {
+		redemptions := newMemoryRedemptions()
+		s, err := newHandoffStore("secret", redemptions)
+		Expect(err).ToNot(HaveOccurred())
+		replica, err := newHandoffStore("secret", redemptions)
+		Expect(err).ToNot(HaveOccurred())
+		other, err := newHandoffStore("other", redemptions)
+		Expect(err).ToNot(HaveOccurred())
+		random, err := newHandoffStore("", nil)
+		Expect(err).ToNot(HaveOccurred())
+		verifier, challenge, err := NewCodeVerifier()
+		Expect(err).ToNot(HaveOccurred())
+		token := (&oauth2.Token{AccessToken: "test"}).WithExtra(map[string]interface{}{"id_token": "id"})
+		code, err := s.put(token, challenge)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = other.redeem(code, verifier)
+		Expect(err).To(Equal(ErrInvalidHandoff))
+		_, err = random.redeem(code, verifier)
+		Expect(err).To(Equal(ErrInvalidHandoff))
+		redeemed, err := replica.redeem(code, verifier)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(redeemed.AccessToken).To(Equal("test"))
+		Expect(redeemed.Extra("id_token")).To(Equal("id"))
+		// Tampered codes are rejected
+		data, err := base64.RawURLEncoding.DecodeString(code)
+		Expect(err).ToNot(HaveOccurred())
+		data[len(data)-1] ^= 1
+		_, err = replica.redeem(base64.RawURLEncoding.EncodeToString(data), verifier)
+		Expect(err).To(Equal(ErrInvalidHandoff))
+	})
+	It("redeems codes once across handlers sharing the secret", func() {
+		// Redemptions have to be shared if the secret is
+		_, err := newHandoffStore("secret", nil)
+		Expect(err).To(HaveOccurred())
+		redemptions := newMemoryRedemptions()
+		handlers := make([]*Handler, 2)
+		engines := make([]*gin.Engine, 2)
+		for i := range handlers {
+			handlers[i] = &Handler{}
+			handlers[i].handoffs, err = newHandoffStore("secret", redemptions)
+			Expect(err).ToNot(HaveOccurred())
+			engines[i] = gin.New()
+			engines[i].POST("/auth/token", RedeemHandoff(handlers[i]))
+		}
+		verifier, challenge, err := NewCodeVerifier()
+		Expect(err).ToNot(HaveOccurred())
+		code, err := handlers[0].handoffs.put(&oauth2.Token{AccessToken: "test"}, challenge)
+		Expect(err).ToNot(HaveOccurred())
+		redeem := func(engine *gin.Engine) int {
+			form := url.Values{"code": {code}, "code_verifier": {verifier}}
+			req := httptest.NewRequest(http.MethodPost, "/auth/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			engine.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		Expect(redeem(engines[1])).To(Equal(http.StatusOK))
+		Expect(redeem(engines[0])).To(Equal(http.StatusBadRequest))
+		Expect(redeem(engines[1])).To(Equal(http.StatusBadRequest))
+	})
+	It("validates challenges", func() {
+		Expect(validateChallenge("")).ToNot(Succeed())
+		Expect(validateChallenge("plain")).ToNot(Succeed())
+		Expect(validateChallenge(CodeChallenge("verifier"))).To(Succeed())
+	})
+})
@@ -0,0 +1,71 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClaimsKey is the key of the verified claims in the gin.Context.
+const ClaimsKey = "smorgasbord/claims"
+
+// Authenticate returns a middleware, which verifies the bearer token of each
+// request. The token is expected in the format, which the client received via
+// the callback. If the token is valid, the claims of the user are stored in the
+// context and can be retrieved using GetClaims, otherwise the request is
+// aborted with status code 401 or 403, if the user is not allowed to use the
+// service.
+func Authenticate(h *Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+			return
+		}
+		token, err := DecodeToken(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("failed to decode token: %v", err)})
+			return
+		}
+		claims, err := h.VerifyClaims(c.Request.Context(), token)
+		if errors.Is(err, ErrNotAllowed) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(ClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// GetClaims returns the claims stored by Authenticate or nil if the request
+// was not authenticated.
+func GetClaims(c *gin.Context) *ExtraClaims {
+	value, ok := c.Get(ClaimsKey)
+	if !ok {
+		return nil
+	}
+	claims, _ := value.(*ExtraClaims)
+	return claims
+}
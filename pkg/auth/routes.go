@@ -17,15 +17,16 @@ limitations under the License.
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/oauth2"
 )
 
-const QueryTokenKey = "token"
+// QueryCodeKey is the query parameter of the callback containing the handoff
+// code, which can be redeemed for the token using RedeemHandoff.
+const QueryCodeKey = "code"
 
 func Register(r *gin.Engine, h *Handler) {
 	authGroup := r.Group("/auth")
@@ -33,6 +34,32 @@ func Register(r *gin.Engine, h *Handler) {
 	authGroup.POST("/login", Login(h))
 	authGroup.GET("/callback", Callback(h))
 	authGroup.POST("/callback", Callback(h))
+	authGroup.POST("/token", RedeemHandoff(h))
+	authGroup.POST("/device", DeviceAuth(h))
+	authGroup.POST("/device/token", DeviceToken(h))
+}
+
+// DeviceTokenRequest is the body expected by DeviceToken.
+type DeviceTokenRequest struct {
+	DeviceCode string `form:"device_code" json:"device_code" binding:"required"`
+}
+
+// DeviceTokenResponse is returned by DeviceToken once the user authorized the
+// device. The token is encoded using EncodeToken.
+type DeviceTokenResponse struct {
+	Token string `json:"token"`
+}
+
+// HandoffRequest is the body expected by RedeemHandoff.
+type HandoffRequest struct {
+	Code         string `form:"code" json:"code" binding:"required"`
+	CodeVerifier string `form:"code_verifier" json:"code_verifier" binding:"required"`
+}
+
+// HandoffResponse is returned by RedeemHandoff. The token is encoded using
+// EncodeToken.
+type HandoffResponse struct {
+	Token string `json:"token"`
 }
 
 func Login(h *Handler) gin.HandlerFunc {
@@ -45,10 +72,20 @@ func Login(h *Handler) gin.HandlerFunc {
 			c.String(http.StatusBadRequest, "failed to bind json object", err)
 			return
 		}
+		// Reject callbacks, which are not allowed, before the user logs in
+		if _, err := h.parseCallback(state.Callback); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validateChallenge(state.Challenge); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
 		// Redirect to authCodeURL if no error occurred
 		authCodeURL, err := h.GetAuthCodeURL(&state)
 		if err != nil {
 			c.String(http.StatusInternalServerError, "failed to acquire auth code url")
+			return
 		}
 		c.Redirect(http.StatusSeeOther, authCodeURL)
 	}
@@ -86,37 +123,106 @@ func Callback(h *Handler) gin.HandlerFunc {
 			return
 		}
 
-		state, _, err := h.VerifyStateAndClaims(ctx, token, encoded)
-		if err != nil {
+		state, claims, err := h.VerifyStateAndClaims(ctx, token, encoded)
+		if errors.Is(err, ErrNotAllowed) {
+			c.String(http.StatusForbidden, err.Error())
+			return
+		} else if err != nil {
 			c.String(http.StatusInternalServerError, fmt.Sprintf("failed to verify token: %v", err), err)
 			return
 		}
+		h.onLogin(ctx, claims, token)
 
-		callbackURL, err := url.Parse(state.Callback)
+		callbackURL, err := h.parseCallback(state.Callback)
 		if err != nil {
-			c.String(http.StatusBadRequest, fmt.Sprintf("error parsing url from state: %v", err))
+			c.String(http.StatusBadRequest, err.Error())
 			return
 		}
-		err = addTokenToQuery(callbackURL, token)
+		// The token is not passed to the callback directly, as it would end up
+		// in the history of the browser, but is handed off using a code
+		handoffCode, err := h.handoffs.put(token, state.Challenge)
 		if err != nil {
-			c.String(http.StatusBadRequest, fmt.Sprintf("failed to add token to query: %v", err))
+			c.String(http.StatusInternalServerError, fmt.Sprintf("failed to create handoff code: %v", err))
 			return
 		}
+		q := callbackURL.Query()
+		q.Set(QueryCodeKey, handoffCode)
+		callbackURL.RawQuery = q.Encode()
 
 		c.Redirect(http.StatusSeeOther, callbackURL.String())
 	}
 }
 
-func addTokenToQuery(u *url.URL, token *oauth2.Token) error {
-	q, err := url.ParseQuery(u.RawQuery)
-	if err != nil {
-		return err
+// DeviceAuth initiates the device authorization grant on behalf of the
+// client, so the client does not need to know the client secret.
+func DeviceAuth(h *Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceAuth, err := h.StartDeviceAuth(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusBadGateway, &DeviceTokenError{Code: "server_error", Description: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, deviceAuth)
+	}
+}
+
+// DeviceToken is polled by the client until the user authorized the device.
+// Errors of the issuer are passed through as described in RFC 8628.
+func DeviceToken(h *Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req DeviceTokenRequest
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, &DeviceTokenError{Code: "invalid_request", Description: err.Error()})
+			return
+		}
+		ctx := c.Request.Context()
+		token, err := h.ExchangeDeviceCode(ctx, req.DeviceCode)
+		var tokenErr *DeviceTokenError
+		if errors.As(err, &tokenErr) {
+			c.JSON(http.StatusBadRequest, tokenErr)
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadGateway, &DeviceTokenError{Code: "server_error", Description: err.Error()})
+			return
+		}
+		claims, err := h.VerifyClaims(ctx, token)
+		if err != nil {
+			c.JSON(http.StatusForbidden, &DeviceTokenError{Code: "access_denied", Description: err.Error()})
+			return
+		}
+		h.onLogin(ctx, claims, token)
+		encoded, err := EncodeToken(token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, &DeviceTokenError{Code: "server_error", Description: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, &DeviceTokenResponse{Token: encoded})
 	}
-	encoded, err := encode(token)
-	if err != nil {
-		return err
+}
+
+// RedeemHandoff responds with the token of a login, if the code passed to the
+// callback and the verifier matching the challenge of the login are provided.
+// Each code can only be redeemed once, see HandlerConfig.Redemptions.
+func RedeemHandoff(h *Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req HandoffRequest
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, &DeviceTokenError{Code: "invalid_request", Description: err.Error()})
+			return
+		}
+		token, err := h.handoffs.redeem(req.Code, req.CodeVerifier)
+		if errors.Is(err, ErrInvalidHandoff) {
+			c.JSON(http.StatusBadRequest, &DeviceTokenError{Code: "invalid_grant", Description: err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, &DeviceTokenError{Code: "server_error", Description: err.Error()})
+			return
+		}
+		encoded, err := EncodeToken(token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, &DeviceTokenError{Code: "server_error", Description: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, &HandoffResponse{Token: encoded})
 	}
-	q.Add(QueryTokenKey, encoded)
-	u.RawQuery = q.Encode()
-	return nil
 }
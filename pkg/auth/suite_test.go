@@ -17,9 +17,11 @@ limitations under the License.
 package auth_test
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"testing"
 
 	_ "github.com/kubism/smorgasbord/internal/flags"
@@ -28,6 +30,7 @@ import (
 	"github.com/kubism/smorgasbord/pkg/util"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -35,12 +38,25 @@ import (
 
 var (
 	dex       *testutil.Dex
+	baseURL   string
 	server    *http.Server
 	serverLis net.Listener
 	handler   *auth.Handler
 	client    *auth.Client
+	// logins records the tokens passed to OnLogin
+	loginsMutex sync.Mutex
+	logins      []*oauth2.Token
 )
 
+func lastLogin() *oauth2.Token {
+	loginsMutex.Lock()
+	defer loginsMutex.Unlock()
+	if len(logins) == 0 {
+		return nil
+	}
+	return logins[len(logins)-1]
+}
+
 func TestAuth(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "pkg/auth")
@@ -63,6 +79,11 @@ var _ = BeforeSuite(func(done Done) {
 		RedirectURL:        redirectURL,
 		Nonce:              "test",
 		OfflineAsScope:     false,
+		OnLogin: func(ctx context.Context, claims *auth.ExtraClaims, token *oauth2.Token) {
+			loginsMutex.Lock()
+			defer loginsMutex.Unlock()
+			logins = append(logins, token)
+		},
 	}
 	handler, err = auth.NewHandler(config)
 	Expect(err).ToNot(HaveOccurred())
@@ -78,7 +99,8 @@ var _ = BeforeSuite(func(done Done) {
 			panic(err)
 		}
 	}()
-	client = auth.NewClient(fmt.Sprintf("http://%s", serverAddr))
+	baseURL = fmt.Sprintf("http://%s", serverAddr)
+	client = auth.NewClient(baseURL)
 	Expect(err).ToNot(HaveOccurred())
 	Expect(client).ToNot(BeNil())
 	close(done)
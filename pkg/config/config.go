@@ -49,6 +49,12 @@ func FromFile(path string) (*Config, error) {
 	return c, nil
 }
 
+// PrivateKeyPath returns where the private key of the user is stored, which
+// is next to the configuration itself.
+func (c *Config) PrivateKeyPath() string {
+	return c.Path + ".key"
+}
+
 func (c *Config) SaveTo(path string) error {
 	data, err := json.Marshal(c)
 	if err != nil {
@@ -63,4 +63,8 @@ var _ = Describe("Config", func() {
 		Expect(err).To(HaveOccurred())
 		Expect(c).To(BeNil())
 	})
+	It("stores private key next to configuration", func() {
+		c := &Config{Path: filepath.Join(tmpDir, "config5")}
+		Expect(c.PrivateKeyPath()).To(Equal(filepath.Join(tmpDir, "config5.key")))
+	})
 })
@@ -0,0 +1,383 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deactivation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/auth"
+	"github.com/kubism/smorgasbord/pkg/storage"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+)
+
+// DefaultRejectionCodes contains the error code returned by the token endpoint
+// if the refresh token is invalid, expired or revoked, e.g. because the user
+// was disabled. Some identity providers, e.g. older versions of dex, use
+// invalid_request instead.
+var DefaultRejectionCodes = []string{"invalid_grant"}
+
+// Refresher refreshes tokens, which is implemented by auth.Handler.
+type Refresher interface {
+	Refresh(ctx context.Context, refreshToken string) (*oauth2.Token, error)
+}
+
+// Config configures the Deactivator.
+type Config struct {
+	Storage   storage.Storage
+	Tokens    *TokenStore
+	Refresher Refresher
+	// Interval between two checks of all refresh tokens
+	Interval time.Duration
+	// GracePeriod is the time a refresh token has to be rejected, before the
+	// entries of the user are deactivated, e.g. to survive misconfigurations
+	// of the identity provider
+	GracePeriod time.Duration
+	// DryRun only reports the users, which would be deactivated
+	DryRun bool
+	// RejectionCodes are the error codes of the token endpoint, which are
+	// considered a rejection of the refresh token (defaults to
+	// DefaultRejectionCodes). All other errors are considered temporary.
+	RejectionCodes []string
+	Log            zerolog.Logger
+}
+
+// Status is the outcome of the check of a single user.
+type Status string
+
+const (
+	// StatusActive is reported if the refresh token is still valid.
+	StatusActive Status = "active"
+	// StatusRejected is reported if the refresh token was rejected, but the
+	// grace period did not pass yet.
+	StatusRejected Status = "rejected"
+	// StatusDeactivated is reported if the entries of the user were (or in
+	// dry-run mode would have been) deactivated.
+	StatusDeactivated Status = "deactivated"
+	// StatusError is reported if the refresh token could not be checked, e.g.
+	// because the identity provider was not reachable.
+	StatusError Status = "error"
+)
+
+// Result is the outcome of the check of a single user.
+type Result struct {
+	ID            string     `json:"id"`
+	Status        Status     `json:"status"`
+	RejectedSince *time.Time `json:"rejectedSince,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+}
+
+// Report contains the results of all users checked by Check.
+type Report struct {
+	DryRun  bool     `json:"dryRun"`
+	Results []Result `json:"results"`
+}
+
+// Deactivator periodically refreshes the stored refresh tokens of all users
+// and deactivates the entries of users, whose refresh tokens are rejected by
+// the identity provider.
+type Deactivator struct {
+	config *Config
+	// reactivations contains the ids of users, who logged in since the last
+	// reactivation, and notify wakes up Run to reactivate their entries
+	mutex         sync.Mutex
+	reactivations map[string]bool
+	notify        chan struct{}
+}
+
+// New validates the configuration and returns a new Deactivator.
+func New(config *Config) (*Deactivator, error) {
+	if config.Storage == nil || config.Tokens == nil || config.Refresher == nil {
+		return nil, fmt.Errorf("storage, tokens and refresher are required")
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("interval has to be positive")
+	}
+	if config.GracePeriod < 0 {
+		return nil, fmt.Errorf("grace period must not be negative")
+	}
+	if len(config.RejectionCodes) == 0 {
+		config.RejectionCodes = DefaultRejectionCodes
+	}
+	return &Deactivator{
+		config:        config,
+		reactivations: map[string]bool{},
+		notify:        make(chan struct{}, 1),
+	}, nil
+}
+
+// OnLogin stores the refresh token of the user and reactivates previously
+// deactivated entries, as the user was obviously able to login again. The
+// entries are reactivated asynchronously by Run, so logins do not wait for
+// the storage. It can be used as auth.HandlerConfig.OnLogin.
+func (d *Deactivator) OnLogin(ctx context.Context, claims *auth.ExtraClaims, token *oauth2.Token) {
+	log := d.config.Log.With().Str("id", claims.ID).Logger()
+	if token.RefreshToken == "" {
+		log.Warn().Msg("no refresh token received, user can not be deactivated automatically")
+		return
+	}
+	if err := d.config.Tokens.Put(claims.ID, token.RefreshToken); err != nil {
+		log.Error().Err(err).Msg("failed to store refresh token")
+		return
+	}
+	if d.config.DryRun {
+		return
+	}
+	d.queueReactivation(claims.ID)
+}
+
+// queueReactivation adds the users to the next batch of reactivations and
+// wakes up Run.
+func (d *Deactivator) queueReactivation(ids ...string) {
+	d.mutex.Lock()
+	for _, id := range ids {
+		d.reactivations[id] = true
+	}
+	d.mutex.Unlock()
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run checks all refresh tokens right away and then periodically until the
+// context is cancelled. In between it reactivates the entries of users, who
+// logged in again.
+func (d *Deactivator) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	d.checkAndLog(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-d.notify:
+			d.reactivate()
+		case <-ticker.C:
+			// Retry failed reactivations before checking again
+			d.reactivate()
+			d.checkAndLog(ctx)
+		}
+	}
+}
+
+func (d *Deactivator) checkAndLog(ctx context.Context) {
+	report, err := d.Check(ctx)
+	if err != nil {
+		d.config.Log.Error().Err(err).Msg("deactivation failed")
+	}
+	if report != nil {
+		d.logReport(report)
+	}
+}
+
+// reactivate reactivates the entries of all users, who logged in since the
+// last call, in a single transaction. If the transaction fails, the users are
+// kept for the next batch, so temporary errors of the storage do not keep
+// them deactivated until they log in again.
+func (d *Deactivator) reactivate() {
+	d.mutex.Lock()
+	ids := make([]string, 0, len(d.reactivations))
+	for id := range d.reactivations {
+		ids = append(ids, id)
+	}
+	d.reactivations = map[string]bool{}
+	d.mutex.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+	sort.Strings(ids)
+	failed := ""
+	err := d.config.Storage.Transact(func() error {
+		for _, id := range ids {
+			if err := d.config.Storage.Reactivate(id); err != nil {
+				failed = id
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		return
+	}
+	d.mutex.Lock()
+	for _, id := range ids {
+		d.reactivations[id] = true
+	}
+	d.mutex.Unlock()
+	if failed != "" {
+		d.config.Log.Error().Err(err).Str("id", failed).Strs("ids", ids).Msg("failed to reactivate entries")
+	} else {
+		d.config.Log.Error().Err(err).Strs("ids", ids).Msg("failed to save reactivated entries")
+	}
+}
+
+// Check refreshes the tokens of all users and deactivates the entries of
+// users, whose tokens were rejected for longer than the grace period. The
+// records of deactivated users are removed, so they are only checked again
+// after they logged in again. Users, who logged in during the check, keep
+// their new refresh token and are reactivated again.
+func (d *Deactivator) Check(ctx context.Context) (*Report, error) {
+	report := &Report{DryRun: d.config.DryRun, Results: []Result{}}
+	var (
+		deactivated []Result
+		records     = map[string]Record{}
+	)
+	for _, id := range d.config.Tokens.IDs() {
+		result, record := d.check(ctx, id)
+		if result.Status == StatusDeactivated && !d.config.DryRun {
+			deactivated = append(deactivated, result)
+			records[id] = record
+		}
+		report.Results = append(report.Results, result)
+	}
+	if len(deactivated) == 0 {
+		return report, nil
+	}
+	err := d.config.Storage.Transact(func() error {
+		for _, result := range deactivated {
+			if err := d.config.Storage.Deactivate(result.ID, "refresh token rejected: "+result.Reason); err != nil {
+				return fmt.Errorf("failed to deactivate entries of %s: %w", result.ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to save deactivations: %w", err)
+	}
+	var loggedIn []string
+	for _, result := range deactivated {
+		deleted, err := d.config.Tokens.DeleteUnchanged(result.ID, records[result.ID])
+		if err != nil {
+			return report, err
+		}
+		if !deleted {
+			loggedIn = append(loggedIn, result.ID)
+		}
+	}
+	if len(loggedIn) > 0 {
+		d.queueReactivation(loggedIn...)
+	}
+	return report, nil
+}
+
+// check refreshes the token of the user and returns the result as well as the
+// record the result is based on.
+func (d *Deactivator) check(ctx context.Context, id string) (Result, Record) {
+	record, refreshToken, err := d.config.Tokens.Get(id)
+	if err != nil {
+		return Result{ID: id, Status: StatusError, Reason: err.Error()}, record
+	}
+	token, err := d.config.Refresher.Refresh(ctx, refreshToken)
+	if err == nil {
+		// Refresh tokens might be rotated and a previous rejection has to be
+		// reset, e.g. if the identity provider had an outage
+		if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+			refreshToken = token.RefreshToken
+		} else if record.RejectedSince == nil {
+			return Result{ID: id, Status: StatusActive}, record
+		}
+		// The refresh token of a login during the check is kept, as it is
+		// newer
+		err := d.config.Tokens.PutUnchanged(id, record, refreshToken)
+		if err != nil && !errors.Is(err, ErrTokenChanged) {
+			return Result{ID: id, Status: StatusError, Reason: err.Error()}, record
+		}
+		return Result{ID: id, Status: StatusActive}, record
+	}
+	reason, ok := rejectionReason(err, d.config.RejectionCodes)
+	if !ok {
+		return Result{ID: id, Status: StatusError, Reason: err.Error()}, record
+	}
+	record, err = d.config.Tokens.Reject(id, record, reason)
+	if errors.Is(err, ErrTokenChanged) {
+		// The user logged in again during the check
+		return Result{ID: id, Status: StatusActive}, record
+	} else if err != nil {
+		return Result{ID: id, Status: StatusError, Reason: err.Error()}, record
+	}
+	result := Result{ID: id, Status: StatusRejected, RejectedSince: record.RejectedSince, Reason: reason}
+	if time.Since(*record.RejectedSince) >= d.config.GracePeriod {
+		result.Status = StatusDeactivated
+	}
+	return result, record
+}
+
+func (d *Deactivator) logReport(report *Report) {
+	for _, result := range report.Results {
+		var event *zerolog.Event
+		switch result.Status {
+		case StatusActive:
+			event = d.config.Log.Debug()
+		case StatusDeactivated:
+			event = d.config.Log.Warn()
+		default:
+			event = d.config.Log.Info()
+		}
+		event = event.Str("id", result.ID).Str("status", string(result.Status)).Bool("dryRun", report.DryRun)
+		if result.RejectedSince != nil {
+			event = event.Time("rejectedSince", *result.RejectedSince)
+		}
+		event.Str("reason", result.Reason).Msg("checked refresh token")
+	}
+}
+
+// rejectionReason returns the error code and description, if the error
+// indicates that the identity provider rejected the refresh token, i.e. it
+// contains one of the codes. Other errors, e.g. network errors, are
+// considered temporary.
+func rejectionReason(err error, codes []string) (string, bool) {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return "", false
+	}
+	var body struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if jerr := json.Unmarshal(retrieveErr.Body, &body); jerr != nil {
+		values, qerr := url.ParseQuery(string(retrieveErr.Body))
+		if qerr != nil {
+			return "", false
+		}
+		body.Error, body.ErrorDescription = values.Get("error"), values.Get("error_description")
+	}
+	if !contains(codes, body.Error) {
+		return "", false
+	}
+	if body.ErrorDescription != "" {
+		return body.Error + ": " + body.ErrorDescription, true
+	}
+	return body.Error, true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deactivation
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/auth"
+	"github.com/kubism/smorgasbord/pkg/storage"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+)
+
+// fakeStorage records deactivations and reactivations.
+type fakeStorage struct {
+	storage.Storage
+	transactions  storage.Transactions
+	mutex         sync.Mutex
+	deactivated   map[string]string
+	saves         int
+	discards      int
+	reactivateErr error
+	saveErr       error
+	// onDeactivate is called after each deactivation, e.g. to simulate
+	// logins
+	onDeactivate func()
+}
+
+func (s *fakeStorage) Deactivate(id, reason string) error {
+	s.mutex.Lock()
+	s.deactivated[id] = reason
+	s.mutex.Unlock()
+	if s.onDeactivate != nil {
+		s.onDeactivate()
+	}
+	return nil
+}
+
+func (s *fakeStorage) Reactivate(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.reactivateErr != nil {
+		return s.reactivateErr
+	}
+	delete(s.deactivated, id)
+	return nil
+}
+
+func (s *fakeStorage) isDeactivated(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.deactivated[id]
+	return ok
+}
+
+func (s *fakeStorage) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.saveErr != nil {
+		return s.saveErr
+	}
+	s.saves++
+	return nil
+}
+
+func (s *fakeStorage) Discard() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.discards++
+	return nil
+}
+
+func (s *fakeStorage) Transact(fn func() error) error {
+	return s.transactions.Run(s, fn)
+}
+
+// fakeRefresher rotates refresh tokens unless they are rejected or an error
+// is configured.
+type fakeRefresher struct {
+	rejected map[string]bool
+	err      error
+	// onRefresh is called before each refresh, e.g. to simulate logins
+	onRefresh func()
+}
+
+func (r *fakeRefresher) Refresh(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	if r.onRefresh != nil {
+		r.onRefresh()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.rejected[refreshToken] {
+		return nil, &oauth2.RetrieveError{
+			Response: &http.Response{StatusCode: http.StatusBadRequest},
+			Body:     []byte(`{"error":"invalid_grant","error_description":"user disabled"}`),
+		}
+	}
+	return &oauth2.Token{AccessToken: "access", RefreshToken: refreshToken + "+"}, nil
+}
+
+var _ = Describe("Deactivator", func() {
+	var (
+		tmpDir    string
+		s         *fakeStorage
+		tokens    *TokenStore
+		refresher *fakeRefresher
+		logs      *gbytes.Buffer
+	)
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+		s = &fakeStorage{deactivated: map[string]string{}}
+		tokens, err = NewTokenStore(filepath.Join(tmpDir, "tokens.json"), "secret")
+		Expect(err).ToNot(HaveOccurred())
+		refresher = &fakeRefresher{rejected: map[string]bool{}}
+		logs = gbytes.NewBuffer()
+	})
+	AfterEach(func() {
+		_ = os.RemoveAll(tmpDir)
+	})
+	newDeactivator := func(gracePeriod time.Duration, dryRun bool) *Deactivator {
+		d, err := New(&Config{
+			Storage:     s,
+			Tokens:      tokens,
+			Refresher:   refresher,
+			Interval:    time.Hour,
+			GracePeriod: gracePeriod,
+			DryRun:      dryRun,
+			Log:         zerolog.New(logs),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return d
+	}
+	login := func(d *Deactivator, id, refreshToken string) {
+		d.OnLogin(context.Background(), &auth.ExtraClaims{ID: id}, &oauth2.Token{RefreshToken: refreshToken})
+	}
+	statuses := func(report *Report) map[string]Status {
+		result := map[string]Status{}
+		for _, r := range report.Results {
+			result[r.ID] = r.Status
+		}
+		return result
+	}
+	It("stores rotated refresh tokens", func() {
+		d := newDeactivator(0, false)
+		login(d, "a@test.com", "a")
+		report, err := d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(statuses(report)).To(Equal(map[string]Status{"a@test.com": StatusActive}))
+		_, refreshToken, err := tokens.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshToken).To(Equal("a+"))
+		// Refresh tokens of logins during the check are kept
+		refresher.onRefresh = func() {
+			refresher.onRefresh = nil
+			login(d, "a@test.com", "a2")
+		}
+		report, err = d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(statuses(report)).To(Equal(map[string]Status{"a@test.com": StatusActive}))
+		_, refreshToken, err = tokens.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshToken).To(Equal("a2"))
+	})
+	It("deactivates users after grace period", func() {
+		d := newDeactivator(50*time.Millisecond, false)
+		login(d, "a@test.com", "a")
+		login(d, "b@test.com", "b")
+		refresher.rejected["a"] = true
+		report, err := d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(statuses(report)).To(Equal(map[string]Status{
+			"a@test.com": StatusRejected,
+			"b@test.com": StatusActive,
+		}))
+		Expect(s.deactivated).To(BeEmpty())
+		time.Sleep(50 * time.Millisecond)
+		report, err = d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(statuses(report)).To(Equal(map[string]Status{
+			"a@test.com": StatusDeactivated,
+			"b@test.com": StatusActive,
+		}))
+		Expect(s.deactivated).To(HaveKeyWithValue("a@test.com", "refresh token rejected: invalid_grant: user disabled"))
+		Expect(tokens.IDs()).To(Equal([]string{"b@test.com"}))
+		// Logging in again reactivates the user
+		login(d, "a@test.com", "a2")
+		d.reactivate()
+		Expect(s.deactivated).To(BeEmpty())
+		Expect(tokens.IDs()).To(Equal([]string{"a@test.com", "b@test.com"}))
+	})
+	It("checks refresh tokens right away when running", func() {
+		d := newDeactivator(0, false)
+		login(d, "a@test.com", "a")
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- d.Run(ctx)
+		}()
+		Eventually(func() (string, error) {
+			_, refreshToken, err := tokens.Get("a@test.com")
+			return refreshToken, err
+		}).Should(Equal("a+"))
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+	It("reactivates users asynchronously when running", func() {
+		d := newDeactivator(time.Hour, false)
+		s.deactivated["a@test.com"] = "test"
+		s.deactivated["b@test.com"] = "test"
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- d.Run(ctx)
+		}()
+		login(d, "a@test.com", "a")
+		Eventually(func() bool { return s.isDeactivated("a@test.com") }).Should(BeFalse())
+		Expect(s.isDeactivated("b@test.com")).To(BeTrue())
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+	It("reports failed reactivations", func() {
+		d := newDeactivator(time.Hour, false)
+		s.deactivated["a@test.com"] = "test"
+		s.reactivateErr = errors.New("broken entry")
+		login(d, "a@test.com", "a")
+		d.reactivate()
+		Expect(logs).To(gbytes.Say("failed to reactivate entries"))
+		Expect(s.discards).To(Equal(1))
+		s.reactivateErr = nil
+		s.saveErr = errors.New("storage unavailable")
+		login(d, "a@test.com", "a")
+		d.reactivate()
+		Expect(logs).To(gbytes.Say("failed to save reactivated entries"))
+		Expect(s.discards).To(Equal(2))
+		// Failed reactivations are retried with the next batch
+		s.saveErr = nil
+		d.reactivate()
+		Expect(s.saves).To(Equal(1))
+		Expect(s.isDeactivated("a@test.com")).To(BeFalse())
+		// Only users, who logged in since, are reactivated
+		d.reactivate()
+		Expect(s.saves).To(Equal(1))
+	})
+	It("keeps refresh tokens of users logging in during a check", func() {
+		d := newDeactivator(0, false)
+		login(d, "a@test.com", "a")
+		d.reactivate()
+		refresher.rejected["a"] = true
+		// Login while the refresh token is checked
+		refresher.onRefresh = func() {
+			refresher.onRefresh = nil
+			login(d, "a@test.com", "a2")
+		}
+		report, err := d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(statuses(report)).To(Equal(map[string]Status{"a@test.com": StatusActive}))
+		record, refreshToken, err := tokens.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshToken).To(Equal("a2"))
+		Expect(record.RejectedSince).To(BeNil())
+		// Login while the entries are deactivated
+		refresher.rejected["a2"] = true
+		s.onDeactivate = func() {
+			s.onDeactivate = nil
+			login(d, "a@test.com", "a3")
+		}
+		report, err = d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(statuses(report)).To(Equal(map[string]Status{"a@test.com": StatusDeactivated}))
+		_, refreshToken, err = tokens.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshToken).To(Equal("a3"))
+		Expect(s.isDeactivated("a@test.com")).To(BeTrue())
+		d.reactivate()
+		Expect(s.isDeactivated("a@test.com")).To(BeFalse())
+	})
+	It("resets rejection if refresh succeeds again", func() {
+		d := newDeactivator(time.Hour, false)
+		login(d, "a@test.com", "a")
+		refresher.rejected["a"] = true
+		_, err := d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		delete(refresher.rejected, "a")
+		_, err = d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		record, _, err := tokens.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(record.RejectedSince).To(BeNil())
+	})
+	It("only reports deactivations in dry-run mode", func() {
+		d := newDeactivator(0, true)
+		login(d, "a@test.com", "a")
+		refresher.rejected["a"] = true
+		report, err := d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.DryRun).To(BeTrue())
+		Expect(statuses(report)).To(Equal(map[string]Status{"a@test.com": StatusDeactivated}))
+		Expect(report.Results[0].RejectedSince).ToNot(BeNil())
+		Expect(s.deactivated).To(BeEmpty())
+		Expect(s.saves).To(Equal(0))
+		Expect(tokens.IDs()).To(Equal([]string{"a@test.com"}))
+	})
+	It("ignores temporary errors", func() {
+		d := newDeactivator(0, false)
+		login(d, "a@test.com", "a")
+		refresher.err = errors.New("connection refused")
+		report, err := d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(statuses(report)).To(Equal(map[string]Status{"a@test.com": StatusError}))
+		refresher.err = &oauth2.RetrieveError{
+			Response: &http.Response{StatusCode: http.StatusUnauthorized},
+			Body:     []byte(`{"error":"invalid_client"}`),
+		}
+		report, err = d.Check(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(statuses(report)).To(Equal(map[string]Status{"a@test.com": StatusError}))
+		Expect(s.deactivated).To(BeEmpty())
+	})
+	It("supports custom rejection codes", func() {
+		reason, ok := rejectionReason(&oauth2.RetrieveError{Body: []byte(`{"error":"invalid_request"}`)}, []string{"invalid_request"})
+		Expect(ok).To(BeTrue())
+		Expect(reason).To(Equal("invalid_request"))
+		reason, ok = rejectionReason(&oauth2.RetrieveError{Body: []byte(`error=invalid_grant`)}, DefaultRejectionCodes)
+		Expect(ok).To(BeTrue())
+		Expect(reason).To(Equal("invalid_grant"))
+	})
+	It("ignores logins without refresh token", func() {
+		d := newDeactivator(0, false)
+		login(d, "a@test.com", "")
+		Expect(tokens.IDs()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,253 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deactivation
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/util"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// saltLen is the length of the random salt used to derive the encryption key.
+const saltLen = 16
+
+// Record is the information kept per user.
+type Record struct {
+	// RefreshToken is the encrypted refresh token of the user
+	RefreshToken string `json:"refreshToken"`
+	// UpdatedAt is the time the refresh token was last stored
+	UpdatedAt time.Time `json:"updatedAt"`
+	// RejectedSince is set once the identity provider rejected the refresh
+	// token for the first time and reset if a refresh succeeds again
+	RejectedSince *time.Time `json:"rejectedSince,omitempty"`
+	// Reason contains the error returned by the identity provider
+	Reason string `json:"reason,omitempty"`
+}
+
+// tokenFile is the content of the file the tokens are stored in.
+type tokenFile struct {
+	// Salt is used to derive the encryption key from the secret
+	Salt    []byte             `json:"salt"`
+	Records map[string]*Record `json:"records"`
+}
+
+// TokenStore persists the refresh tokens of users in a file. The refresh
+// tokens are encrypted using AES-GCM with a key derived from the provided
+// secret using scrypt, so the file does not leak long-lived credentials.
+type TokenStore struct {
+	mutex   sync.Mutex
+	path    string
+	salt    []byte
+	aead    cipher.AEAD
+	records map[string]*Record
+}
+
+// NewTokenStore loads the tokens stored at path, if the file exists.
+func NewTokenStore(path, secret string) (*TokenStore, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("secret is required to encrypt refresh tokens")
+	}
+	file := tokenFile{Records: map[string]*Record{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		file.Salt = make([]byte, saltLen)
+		if _, err := io.ReadFull(rand.Reader, file.Salt); err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %w", path, err)
+	}
+	if len(file.Salt) != saltLen {
+		return nil, fmt.Errorf("invalid salt in %s", path)
+	}
+	if file.Records == nil {
+		file.Records = map[string]*Record{}
+	}
+	// The parameters are the recommended ones for interactive logins, which
+	// is fine as the key is only derived once on startup
+	key, err := scrypt.Key([]byte(secret), file.Salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenStore{
+		path:    path,
+		salt:    file.Salt,
+		aead:    aead,
+		records: file.Records,
+	}, nil
+}
+
+// IDs returns the sorted ids of all users with a stored refresh token.
+func (t *TokenStore) IDs() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ids := make([]string, 0, len(t.records))
+	for id := range t.records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Get returns a copy of the record and the decrypted refresh token of the
+// user.
+func (t *TokenStore) Get(id string) (Record, string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	record, ok := t.records[id]
+	if !ok {
+		return Record{}, "", fmt.Errorf("no refresh token stored for %s", id)
+	}
+	refreshToken, err := t.decrypt(record.RefreshToken)
+	if err != nil {
+		return Record{}, "", fmt.Errorf("failed to decrypt refresh token of %s: %w", id, err)
+	}
+	return *record, refreshToken, nil
+}
+
+// Put stores the refresh token of the user and resets a previous rejection.
+func (t *TokenStore) Put(id, refreshToken string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	encrypted, err := t.encrypt(refreshToken)
+	if err != nil {
+		return err
+	}
+	t.records[id] = &Record{RefreshToken: encrypted, UpdatedAt: time.Now().UTC()}
+	return t.save()
+}
+
+// ErrTokenChanged is returned by PutUnchanged and Reject if the refresh token
+// was stored again since it was checked, e.g. because the user logged in
+// again.
+var ErrTokenChanged = errors.New("refresh token changed")
+
+// PutUnchanged stores the refresh token of the user and resets a previous
+// rejection like Put, unless another refresh token was stored since the
+// checked record was read.
+func (t *TokenStore) PutUnchanged(id string, checked Record, refreshToken string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	record, ok := t.records[id]
+	if !ok {
+		return fmt.Errorf("no refresh token stored for %s", id)
+	}
+	if record.RefreshToken != checked.RefreshToken {
+		return ErrTokenChanged
+	}
+	encrypted, err := t.encrypt(refreshToken)
+	if err != nil {
+		return err
+	}
+	t.records[id] = &Record{RefreshToken: encrypted, UpdatedAt: time.Now().UTC()}
+	return t.save()
+}
+
+// Reject marks the refresh token of the user as rejected, unless another
+// refresh token was stored since the checked record was read. The time of the
+// first rejection is kept.
+func (t *TokenStore) Reject(id string, checked Record, reason string) (Record, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	record, ok := t.records[id]
+	if !ok {
+		return Record{}, fmt.Errorf("no refresh token stored for %s", id)
+	}
+	if record.RefreshToken != checked.RefreshToken {
+		return *record, ErrTokenChanged
+	}
+	if record.RejectedSince == nil {
+		now := time.Now().UTC()
+		record.RejectedSince = &now
+	}
+	record.Reason = reason
+	return *record, t.save()
+}
+
+// DeleteUnchanged removes the record of the user, but only if the refresh
+// token was not stored again since the record was read, e.g. because the user
+// logged in again. It returns whether the record was removed.
+func (t *TokenStore) DeleteUnchanged(id string, record Record) (bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	current, ok := t.records[id]
+	if !ok {
+		return true, nil
+	}
+	if current.RefreshToken != record.RefreshToken {
+		return false, nil
+	}
+	delete(t.records, id)
+	return true, t.save()
+}
+
+func (t *TokenStore) save() error {
+	data, err := json.MarshalIndent(&tokenFile{Salt: t.salt, Records: t.records}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(t.path, data, 0600)
+}
+
+func (t *TokenStore) encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := t.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (t *TokenStore) decrypt(encrypted string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < t.aead.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := data[:t.aead.NonceSize()], data[t.aead.NonceSize():]
+	plaintext, err := t.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deactivation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TokenStore", func() {
+	var (
+		tmpDir string
+		path   string
+	)
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(tmpDir, "tokens.json")
+	})
+	AfterEach(func() {
+		_ = os.RemoveAll(tmpDir)
+	})
+	It("persists encrypted refresh tokens", func() {
+		t, err := NewTokenStore(path, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Put("a@test.com", "refresh-a")).To(Succeed())
+		Expect(t.Put("b@test.com", "refresh-b")).To(Succeed())
+		data, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).ToNot(ContainSubstring("refresh-a"))
+		Expect(string(data)).To(ContainSubstring(`"salt"`))
+		fi, err := os.Stat(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		// Reload from file
+		t, err = NewTokenStore(path, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.IDs()).To(Equal([]string{"a@test.com", "b@test.com"}))
+		_, refreshToken, err := t.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshToken).To(Equal("refresh-a"))
+	})
+	It("only deletes unchanged records", func() {
+		t, err := NewTokenStore(path, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Put("a@test.com", "refresh-a")).To(Succeed())
+		record, _, err := t.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Put("a@test.com", "refresh-a2")).To(Succeed())
+		Expect(t.DeleteUnchanged("a@test.com", record)).To(BeFalse())
+		Expect(t.IDs()).To(Equal([]string{"a@test.com"}))
+		record, _, err = t.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.DeleteUnchanged("a@test.com", record)).To(BeTrue())
+		Expect(t.IDs()).To(BeEmpty())
+	})
+	It("only stores refresh tokens of unchanged records", func() {
+		t, err := NewTokenStore(path, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Put("a@test.com", "refresh-a")).To(Succeed())
+		checked, _, err := t.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = t.Reject("a@test.com", checked, "rejected")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.PutUnchanged("a@test.com", checked, "refresh-a2")).To(Succeed())
+		record, refreshToken, err := t.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshToken).To(Equal("refresh-a2"))
+		Expect(record.RejectedSince).To(BeNil())
+		// Tokens stored since the check are kept
+		Expect(t.Put("a@test.com", "refresh-a3")).To(Succeed())
+		Expect(t.PutUnchanged("a@test.com", record, "refresh-a4")).To(MatchError(ErrTokenChanged))
+		_, refreshToken, err = t.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshToken).To(Equal("refresh-a3"))
+		Expect(t.PutUnchanged("unknown@test.com", record, "refresh")).ToNot(Succeed())
+	})
+	It("fails to decrypt with other secret", func() {
+		t, err := NewTokenStore(path, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Put("a@test.com", "refresh-a")).To(Succeed())
+		t, err = NewTokenStore(path, "other")
+		Expect(err).ToNot(HaveOccurred())
+		_, _, err = t.Get("a@test.com")
+		Expect(err).To(HaveOccurred())
+	})
+	It("keeps time of first rejection until token is stored again", func() {
+		t, err := NewTokenStore(path, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Put("a@test.com", "refresh-a")).To(Succeed())
+		checked, _, err := t.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		first, err := t.Reject("a@test.com", checked, "first")
+		Expect(err).ToNot(HaveOccurred())
+		second, err := t.Reject("a@test.com", checked, "second")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*second.RejectedSince).To(Equal(*first.RejectedSince))
+		Expect(second.Reason).To(Equal("second"))
+		Expect(t.Put("a@test.com", "refresh-a")).To(Succeed())
+		record, _, err := t.Get("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(record.RejectedSince).To(BeNil())
+		// Tokens stored since the check are not rejected
+		_, err = t.Reject("a@test.com", checked, "third")
+		Expect(err).To(MatchError(ErrTokenChanged))
+		_, err = t.Reject("unknown@test.com", checked, "test")
+		Expect(err).To(HaveOccurred())
+	})
+	It("derives different keys for different files", func() {
+		t, err := NewTokenStore(path, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Put("a@test.com", "refresh-a")).To(Succeed())
+		other := filepath.Join(tmpDir, "other.json")
+		o, err := NewTokenStore(other, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(o.Put("a@test.com", "refresh-a")).To(Succeed())
+		Expect(o.salt).ToNot(Equal(t.salt))
+		// Records can not be decrypted with the key of another file
+		o.records["a@test.com"] = t.records["a@test.com"]
+		_, _, err = o.Get("a@test.com")
+		Expect(err).To(HaveOccurred())
+	})
+	It("rejects files without valid salt", func() {
+		Expect(ioutil.WriteFile(path, []byte(`{"records":{}}`), 0600)).To(Succeed())
+		_, err := NewTokenStore(path, "secret")
+		Expect(err).To(MatchError(ContainSubstring("invalid salt")))
+	})
+	It("requires a secret", func() {
+		_, err := NewTokenStore(path, "")
+		Expect(err).To(HaveOccurred())
+	})
+})
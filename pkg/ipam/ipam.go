@@ -0,0 +1,201 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrExhausted is returned if a prefix does not contain any free addresses.
+var ErrExhausted = errors.New("no free address left")
+
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+func (r ipRange) contains(ip net.IP) bool {
+	return bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0
+}
+
+// IPAM allocates addresses from the configured prefixes, e.g. an IPv4 and an
+// IPv6 network of the VPN. It does not keep track of allocations itself, but
+// derives the free addresses from the addresses in use. Releasing an address
+// is therefore as simple as removing the entry it was assigned to.
+type IPAM struct {
+	prefixes []*net.IPNet
+	reserved []ipRange
+}
+
+// New creates an IPAM for the provided prefixes in CIDR notation. At most one
+// prefix per address family is allowed. Reserved addresses will never be
+// allocated and can be provided as single address ("10.0.0.1"), prefix
+// ("10.0.0.0/29") or range ("10.0.0.1-10.0.0.9").
+func New(cidrs []string, reserved []string) (*IPAM, error) {
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("at least one prefix is required")
+	}
+	p := &IPAM{}
+	families := map[int]bool{}
+	for _, cidr := range cidrs {
+		_, prefix, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q: %w", cidr, err)
+		}
+		prefix.IP = normalize(prefix.IP)
+		if families[len(prefix.IP)] {
+			return nil, fmt.Errorf("only one prefix per address family allowed, got second %q", cidr)
+		}
+		families[len(prefix.IP)] = true
+		p.prefixes = append(p.prefixes, prefix)
+		// The network address and the IPv4 broadcast address are not usable
+		// for peers, so let's reserve them right away
+		first, last := bounds(prefix)
+		p.reserved = append(p.reserved, ipRange{first, first})
+		if ones, bits := prefix.Mask.Size(); bits == 8*net.IPv4len && ones < 31 {
+			p.reserved = append(p.reserved, ipRange{last, last})
+		}
+	}
+	for _, value := range reserved {
+		r, err := parseRange(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		p.reserved = append(p.reserved, r)
+	}
+	return p, nil
+}
+
+// Allocate returns the lowest free address of every configured prefix as
+// comma-separated list, which can be used as allowed IPs of a peer, e.g.
+// "10.0.0.2/32, fd00::2/128". The used addresses are expected in the same
+// format, but any notation of addresses and prefixes is accepted.
+func (p *IPAM) Allocate(used []string) (string, error) {
+	inUse := map[string]bool{}
+	for _, value := range used {
+		for _, addr := range strings.Split(value, ",") {
+			if ip := parseIP(strings.TrimSpace(addr)); ip != nil {
+				inUse[string(ip)] = true
+			}
+		}
+	}
+	allocated := make([]string, 0, len(p.prefixes))
+	for _, prefix := range p.prefixes {
+		ip, err := p.next(prefix, inUse)
+		if err != nil {
+			return "", err
+		}
+		allocated = append(allocated, fmt.Sprintf("%s/%d", ip, 8*len(ip)))
+	}
+	return strings.Join(allocated, ", "), nil
+}
+
+func (p *IPAM) next(prefix *net.IPNet, inUse map[string]bool) (net.IP, error) {
+	ip, last := bounds(prefix)
+	for bytes.Compare(ip, last) <= 0 {
+		if r, ok := p.reservedRange(ip); ok {
+			if bytes.Compare(r.last, last) >= 0 {
+				break
+			}
+			ip = increment(r.last)
+			continue
+		}
+		if !inUse[string(ip)] {
+			return ip, nil
+		}
+		if bytes.Equal(ip, last) {
+			break
+		}
+		ip = increment(ip)
+	}
+	return nil, fmt.Errorf("%w in %s", ErrExhausted, prefix)
+}
+
+func (p *IPAM) reservedRange(ip net.IP) (ipRange, bool) {
+	for _, r := range p.reserved {
+		if len(r.first) == len(ip) && r.contains(ip) {
+			return r, true
+		}
+	}
+	return ipRange{}, false
+}
+
+func parseRange(value string) (ipRange, error) {
+	if strings.Contains(value, "/") {
+		_, prefix, err := net.ParseCIDR(value)
+		if err != nil {
+			return ipRange{}, fmt.Errorf("invalid reserved prefix %q: %w", value, err)
+		}
+		prefix.IP = normalize(prefix.IP)
+		first, last := bounds(prefix)
+		return ipRange{first, last}, nil
+	}
+	parts := strings.SplitN(value, "-", 2)
+	first := normalize(net.ParseIP(strings.TrimSpace(parts[0])))
+	last := first
+	if len(parts) == 2 {
+		last = normalize(net.ParseIP(strings.TrimSpace(parts[1])))
+	}
+	if first == nil || last == nil || len(first) != len(last) || bytes.Compare(first, last) > 0 {
+		return ipRange{}, fmt.Errorf("invalid reserved address or range %q", value)
+	}
+	return ipRange{first, last}, nil
+}
+
+// parseIP will parse an address with or without prefix length and returns
+// it normalized or nil if the value is invalid.
+func parseIP(value string) net.IP {
+	if i := strings.Index(value, "/"); i >= 0 {
+		value = value[:i]
+	}
+	return normalize(net.ParseIP(value))
+}
+
+// normalize will return IPv4 addresses in their 4-byte representation, so
+// addresses of the same family can be compared bytewise.
+func normalize(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func bounds(prefix *net.IPNet) (net.IP, net.IP) {
+	first := make(net.IP, len(prefix.IP))
+	last := make(net.IP, len(prefix.IP))
+	for i := range prefix.IP {
+		first[i] = prefix.IP[i] & prefix.Mask[i]
+		last[i] = prefix.IP[i] | ^prefix.Mask[i]
+	}
+	return first, last
+}
+
+func increment(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IPAM", func() {
+	It("allocates lowest free address", func() {
+		p, err := New([]string{"10.0.0.0/24"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ip, err := p.Allocate(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(Equal("10.0.0.1/32"))
+		ip, err = p.Allocate([]string{"10.0.0.1/32", "10.0.0.3/32"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(Equal("10.0.0.2/32"))
+	})
+	It("allocates from IPv4 and IPv6 prefixes", func() {
+		p, err := New([]string{"10.0.0.0/24", "fd00::/64"}, []string{"10.0.0.1", "fd00::1"})
+		Expect(err).ToNot(HaveOccurred())
+		ip, err := p.Allocate([]string{"10.0.0.2/32, fd00::2/128", "0.0.0.0/0"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(Equal("10.0.0.3/32, fd00::3/128"))
+	})
+	It("skips reserved prefixes and ranges", func() {
+		p, err := New([]string{"10.0.0.0/24"}, []string{"10.0.0.0/29", "10.0.0.8-10.0.0.10"})
+		Expect(err).ToNot(HaveOccurred())
+		ip, err := p.Allocate(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(Equal("10.0.0.11/32"))
+	})
+	It("fails if pool is exhausted", func() {
+		p, err := New([]string{"10.0.0.0/30"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ip, err := p.Allocate([]string{"10.0.0.1/32"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(Equal("10.0.0.2/32"))
+		_, err = p.Allocate([]string{"10.0.0.1/32", ip})
+		Expect(errors.Is(err, ErrExhausted)).To(BeTrue())
+		p, err = New([]string{"fd00::/126"}, []string{"fd00::1-fd00::3"})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = p.Allocate(nil)
+		Expect(errors.Is(err, ErrExhausted)).To(BeTrue())
+	})
+	It("fails for invalid configuration", func() {
+		_, err := New(nil, nil)
+		Expect(err).To(HaveOccurred())
+		_, err = New([]string{"10.0.0.0/33"}, nil)
+		Expect(err).To(HaveOccurred())
+		_, err = New([]string{"10.0.0.0/24", "10.1.0.0/24"}, nil)
+		Expect(err).To(HaveOccurred())
+		_, err = New([]string{"10.0.0.0/24"}, []string{"10.0.0.9-10.0.0.1"})
+		Expect(err).To(HaveOccurred())
+		_, err = New([]string{"10.0.0.0/24"}, []string{"foo"})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/kubism/smorgasbord/pkg/util"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeyLen is the length of wireguard keys in bytes.
+const KeyLen = 32
+
+// Key is a curve25519 key as used by wireguard.
+type Key [KeyLen]byte
+
+// GeneratePrivateKey generates a new private key using a cryptographically
+// secure source of randomness.
+func GeneratePrivateKey() (Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return Key{}, fmt.Errorf("failed to read random bytes: %v", err)
+	}
+	// Clamp the key as described by https://cr.yp.to/ecdh.html
+	k[0] &= 248
+	k[31] &= 127
+	k[31] |= 64
+	return k, nil
+}
+
+// ParseKey parses a base64 encoded key, e.g. as returned by `wg genkey`.
+func ParseKey(s string) (Key, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to decode key: %v", err)
+	}
+	if len(data) != KeyLen {
+		return Key{}, fmt.Errorf("invalid key length %d, expected %d", len(data), KeyLen)
+	}
+	var k Key
+	copy(k[:], data)
+	return k, nil
+}
+
+// PublicKey derives the public key, if k is a private key.
+func (k Key) PublicKey() Key {
+	var pub Key
+	curve25519.ScalarBaseMult((*[KeyLen]byte)(&pub), (*[KeyLen]byte)(&k))
+	return pub
+}
+
+// String returns the base64 encoded key.
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ReadPrivateKey reads the private key stored at path.
+func ReadPrivateKey(path string) (Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	return ParseKey(string(data))
+}
+
+// WritePrivateKey stores the private key at path, which is only readable by
+// the current user. The file is written atomically, so an existing key is
+// either replaced completely or not at all.
+func WritePrivateKey(path string, k Key) error {
+	return util.WriteFileAtomic(path, []byte(k.String()+"\n"), 0600)
+}
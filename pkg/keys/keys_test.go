@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keys
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Keys", func() {
+	It("derives public key", func() {
+		// Test vector generated using `wg genkey | tee /dev/stderr | wg pubkey`
+		priv, err := ParseKey("yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(priv.PublicKey().String()).To(Equal("HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw="))
+	})
+	It("generates distinct clamped private keys", func() {
+		k1, err := GeneratePrivateKey()
+		Expect(err).ToNot(HaveOccurred())
+		k2, err := GeneratePrivateKey()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(k1).ToNot(Equal(k2))
+		Expect(k1[0] & 7).To(BeZero())
+		Expect(k1[31] & 64).ToNot(BeZero())
+		parsed, err := ParseKey(k1.String())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsed).To(Equal(k1))
+	})
+	It("fails to parse invalid keys", func() {
+		_, err := ParseKey("invalid")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseKey("aGVsbG8=")
+		Expect(err).To(HaveOccurred())
+	})
+	It("writes private key only readable by user", func() {
+		path := filepath.Join(tmpDir, "key")
+		k, err := GeneratePrivateKey()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(WritePrivateKey(path, k)).To(Succeed())
+		fi, err := os.Stat(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		read, err := ReadPrivateKey(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(k))
+	})
+})
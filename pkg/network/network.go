@@ -0,0 +1,185 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+
+	"github.com/kubism/smorgasbord/pkg/ipam"
+	"github.com/kubism/smorgasbord/pkg/storage"
+)
+
+// validName matches names, which are safe to use in URLs and file names.
+var validName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Network is a VPN served by one or more wireguard servers sharing the same
+// key pair. Entries are scoped to a single network, whose CIDRs their
+// allowed IPs are allocated from.
+type Network struct {
+	// Name identifies the network, e.g. when registering a key
+	Name string `json:"name"`
+	// CIDRs of the network (at most one per address family), which allowed
+	// IPs of new peers are allocated from. If empty, no allowed IPs are
+	// allocated.
+	CIDRs []string `json:"cidrs,omitempty"`
+	// ReservedIPs are addresses, prefixes or ranges, which will not be
+	// allocated, e.g. the address of the server
+	ReservedIPs []string `json:"reservedIPs,omitempty"`
+	// PublicKey of the wireguard servers of the network
+	PublicKey string `json:"publicKey,omitempty"`
+	// Endpoints (host:port) of the wireguard servers of the network
+	Endpoints []string `json:"endpoints,omitempty"`
+	// DNS servers clients should use while connected
+	DNS []string `json:"dns,omitempty"`
+	// AllowedIPs are the routes clients should send through the VPN,
+	// defaults to the CIDRs
+	AllowedIPs []string `json:"allowedIPs,omitempty"`
+	// PersistentKeepalive interval in seconds clients should use
+	PersistentKeepalive int `json:"persistentKeepalive,omitempty"`
+	// Groups of users, which may use the network. All users may use the
+	// network if no groups are provided.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Allows returns whether a member of the groups may use the network.
+func (n *Network) Allows(groups []string) bool {
+	if len(n.Groups) == 0 {
+		return true
+	}
+	for _, allowed := range n.Groups {
+		for _, group := range groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Networks contains all networks of a deployment and allocates allowed IPs
+// within the network of an entry. It implements storage.NetworkAllocator.
+type Networks struct {
+	networks   []Network
+	allocators map[string]*ipam.IPAM
+}
+
+// New validates the networks and sets up their allocators. Names must be
+// unique and the CIDRs of the networks must not overlap, so allowed IPs are
+// unique across all networks.
+func New(networks []Network) (*Networks, error) {
+	n := &Networks{allocators: map[string]*ipam.IPAM{}}
+	var prefixes []*net.IPNet
+	for _, network := range networks {
+		if !validName.MatchString(network.Name) {
+			return nil, fmt.Errorf("invalid network name %q, only lowercase alphanumeric characters and dashes are allowed", network.Name)
+		}
+		if _, ok := n.allocators[network.Name]; ok {
+			return nil, fmt.Errorf("network %q is defined twice", network.Name)
+		}
+		var allocator *ipam.IPAM
+		if len(network.CIDRs) > 0 {
+			var err error
+			allocator, err = ipam.New(network.CIDRs, network.ReservedIPs)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", network.Name, err)
+			}
+		}
+		for _, cidr := range network.CIDRs {
+			// The CIDR was already validated by ipam.New
+			_, prefix, _ := net.ParseCIDR(cidr)
+			for _, other := range prefixes {
+				if other.Contains(prefix.IP) || prefix.Contains(other.IP) {
+					return nil, fmt.Errorf("CIDR %s of network %q overlaps with %s", cidr, network.Name, other)
+				}
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		if len(network.AllowedIPs) == 0 {
+			network.AllowedIPs = network.CIDRs
+		}
+		n.networks = append(n.networks, network)
+		n.allocators[network.Name] = allocator
+	}
+	return n, nil
+}
+
+// Load reads the networks from a JSON file containing a list of networks.
+func Load(path string) ([]Network, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	networks := []Network{}
+	if err := json.Unmarshal(data, &networks); err != nil {
+		return nil, fmt.Errorf("failed to decode networks: %w", err)
+	}
+	return networks, nil
+}
+
+// List returns all networks in the order they were configured.
+func (n *Networks) List() []Network {
+	return append([]Network{}, n.networks...)
+}
+
+// Names returns the names of all networks in the order they were configured.
+func (n *Networks) Names() []string {
+	names := make([]string, 0, len(n.networks))
+	for _, network := range n.networks {
+		names = append(names, network.Name)
+	}
+	return names
+}
+
+// Get returns the network with the provided name. The empty name refers to
+// storage.DefaultNetwork.
+func (n *Networks) Get(name string) (*Network, bool) {
+	if name == "" {
+		name = storage.DefaultNetwork
+	}
+	for i := range n.networks {
+		if n.networks[i].Name == name {
+			network := n.networks[i]
+			return &network, true
+		}
+	}
+	return nil, false
+}
+
+// Allocate assigns an allowed IP within storage.DefaultNetwork.
+func (n *Networks) Allocate(used []string) (string, error) {
+	return n.AllocateFor("", used)
+}
+
+// AllocateFor assigns an allowed IP within the network with the provided
+// name. No allowed IP is assigned if the network has no CIDRs.
+func (n *Networks) AllocateFor(name string, used []string) (string, error) {
+	if name == "" {
+		name = storage.DefaultNetwork
+	}
+	allocator, ok := n.allocators[name]
+	if !ok {
+		return "", fmt.Errorf("unknown network %q", name)
+	}
+	if allocator == nil {
+		return "", nil
+	}
+	return allocator.Allocate(used)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Networks", func() {
+	It("allocates allowed IPs within the network", func() {
+		n, err := New([]Network{
+			{Name: storage.DefaultNetwork, CIDRs: []string{"10.0.0.0/24"}},
+			{Name: "office", CIDRs: []string{"10.1.0.0/24", "fd00::/64"}, ReservedIPs: []string{"10.1.0.1"}},
+			{Name: "lab"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		used := []string{"10.0.0.1/32", "10.1.0.2/32, fd00::1/128"}
+		Expect(n.Allocate(used)).To(Equal("10.0.0.2/32"))
+		Expect(n.AllocateFor("", used)).To(Equal("10.0.0.2/32"))
+		Expect(n.AllocateFor("office", used)).To(Equal("10.1.0.3/32, fd00::2/128"))
+		Expect(n.AllocateFor("lab", used)).To(BeEmpty())
+		_, err = n.AllocateFor("unknown", used)
+		Expect(err).To(MatchError(ContainSubstring("unknown network")))
+		// Allocations depend on the network of the entry
+		st := storage.State{}
+		Expect(st.Add("a@test.com", storage.Entry{PublicKey: "a", Network: "office"}, n, storage.Now())).To(Succeed())
+		Expect(st.Add("a@test.com", storage.Entry{PublicKey: "b"}, n, storage.Now())).To(Succeed())
+		Expect(st.AllowedIPs()).To(ConsistOf("10.1.0.2/32, fd00::1/128", "10.0.0.1/32"))
+	})
+	It("returns networks by name", func() {
+		n, err := New([]Network{
+			{Name: storage.DefaultNetwork, CIDRs: []string{"10.0.0.0/24"}},
+			{Name: "office", AllowedIPs: []string{"0.0.0.0/0"}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		network, ok := n.Get("")
+		Expect(ok).To(BeTrue())
+		Expect(network.Name).To(Equal(storage.DefaultNetwork))
+		Expect(network.AllowedIPs).To(Equal([]string{"10.0.0.0/24"}))
+		network, ok = n.Get("office")
+		Expect(ok).To(BeTrue())
+		Expect(network.AllowedIPs).To(Equal([]string{"0.0.0.0/0"}))
+		_, ok = n.Get("unknown")
+		Expect(ok).To(BeFalse())
+		Expect(n.List()).To(HaveLen(2))
+		Expect(n.Names()).To(Equal([]string{"default", "office"}))
+	})
+	It("validates networks", func() {
+		for _, networks := range [][]Network{
+			{{Name: ""}},
+			{{Name: "Office"}},
+			{{Name: "../office"}},
+			{{Name: "office"}, {Name: "office"}},
+			{{Name: "office", CIDRs: []string{"invalid"}}},
+			{{Name: "a", CIDRs: []string{"10.0.0.0/16"}}, {Name: "b", CIDRs: []string{"10.0.1.0/24"}}},
+		} {
+			_, err := New(networks)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+	It("restricts networks to groups", func() {
+		network := &Network{Name: "office"}
+		Expect(network.Allows(nil)).To(BeTrue())
+		network.Groups = []string{"admins", "developers"}
+		Expect(network.Allows(nil)).To(BeFalse())
+		Expect(network.Allows([]string{"sales"})).To(BeFalse())
+		Expect(network.Allows([]string{"sales", "developers"})).To(BeTrue())
+	})
+	It("loads networks from file", func() {
+		dir, err := ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "networks.json")
+		Expect(ioutil.WriteFile(path, []byte(`[{ "name": "office", "cidrs": ["10.0.0.0/24"], "endpoints": ["vpn.test.com:51820"], "groups": ["staff"] }]`), 0644)).To(Succeed())
+		networks, err := Load(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(networks).To(Equal([]Network{{
+			Name:      "office",
+			CIDRs:     []string{"10.0.0.0/24"},
+			Endpoints: []string{"vpn.test.com:51820"},
+			Groups:    []string{"staff"},
+		}}))
+		Expect(ioutil.WriteFile(path, []byte(`{`), 0644)).To(Succeed())
+		_, err = Load(path)
+		Expect(err).To(HaveOccurred())
+	})
+})
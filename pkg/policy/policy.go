@@ -0,0 +1,171 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ErrForbidden is wrapped by all errors returned if the policy denies an
+// action, so they can be distinguished from other errors.
+var ErrForbidden = errors.New("forbidden")
+
+// AllUsers can be used as group of a rule to match every user.
+const AllUsers = "*"
+
+// Rule grants the members of a group the permission to register keys.
+type Rule struct {
+	// Group the rule applies to or AllUsers
+	Group string `json:"group"`
+	// Networks the members may register keys for, all networks if empty
+	Networks []string `json:"networks,omitempty"`
+	// MaxDevices is the number of keys each member may register for each of
+	// the networks, unlimited if zero
+	MaxDevices int `json:"maxDevices,omitempty"`
+}
+
+// Policy decides which users may register keys, for which networks and how
+// many. Users may only register keys if at least one rule matches one of
+// their groups. If a user is member of multiple groups, the most permissive
+// rules apply. A policy without rules allows all users to register any number
+// of keys, so a nil *Policy can be used as well.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Load reads the policy from a JSON file.
+func Load(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to decode policy: %w", err)
+	}
+	return p, nil
+}
+
+// Validate checks the rules, e.g. whether all networks they refer to are
+// known.
+func (p *Policy) Validate(networks []string) error {
+	if p == nil {
+		return nil
+	}
+	known := map[string]bool{}
+	for _, name := range networks {
+		known[name] = true
+	}
+	for i, rule := range p.Rules {
+		if rule.Group == "" {
+			return fmt.Errorf("group of rule %d is required", i)
+		}
+		if rule.MaxDevices < 0 {
+			return fmt.Errorf("max devices of rule %d must not be negative", i)
+		}
+		for _, name := range rule.Networks {
+			if !known[name] {
+				return fmt.Errorf("rule %d refers to unknown network %q", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+// AllowsNetwork returns whether a member of the groups may register keys
+// for the network.
+func (p *Policy) AllowsNetwork(groups []string, network string) bool {
+	for _, rule := range p.matching(groups) {
+		if rule.covers(network) {
+			return true
+		}
+	}
+	return p == nil || len(p.Rules) == 0
+}
+
+// AuthorizeAdd returns an error wrapping ErrForbidden, if a member of the
+// groups, who already registered the number of devices for the network, is
+// not allowed to register another key for it.
+func (p *Policy) AuthorizeAdd(groups []string, network string, devices int) error {
+	if p == nil || len(p.Rules) == 0 {
+		return nil
+	}
+	rules := p.matching(groups)
+	if len(rules) == 0 {
+		return fmt.Errorf("%w: none of your groups may register keys", ErrForbidden)
+	}
+	// Only rules covering the network may raise the limit, otherwise an
+	// unlimited rule for another network would lift it
+	max := 0
+	covered := false
+	for _, rule := range rules {
+		if !rule.covers(network) {
+			continue
+		}
+		covered = true
+		if rule.MaxDevices == 0 {
+			return nil
+		}
+		if rule.MaxDevices > max {
+			max = rule.MaxDevices
+		}
+	}
+	if !covered {
+		return fmt.Errorf("%w: none of your groups may register keys for network %q", ErrForbidden, network)
+	}
+	if devices >= max {
+		return fmt.Errorf("%w: you already registered %d of %d allowed keys", ErrForbidden, devices, max)
+	}
+	return nil
+}
+
+// covers returns whether the rule grants access to the network.
+func (r Rule) covers(network string) bool {
+	if len(r.Networks) == 0 {
+		return true
+	}
+	for _, name := range r.Networks {
+		if name == network {
+			return true
+		}
+	}
+	return false
+}
+
+// matching returns the rules applying to members of the groups.
+func (p *Policy) matching(groups []string) []Rule {
+	if p == nil {
+		return nil
+	}
+	var rules []Rule
+	for _, rule := range p.Rules {
+		if rule.Group == AllUsers {
+			rules = append(rules, rule)
+			continue
+		}
+		for _, group := range groups {
+			if group == rule.Group {
+				rules = append(rules, rule)
+				break
+			}
+		}
+	}
+	return rules
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy", func() {
+	p := &Policy{Rules: []Rule{
+		{Group: "staff", MaxDevices: 3},
+		{Group: "contractors", Networks: []string{"office"}, MaxDevices: 1},
+		{Group: "admins"},
+	}}
+	It("allows everything without rules", func() {
+		var nilPolicy *Policy
+		Expect(nilPolicy.AuthorizeAdd(nil, "default", 100)).To(Succeed())
+		Expect(nilPolicy.AllowsNetwork(nil, "default")).To(BeTrue())
+		Expect((&Policy{}).AuthorizeAdd(nil, "default", 100)).To(Succeed())
+		Expect((&Policy{}).AllowsNetwork(nil, "default")).To(BeTrue())
+	})
+	It("denies users without matching rules", func() {
+		err := p.AuthorizeAdd([]string{"sales"}, "default", 0)
+		Expect(err).To(MatchError(ErrForbidden))
+		Expect(err).To(MatchError(ContainSubstring("none of your groups may register keys")))
+		Expect(p.AllowsNetwork(nil, "default")).To(BeFalse())
+	})
+	It("restricts networks", func() {
+		Expect(p.AuthorizeAdd([]string{"contractors"}, "office", 0)).To(Succeed())
+		err := p.AuthorizeAdd([]string{"contractors"}, "default", 0)
+		Expect(err).To(MatchError(ErrForbidden))
+		Expect(err).To(MatchError(ContainSubstring(`network "default"`)))
+		// The most permissive rule applies
+		Expect(p.AuthorizeAdd([]string{"contractors", "staff"}, "default", 0)).To(Succeed())
+		Expect(p.AllowsNetwork([]string{"contractors"}, "office")).To(BeTrue())
+		Expect(p.AllowsNetwork([]string{"contractors"}, "default")).To(BeFalse())
+	})
+	It("limits devices", func() {
+		Expect(p.AuthorizeAdd([]string{"staff"}, "default", 2)).To(Succeed())
+		err := p.AuthorizeAdd([]string{"staff"}, "default", 3)
+		Expect(err).To(MatchError(ErrForbidden))
+		Expect(err).To(MatchError(ContainSubstring("3 of 3")))
+		Expect(p.AuthorizeAdd([]string{"staff", "contractors"}, "office", 2)).To(Succeed())
+		Expect(p.AuthorizeAdd([]string{"staff", "admins"}, "default", 100)).To(Succeed())
+	})
+	It("limits devices only by rules covering the network", func() {
+		split := &Policy{Rules: []Rule{
+			{Group: "a", Networks: []string{"office"}},
+			{Group: "b", Networks: []string{"lab"}, MaxDevices: 2},
+		}}
+		groups := []string{"a", "b"}
+		Expect(split.AuthorizeAdd(groups, "lab", 1)).To(Succeed())
+		err := split.AuthorizeAdd(groups, "lab", 2)
+		Expect(err).To(MatchError(ErrForbidden))
+		Expect(err).To(MatchError(ContainSubstring("2 of 2")))
+		Expect(split.AuthorizeAdd(groups, "office", 100)).To(Succeed())
+	})
+	It("matches all users", func() {
+		all := &Policy{Rules: []Rule{{Group: AllUsers, MaxDevices: 1}}}
+		Expect(all.AuthorizeAdd(nil, "default", 0)).To(Succeed())
+		Expect(all.AuthorizeAdd(nil, "default", 1)).To(MatchError(ErrForbidden))
+	})
+	It("validates rules", func() {
+		Expect(p.Validate([]string{"default", "office"})).To(Succeed())
+		Expect(p.Validate([]string{"default"})).To(MatchError(ContainSubstring(`unknown network "office"`)))
+		Expect((&Policy{Rules: []Rule{{}}}).Validate(nil)).ToNot(Succeed())
+		Expect((&Policy{Rules: []Rule{{Group: "a", MaxDevices: -1}}}).Validate(nil)).ToNot(Succeed())
+	})
+	It("loads policy from file", func() {
+		dir, err := ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "policy.json")
+		Expect(ioutil.WriteFile(path, []byte(`{ "rules": [{ "group": "staff", "networks": ["office"], "maxDevices": 2 }] }`), 0644)).To(Succeed())
+		loaded, err := Load(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded.Rules).To(Equal([]Rule{{Group: "staff", Networks: []string{"office"}, MaxDevices: 2}}))
+		Expect(ioutil.WriteFile(path, []byte(`[]`), 0644)).To(Succeed())
+		_, err = Load(path)
+		Expect(err).To(HaveOccurred())
+	})
+})
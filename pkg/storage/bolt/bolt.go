@@ -0,0 +1,586 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/util"
+
+	bbolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultTimeout = time.Second
+	fileMode       = 0600
+	exportFileMode = 0644
+)
+
+var (
+	// entriesBucket maps public keys to records, which enforces the
+	// uniqueness of public keys
+	entriesBucket = []byte("entries")
+	// usersBucket contains a bucket per user mapping a sequence to the public
+	// keys of the user, so entries are listed in the order they were added
+	usersBucket = []byte("users")
+	// allowedIPsBucket maps each canonical prefix of the allowed IPs to the
+	// public key, which enforces the uniqueness of allowed IPs
+	allowedIPsBucket = []byte("allowedIPs")
+	// metaBucket contains the schema version
+	metaBucket = []byte("meta")
+	versionKey = []byte("version")
+)
+
+// Options configure the bolt storage. Only the path is required.
+type Options struct {
+	// Path of the database, which is created if it does not exist
+	Path string
+	// Allocator assigns allowed IPs to new entries, if provided
+	Allocator storage.Allocator
+	// ExportPath is the file the state is exported to after every successful
+	// Save, if provided. The export uses the format of the file and git
+	// storage, so the agent can read it using the file storage.
+	ExportPath string
+	// Timeout to wait for the lock of the database, which is held by a single
+	// process only, defaults to one second
+	Timeout time.Duration
+}
+
+// record is the value of entriesBucket.
+type record struct {
+	ID  string `json:"id"`
+	Seq uint64 `json:"seq"`
+	storage.Entry
+}
+
+type boltStorage struct {
+	mutex        sync.Mutex
+	transactions storage.Transactions
+	db           *bbolt.DB
+	allocator    storage.Allocator
+	exportPath   string
+	// tx contains all changes, which were not saved yet
+	tx *bbolt.Tx
+	// pending contains the operations applied to tx, so they can be replayed
+	// if a later operation fails
+	pending []func(tx *bbolt.Tx) error
+}
+
+// NewStorage opens the database and returns a storage.Storage operating on
+// it. All changes made between two calls of Save are part of a single
+// transaction, so they are either persisted together or not at all. The
+// database can only be opened by a single process at a time, see
+// Options.ExportPath to share the state with the agent.
+func NewStorage(opts *Options) (storage.Storage, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(opts.Path, fileMode, &bbolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", opts.Path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, usersBucket, allowedIPsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if err := reindexAllowedIPs(tx); err != nil {
+			return err
+		}
+		meta := tx.Bucket(metaBucket)
+		if data := meta.Get(versionKey); data != nil {
+			version, err := strconv.Atoi(string(data))
+			if err != nil {
+				return fmt.Errorf("invalid schema version %q", string(data))
+			}
+			if version > storage.CurrentVersion {
+				return fmt.Errorf("schema version %d is newer than supported version %d", version, storage.CurrentVersion)
+			}
+		}
+		return meta.Put(versionKey, []byte(strconv.Itoa(storage.CurrentVersion)))
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	s := &boltStorage{
+		db:         db,
+		allocator:  opts.Allocator,
+		exportPath: opts.ExportPath,
+	}
+	// Export the current state, so it is available right away
+	if err := s.exportFile(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add will add the entry to the user with the provided id. The changes are
+// only persisted once Save is called.
+func (s *boltStorage) Add(id string, entry storage.Entry) error {
+	t := storage.Now()
+	return s.update(func(tx *bbolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		if entry.PublicKey == "" {
+			return fmt.Errorf("public key is required")
+		}
+		if entries.Get([]byte(entry.PublicKey)) != nil {
+			return storage.ErrKeyExists
+		}
+		var allocator storage.Allocator
+		if s.allocator != nil {
+			used := allowedIPs(tx)
+			allocator = storage.AllocatorFunc(func([]string) (string, error) {
+				return storage.Allocate(s.allocator, entry.Network, used)
+			})
+		}
+		st := storage.State{}
+		if err := st.Add(id, entry, allocator, t); err != nil {
+			return err
+		}
+		r := &record{ID: id, Entry: st[id][0]}
+		// Each prefix is canonicalized, as it is used as key to enforce its
+		// uniqueness
+		var prefixes []string
+		if r.AllowedIP != "" {
+			var err error
+			prefixes, err = storage.AllowedIPPrefixes(r.AllowedIP)
+			if err != nil {
+				return err
+			}
+			r.AllowedIP = strings.Join(prefixes, ", ")
+		}
+		ips := tx.Bucket(allowedIPsBucket)
+		for _, prefix := range prefixes {
+			if ips.Get([]byte(prefix)) != nil {
+				return fmt.Errorf("%w: %s", storage.ErrAllowedIPExists, prefix)
+			}
+		}
+		user, err := tx.Bucket(usersBucket).CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+		r.Seq, err = user.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := user.Put(seqKey(r.Seq), []byte(r.PublicKey)); err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			if err := ips.Put([]byte(prefix), []byte(r.PublicKey)); err != nil {
+				return err
+			}
+		}
+		return putRecord(tx, r)
+	})
+}
+
+// Update will replace the metadata of the entry with the same public key of
+// the user with the provided id. Similar to Add the changes have to be
+// persisted using Save.
+func (s *boltStorage) Update(id string, entry storage.Entry) error {
+	t := storage.Now()
+	return s.update(func(tx *bbolt.Tx) error {
+		r, err := getRecord(tx, id, entry.PublicKey)
+		if err != nil {
+			return err
+		}
+		st := storage.State{id: {r.Entry}}
+		if err := st.Update(id, entry, t); err != nil {
+			return err
+		}
+		r.Entry = st[id][0]
+		return putRecord(tx, r)
+	})
+}
+
+// Delete will remove the entry with the public key from the user with the
+// provided id. Similar to Add the changes have to be persisted using Save.
+func (s *boltStorage) Delete(id, publicKey string) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		r, err := getRecord(tx, id, publicKey)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(entriesBucket).Delete([]byte(publicKey)); err != nil {
+			return err
+		}
+		ips := tx.Bucket(allowedIPsBucket)
+		for _, key := range allowedIPKeys(r.AllowedIP) {
+			if err := ips.Delete(key); err != nil {
+				return err
+			}
+		}
+		users := tx.Bucket(usersBucket)
+		user := users.Bucket([]byte(id))
+		if err := user.Delete(seqKey(r.Seq)); err != nil {
+			return err
+		}
+		if k, _ := user.Cursor().First(); k == nil {
+			return users.DeleteBucket([]byte(id))
+		}
+		return nil
+	})
+}
+
+// Deactivate will mark all active entries of the user with the provided id as
+// deactivated. Similar to Add the changes have to be persisted using Save.
+func (s *boltStorage) Deactivate(id, reason string) error {
+	t := storage.Now()
+	return s.updateUser(id, func(st storage.State) {
+		st.Deactivate(id, reason, t)
+	})
+}
+
+// Reactivate will remove the deactivation of all entries of the user with the
+// provided id. Similar to Add the changes have to be persisted using Save.
+func (s *boltStorage) Reactivate(id string) error {
+	t := storage.Now()
+	return s.updateUser(id, func(st storage.State) {
+		st.Reactivate(id, t)
+	})
+}
+
+// List returns the entries of the user including pending changes using the
+// index of the user.
+func (s *boltStorage) List(id string) ([]storage.Entry, error) {
+	entries := []storage.Entry{}
+	err := s.view(func(tx *bbolt.Tx) error {
+		records, err := userRecords(tx, id)
+		for _, r := range records {
+			entries = append(entries, r.Entry)
+		}
+		return err
+	})
+	return entries, err
+}
+
+// ListAll returns the entries of all users including pending changes.
+func (s *boltStorage) ListAll() (storage.State, error) {
+	var st storage.State
+	err := s.view(func(tx *bbolt.Tx) error {
+		var err error
+		st, err = state(tx)
+		return err
+	})
+	return st, err
+}
+
+// Export writes the persisted state without pending changes to w using the
+// format of the file and git storage. It can be used while the database is
+// in use, e.g. to create backups.
+func (s *boltStorage) Export(w io.Writer) error {
+	var st storage.State
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		st, err = state(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	data, err := storage.Encode(st)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Save will commit all changes made since the last call in a single
+// transaction and export the state, if configured.
+func (s *boltStorage) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Commit()
+	s.tx = nil
+	s.pending = nil
+	if err != nil {
+		return err
+	}
+	return s.exportFile()
+}
+
+// Discard will roll back the pending transaction.
+func (s *boltStorage) Discard() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Rollback()
+	s.tx = nil
+	s.pending = nil
+	return err
+}
+
+// Transact will run fn and save or discard its changes, see
+// storage.Storage for details.
+func (s *boltStorage) Transact(fn func() error) error {
+	return s.transactions.Run(s, fn)
+}
+
+// Close will drop all pending changes and close the database.
+func (s *boltStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx != nil {
+		_ = s.tx.Rollback()
+		s.tx = nil
+		s.pending = nil
+	}
+	return s.db.Close()
+}
+
+// exportFile exports the state to the export path, if configured.
+func (s *boltStorage) exportFile() error {
+	if s.exportPath == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := s.Export(&buf); err != nil {
+		return fmt.Errorf("failed to export state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.exportPath), 0755); err != nil {
+		return fmt.Errorf("failed to export state: %w", err)
+	}
+	if err := util.WriteFileAtomic(s.exportPath, buf.Bytes(), exportFileMode); err != nil {
+		return fmt.Errorf("failed to export state: %w", err)
+	}
+	return nil
+}
+
+// update runs fn within the pending transaction, which is started if
+// necessary. As bolt does not support nested transactions, the transaction
+// is rolled back if fn fails and the operations applied before are replayed,
+// so a failed operation never leaves partial changes behind.
+func (s *boltStorage) update(fn func(tx *bbolt.Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx == nil {
+		tx, err := s.db.Begin(true)
+		if err != nil {
+			return err
+		}
+		s.tx = tx
+	}
+	if err := fn(s.tx); err != nil {
+		if rerr := s.replay(); rerr != nil {
+			return fmt.Errorf("failed to restore pending changes after error %q: %w", err, rerr)
+		}
+		return err
+	}
+	s.pending = append(s.pending, fn)
+	return nil
+}
+
+// replay rolls back the pending transaction and applies the pending
+// operations to a new one. If this fails, all pending changes are dropped.
+func (s *boltStorage) replay() error {
+	_ = s.tx.Rollback()
+	s.tx = nil
+	if len(s.pending) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		s.pending = nil
+		return err
+	}
+	for _, fn := range s.pending {
+		if err := fn(tx); err != nil {
+			_ = tx.Rollback()
+			s.pending = nil
+			return err
+		}
+	}
+	s.tx = tx
+	return nil
+}
+
+// updateUser applies fn to the entries of the user and writes back all
+// entries afterwards.
+func (s *boltStorage) updateUser(id string, fn func(st storage.State)) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		records, err := userRecords(tx, id)
+		if err != nil {
+			return err
+		}
+		st := storage.State{id: make([]storage.Entry, len(records))}
+		for i, r := range records {
+			st[id][i] = r.Entry
+		}
+		fn(st)
+		for i, r := range records {
+			r.Entry = st[id][i]
+			if err := putRecord(tx, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// view runs fn within the pending transaction, so pending changes are
+// visible, or a read-only transaction otherwise.
+func (s *boltStorage) view(fn func(tx *bbolt.Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return s.db.View(fn)
+}
+
+// getRecord returns the record of the public key, if it is owned by the user
+// with the provided id, or storage.ErrKeyNotFound otherwise.
+func getRecord(tx *bbolt.Tx, id, publicKey string) (*record, error) {
+	data := tx.Bucket(entriesBucket).Get([]byte(publicKey))
+	if data == nil {
+		return nil, storage.ErrKeyNotFound
+	}
+	r := &record{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to decode entry %s: %w", publicKey, err)
+	}
+	if r.ID != id {
+		return nil, storage.ErrKeyNotFound
+	}
+	return r, nil
+}
+
+func putRecord(tx *bbolt.Tx, r *record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(entriesBucket).Put([]byte(r.PublicKey), data)
+}
+
+// userRecords returns the records of the user in the order they were added.
+func userRecords(tx *bbolt.Tx, id string) ([]*record, error) {
+	user := tx.Bucket(usersBucket).Bucket([]byte(id))
+	if user == nil {
+		return nil, nil
+	}
+	records := []*record{}
+	err := user.ForEach(func(_, publicKey []byte) error {
+		r, err := getRecord(tx, id, string(publicKey))
+		if err != nil {
+			return fmt.Errorf("inconsistent index of %s: %w", id, err)
+		}
+		records = append(records, r)
+		return nil
+	})
+	return records, err
+}
+
+func state(tx *bbolt.Tx) (storage.State, error) {
+	st := storage.State{}
+	err := tx.Bucket(usersBucket).ForEach(func(id, _ []byte) error {
+		records, err := userRecords(tx, string(id))
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			st[r.ID] = append(st[r.ID], r.Entry)
+		}
+		return nil
+	})
+	return st, err
+}
+
+func allowedIPs(tx *bbolt.Tx) []string {
+	used := []string{}
+	_ = tx.Bucket(allowedIPsBucket).ForEach(func(k, _ []byte) error {
+		used = append(used, string(k))
+		return nil
+	})
+	return used
+}
+
+// allowedIPKeys returns the keys of the allowed IPs in allowedIPsBucket,
+// i.e. each canonical prefix. Invalid values, which might have been stored by
+// previous versions, are used as key as they are.
+func allowedIPKeys(allowedIP string) [][]byte {
+	if allowedIP == "" {
+		return nil
+	}
+	prefixes, err := storage.AllowedIPPrefixes(allowedIP)
+	if err != nil {
+		return [][]byte{[]byte(allowedIP)}
+	}
+	keys := make([][]byte, len(prefixes))
+	for i, prefix := range prefixes {
+		keys[i] = []byte(prefix)
+	}
+	return keys
+}
+
+// reindexAllowedIPs rebuilds allowedIPsBucket from the entries, as previous
+// versions used the allowed IPs of an entry as a single key.
+func reindexAllowedIPs(tx *bbolt.Tx) error {
+	if err := tx.DeleteBucket(allowedIPsBucket); err != nil {
+		return err
+	}
+	ips, err := tx.CreateBucket(allowedIPsBucket)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(entriesBucket).ForEach(func(publicKey, data []byte) error {
+		r := &record{}
+		if err := json.Unmarshal(data, r); err != nil {
+			return fmt.Errorf("failed to decode entry %s: %w", publicKey, err)
+		}
+		for _, key := range allowedIPKeys(r.AllowedIP) {
+			if err := ips.Put(key, publicKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
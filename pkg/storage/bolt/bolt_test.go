@@ -0,0 +1,256 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bolt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/ipam"
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/file"
+
+	bbolt "go.etcd.io/bbolt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// staticAllocator always returns the same allowed IP.
+type staticAllocator string
+
+func (a staticAllocator) Allocate(used []string) (string, error) {
+	return string(a), nil
+}
+
+var _ = Describe("Storage", func() {
+	var (
+		dir  string
+		path string
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "smorgasbord.db")
+	})
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+	It("persists entries in the order they were added", func() {
+		allocator, err := ipam.New([]string{"10.0.0.0/24"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		s, err := NewStorage(&Options{Path: path, Allocator: allocator})
+		Expect(err).ToNot(HaveOccurred())
+		for _, key := range []string{"c", "a", "b"} {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: key})).To(Succeed())
+		}
+		Expect(s.Add("b@test.com", storage.Entry{PublicKey: "a"})).To(Equal(storage.ErrKeyExists))
+		Expect(s.Add("b@test.com", storage.Entry{PublicKey: "d", Name: "laptop"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+		s, err = NewStorage(&Options{Path: path, Allocator: allocator})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		entries, err := s.List("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(3))
+		for i, key := range []string{"c", "a", "b"} {
+			Expect(entries[i].PublicKey).To(Equal(key))
+			Expect(entries[i].CreatedBy).To(Equal("a@test.com"))
+			Expect(entries[i].CreatedAt).ToNot(BeNil())
+		}
+		st, err := s.ListAll()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).To(HaveLen(2))
+		Expect(st["b@test.com"][0].Name).To(Equal("laptop"))
+		Expect(st.AllowedIPs()).To(ConsistOf("10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32", "10.0.0.4/32"))
+		Expect(s.List("unknown@test.com")).To(BeEmpty())
+	})
+	It("updates, deactivates and deletes entries", func() {
+		s, err := NewStorage(&Options{Path: path})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(s.Update("a@test.com", storage.Entry{PublicKey: "a", Name: "laptop", Disabled: true})).To(Succeed())
+		Expect(s.Update("b@test.com", storage.Entry{PublicKey: "a"})).To(Equal(storage.ErrKeyNotFound))
+		Expect(s.Deactivate("a@test.com", "test")).To(Succeed())
+		entries, err := s.List("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[0].Name).To(Equal("laptop"))
+		Expect(entries[0].Disabled).To(BeTrue())
+		Expect(entries[0].Deactivation.Reason).To(Equal("test"))
+		Expect(entries[1].Deactivation.Reason).To(Equal("test"))
+		Expect(s.Reactivate("a@test.com")).To(Succeed())
+		Expect(s.List("a@test.com")).To(ConsistOf(
+			WithTransform(func(e storage.Entry) bool { return e.Deactivation == nil }, BeTrue()),
+			WithTransform(func(e storage.Entry) bool { return e.Deactivation == nil }, BeTrue()),
+		))
+		Expect(s.Delete("b@test.com", "a")).To(Equal(storage.ErrKeyNotFound))
+		Expect(s.Delete("a@test.com", "a")).To(Succeed())
+		Expect(s.Delete("a@test.com", "b")).To(Succeed())
+		Expect(s.Delete("a@test.com", "b")).To(Equal(storage.ErrKeyNotFound))
+		Expect(s.Save()).To(Succeed())
+		Expect(s.ListAll()).To(BeEmpty())
+	})
+	It("commits all pending changes in a single transaction", func() {
+		s, err := NewStorage(&Options{Path: path})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		// Pending changes are visible, but not exported
+		Expect(s.ListAll()).To(HaveLen(2))
+		var buf bytes.Buffer
+		Expect(s.(storage.Exporter).Export(&buf)).To(Succeed())
+		st, _, err := storage.Decode(buf.Bytes())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).To(BeEmpty())
+		// Closing drops the pending changes
+		Expect(s.Close()).To(Succeed())
+		s, err = NewStorage(&Options{Path: path})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.ListAll()).To(BeEmpty())
+	})
+	It("enforces unique allowed IPs", func() {
+		s, err := NewStorage(&Options{Path: path, Allocator: staticAllocator("10.0.0.1/32")})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(MatchError(storage.ErrAllowedIPExists))
+		// The failed addition did not modify the transaction
+		Expect(s.List("a@test.com")).To(HaveLen(1))
+		Expect(s.Delete("a@test.com", "a")).To(Succeed())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		Expect(s.ListAll()).To(Equal(storage.State{"a@test.com": mustList(s, "a@test.com")}))
+		Expect(mustList(s, "a@test.com")[0].AllowedIP).To(Equal("10.0.0.1/32"))
+	})
+	It("canonicalizes allowed IPs", func() {
+		allowedIP := "10.0.0.1/32"
+		s, err := NewStorage(&Options{Path: path, Allocator: storage.AllocatorFunc(func([]string) (string, error) {
+			return allowedIP, nil
+		})})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		for _, allowedIP = range []string{" 10.0.0.1/32 ", "10.0.0.1"} {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(MatchError(storage.ErrAllowedIPExists))
+		}
+		allowedIP = "10.0.0.2"
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(mustList(s, "a@test.com")[1].AllowedIP).To(Equal("10.0.0.2/32"))
+	})
+	It("enforces unique prefixes of dual-stack allowed IPs", func() {
+		allowedIP := "10.0.0.1/32, fd00::1/128"
+		s, err := NewStorage(&Options{Path: path, Allocator: storage.AllocatorFunc(func([]string) (string, error) {
+			return allowedIP, nil
+		})})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		// Failed operations replay pending ones, which would allocate again
+		Expect(s.Save()).To(Succeed())
+		for _, allowedIP = range []string{"10.0.0.2/32, FD00:0::1", "10.0.0.1, fd00::2/128"} {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(MatchError(storage.ErrAllowedIPExists))
+		}
+		allowedIP = "10.0.0.2, fd00::2"
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(mustList(s, "a@test.com")[1].AllowedIP).To(Equal("10.0.0.2/32, fd00::2/128"))
+		Expect(s.Delete("a@test.com", "a")).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+		// Allowed IPs indexed as a single key by previous versions are
+		// reindexed when opened
+		db, err := bbolt.Open(path, fileMode, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(db.Update(func(tx *bbolt.Tx) error {
+			ips := tx.Bucket(allowedIPsBucket)
+			if err := ips.Delete([]byte("10.0.0.2/32")); err != nil {
+				return err
+			}
+			if err := ips.Delete([]byte("fd00::2/128")); err != nil {
+				return err
+			}
+			return ips.Put([]byte("10.0.0.2/32, fd00::2/128"), []byte("b"))
+		})).To(Succeed())
+		Expect(db.Close()).To(Succeed())
+		s, err = NewStorage(&Options{Path: path, Allocator: storage.AllocatorFunc(func([]string) (string, error) {
+			return allowedIP, nil
+		})})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		allowedIP = "10.0.0.1, fd00::2"
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "c"})).To(MatchError(storage.ErrAllowedIPExists))
+		allowedIP = "10.0.0.1, fd00::1"
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "c"})).To(Succeed())
+	})
+	It("drops partial changes of failed operations", func() {
+		s, err := NewStorage(&Options{Path: path})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		// Operations failing after writing are rolled back, while previous
+		// operations are kept
+		err = s.(*boltStorage).update(func(tx *bbolt.Tx) error {
+			if err := putRecord(tx, &record{ID: "b@test.com", Entry: storage.Entry{PublicKey: "b"}}); err != nil {
+				return err
+			}
+			return fmt.Errorf("failed")
+		})
+		Expect(err).To(MatchError("failed"))
+		Expect(s.Save()).To(Succeed())
+		Expect(s.ListAll()).To(Equal(storage.State{"a@test.com": mustList(s, "a@test.com")}))
+		Expect(s.(*boltStorage).view(func(tx *bbolt.Tx) error {
+			Expect(tx.Bucket(entriesBucket).Get([]byte("b"))).To(BeNil())
+			return nil
+		})).To(Succeed())
+		Expect(s.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+	})
+	It("exports the state after saving", func() {
+		exportPath := filepath.Join(dir, "export", "smorgasbord.json")
+		s, err := NewStorage(&Options{Path: path, ExportPath: exportPath})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a", Labels: map[string]string{"os": "linux"}})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		// The export can be read using the file storage, e.g. by the agent
+		f, err := file.NewStorage(exportPath, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(f.ListAll()).To(Equal(storage.State{"a@test.com": mustList(s, "a@test.com")}))
+	})
+	It("is locked by a single process", func() {
+		s, err := NewStorage(&Options{Path: path})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		_, err = NewStorage(&Options{Path: path, Timeout: 100 * time.Millisecond})
+		Expect(err).To(MatchError(ContainSubstring("timeout")))
+		_, err = NewStorage(&Options{})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func mustList(s storage.Storage, id string) []storage.Entry {
+	entries, err := s.List(id)
+	Expect(err).ToNot(HaveOccurred())
+	return entries
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/util"
+)
+
+const (
+	// lockSuffix is appended to the path of the state to derive the path of
+	// the lock file. The state itself can not be locked, as it is replaced
+	// on every write.
+	lockSuffix = ".lock"
+	fileMode   = 0644
+)
+
+// operation is a single modification of the state, which is kept until it
+// was successfully saved, so it can be applied to the latest state, which
+// might have been modified by another process in the meantime.
+type operation struct {
+	description string
+	apply       func(st storage.State) error
+}
+
+type fileStorage struct {
+	mutex        sync.Mutex
+	transactions storage.Transactions
+	path         string
+	allocator    storage.Allocator
+	// pending contains all operations, which were not saved yet
+	pending []operation
+	// version is the schema version of the state read last
+	version int
+}
+
+// NewStorage returns a storage.Storage persisting the state in a local JSON
+// file using the same format as the git storage. Writes are atomic and
+// synced to disk. Multiple processes, e.g. the server and the agent, can use
+// the same file concurrently, as all access is synchronized using a lock
+// file next to it. If an allocator is provided, new entries will be assigned
+// an allowed IP.
+func NewStorage(path string, allocator storage.Allocator) (storage.Storage, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	s := &fileStorage{path: path, allocator: allocator}
+	// Make sure the state can be read
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add will add the entry to the user with the provided id. The changes are
+// only persisted once Save is called.
+func (s *fileStorage) Add(id string, entry storage.Entry) error {
+	t := storage.Now()
+	return s.do(operation{
+		description: fmt.Sprintf("Add public key %s of %s", entry.PublicKey, id),
+		apply: func(st storage.State) error {
+			return st.Add(id, entry, s.allocator, t)
+		},
+	})
+}
+
+// Update will replace the metadata of the entry with the same public key of
+// the user with the provided id. Similar to Add the changes have to be
+// persisted using Save.
+func (s *fileStorage) Update(id string, entry storage.Entry) error {
+	t := storage.Now()
+	return s.do(operation{
+		description: fmt.Sprintf("Update public key %s of %s", entry.PublicKey, id),
+		apply: func(st storage.State) error {
+			return st.Update(id, entry, t)
+		},
+	})
+}
+
+// Delete will remove the entry with the public key from the user with the
+// provided id. Similar to Add the changes have to be persisted using Save.
+func (s *fileStorage) Delete(id, publicKey string) error {
+	return s.do(operation{
+		description: fmt.Sprintf("Delete public key %s of %s", publicKey, id),
+		apply: func(st storage.State) error {
+			return st.Delete(id, publicKey)
+		},
+	})
+}
+
+// Deactivate will mark all active entries of the user with the provided id as
+// deactivated. Similar to Add the changes have to be persisted using Save.
+func (s *fileStorage) Deactivate(id, reason string) error {
+	t := storage.Now()
+	return s.do(operation{
+		description: fmt.Sprintf("Deactivate entries of %s: %s", id, reason),
+		apply: func(st storage.State) error {
+			st.Deactivate(id, reason, t)
+			return nil
+		},
+	})
+}
+
+// Reactivate will remove the deactivation of all entries of the user with the
+// provided id. Similar to Add the changes have to be persisted using Save.
+func (s *fileStorage) Reactivate(id string) error {
+	t := storage.Now()
+	return s.do(operation{
+		description: fmt.Sprintf("Reactivate entries of %s", id),
+		apply: func(st storage.State) error {
+			st.Reactivate(id, t)
+			return nil
+		},
+	})
+}
+
+// Migrate will rewrite the state using the current schema version, if it was
+// written by a previous version. Similar to Add the changes have to be
+// persisted using Save.
+func (s *fileStorage) Migrate() (int, bool, error) {
+	if _, err := s.ListAll(); err != nil {
+		return 0, false, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	version := s.version
+	if version == storage.CurrentVersion {
+		return version, false, nil
+	}
+	// The state is migrated while reading, it only has to be written again
+	s.pending = append(s.pending, operation{
+		description: fmt.Sprintf("Migrate schema to version %d", storage.CurrentVersion),
+		apply:       func(st storage.State) error { return nil },
+	})
+	return version, true, nil
+}
+
+func (s *fileStorage) List(id string) ([]storage.Entry, error) {
+	st, err := s.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	return st.List(id), nil
+}
+
+// ListAll returns the persisted state including all pending changes.
+func (s *fileStorage) ListAll() (storage.State, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.load()
+}
+
+// Save will apply all pending changes to the latest state and persist it.
+// Changes, which can no longer be applied, because the same public key was
+// modified concurrently by another process, are dropped and returned as
+// *storage.ConflictError.
+func (s *fileStorage) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	unlock, err := lock(s.path+lockSuffix, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = unlock()
+	}()
+	st, version, err := s.read()
+	if err != nil {
+		return err
+	}
+	s.version = version
+	var conflicts []string
+	for _, o := range s.pending {
+		if err := o.apply(st); err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s: %v", o.description, err))
+		}
+	}
+	data, err := storage.Encode(st)
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(s.path, data, fileMode); err != nil {
+		return err
+	}
+	s.pending = nil
+	s.version = storage.CurrentVersion
+	if len(conflicts) > 0 {
+		return &storage.ConflictError{Changes: conflicts}
+	}
+	return nil
+}
+
+// Discard will drop all pending changes.
+func (s *fileStorage) Discard() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending = nil
+	return nil
+}
+
+// Transact will run fn and save or discard its changes, see
+// storage.Storage for details.
+func (s *fileStorage) Transact(fn func() error) error {
+	return s.transactions.Run(s, fn)
+}
+
+// Close will drop all pending changes.
+func (s *fileStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending = nil
+	return nil
+}
+
+// do will apply the operation to the current state including all pending
+// changes and keep it, if it succeeded.
+func (s *fileStorage) do(o operation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	st, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := o.apply(st); err != nil {
+		return err
+	}
+	s.pending = append(s.pending, o)
+	return nil
+}
+
+// load returns the persisted state with all pending changes applied.
+// Pending changes, which can no longer be applied, are skipped, as they will
+// be reported by Save.
+func (s *fileStorage) load() (storage.State, error) {
+	unlock, err := lock(s.path+lockSuffix, false)
+	if err != nil {
+		return nil, err
+	}
+	st, version, err := s.read()
+	_ = unlock()
+	if err != nil {
+		return nil, err
+	}
+	s.version = version
+	for _, o := range s.pending {
+		_ = o.apply(st)
+	}
+	return st, nil
+}
+
+// read decodes the persisted state. If the file does not exist yet, an empty
+// state is returned. The caller is expected to hold the lock.
+func (s *fileStorage) read() (storage.State, int, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return storage.State{}, storage.CurrentVersion, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	st, version, err := storage.Decode(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to decode %s: %w", s.path, err)
+	}
+	return st, version, nil
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/kubism/smorgasbord/pkg/ipam"
+	"github.com/kubism/smorgasbord/pkg/storage"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Storage", func() {
+	var (
+		dir  string
+		path string
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "state", "smorgasbord.json")
+	})
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+	It("persists entries", func() {
+		s, err := NewStorage(path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a", Name: "laptop"})).To(Succeed())
+		Expect(s.Add("b@test.com", storage.Entry{PublicKey: "a"})).To(Equal(storage.ErrKeyExists))
+		Expect(s.List("a@test.com")).To(HaveLen(1))
+		// Pending changes are not visible to other instances
+		other, err := NewStorage(path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		Expect(other.List("a@test.com")).To(BeEmpty())
+		Expect(s.Save()).To(Succeed())
+		entries, err := other.List("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Name).To(Equal("laptop"))
+		Expect(entries[0].CreatedBy).To(Equal("a@test.com"))
+		Expect(other.Add("b@test.com", storage.Entry{PublicKey: "a"})).To(Equal(storage.ErrKeyExists))
+		Expect(other.Update("a@test.com", storage.Entry{PublicKey: "a", Disabled: true})).To(Succeed())
+		Expect(other.Deactivate("a@test.com", "test")).To(Succeed())
+		Expect(other.Save()).To(Succeed())
+		entries, err = s.List("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[0].Disabled).To(BeTrue())
+		Expect(entries[0].Deactivation.Reason).To(Equal("test"))
+		Expect(s.Delete("a@test.com", "a")).To(Succeed())
+		Expect(s.Delete("a@test.com", "a")).To(Equal(storage.ErrKeyNotFound))
+		Expect(s.Save()).To(Succeed())
+		Expect(other.ListAll()).To(BeEmpty())
+		// Only the state and lock file are left
+		files, err := ioutil.ReadDir(filepath.Dir(path))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(HaveLen(2))
+	})
+	It("drops pending changes on close", func() {
+		s, err := NewStorage(path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		Expect(path).ToNot(BeAnExistingFile())
+	})
+	It("returns conflicting changes", func() {
+		s, err := NewStorage(path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		other, err := NewStorage(path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		Expect(s.Delete("a@test.com", "a")).To(Succeed())
+		Expect(other.Delete("a@test.com", "a")).To(Succeed())
+		Expect(other.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		err = other.Save()
+		var conflictErr *storage.ConflictError
+		Expect(err).To(BeAssignableToTypeOf(conflictErr))
+		Expect(err.Error()).To(ContainSubstring("Delete public key a of a@test.com"))
+		// All other changes are persisted
+		Expect(s.ListAll()).To(Equal(storage.State{"b@test.com": mustList(other, "b@test.com")}))
+	})
+	It("synchronizes concurrent instances", func() {
+		allocator, err := ipam.New([]string{"10.0.0.0/24"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				s, err := NewStorage(path, allocator)
+				Expect(err).ToNot(HaveOccurred())
+				defer s.Close()
+				Expect(s.Add(fmt.Sprintf("%d@test.com", i), storage.Entry{PublicKey: fmt.Sprintf("key%d", i)})).To(Succeed())
+				Expect(s.Save()).To(Succeed())
+			}(i)
+		}
+		wg.Wait()
+		s, err := NewStorage(path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		st, err := s.ListAll()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).To(HaveLen(10))
+		// Allowed IPs are allocated based on the latest state, so they are
+		// unique even if allocated concurrently
+		allowedIPs := map[string]bool{}
+		for _, ip := range st.AllowedIPs() {
+			allowedIPs[ip] = true
+		}
+		Expect(allowedIPs).To(HaveLen(10))
+	})
+	It("migrates legacy state", func() {
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte(`{ "legacy@test.com": [{ "publicKey": "legacy", "allowedIP": "10.0.0.1/32" }] }`), 0644)).To(Succeed())
+		s, err := NewStorage(path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.List("legacy@test.com")).To(HaveLen(1))
+		migrator, ok := s.(storage.Migrator)
+		Expect(ok).To(BeTrue())
+		version, changed, err := migrator.Migrate()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version).To(Equal(storage.LegacyVersion))
+		Expect(changed).To(BeTrue())
+		Expect(s.Save()).To(Succeed())
+		data, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(storage.Version(data)).To(Equal(storage.CurrentVersion))
+		_, changed, err = migrator.Migrate()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeFalse())
+	})
+	It("fails to read invalid state", func() {
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte(`{]`), 0644)).To(Succeed())
+		_, err := NewStorage(path, nil)
+		Expect(err).To(HaveOccurred())
+		_, err = NewStorage("", nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func mustList(s storage.Storage, id string) []storage.Entry {
+	entries, err := s.List(id)
+	Expect(err).ToNot(HaveOccurred())
+	return entries
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"fmt"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/storagetest"
+	"github.com/kubism/smorgasbord/pkg/testutil"
+
+	. "github.com/onsi/gomega"
+)
+
+var conformanceRepos int
+
+var _ = storagetest.DescribeBackend("git", storagetest.Backend{
+	Setup: func() (storagetest.Opener, func()) {
+		// Use a new repository for each test
+		conformanceRepos++
+		url := fmt.Sprintf("http://%s/conformance%d.git", gitServer.GetAddr(), conformanceRepos)
+		Expect(testutil.InitRepository(url, map[string]string{
+			"README.md": "# Test",
+		})).To(Succeed())
+		open := func(allocator storage.Allocator) (storage.Storage, error) {
+			return NewStorage(&Options{RepositoryURL: url, Allocator: allocator})
+		}
+		return open, func() {}
+	},
+	ConcurrentChanges: true,
+})
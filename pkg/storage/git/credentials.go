@@ -0,0 +1,137 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// defaultUsername is used for basic auth and ssh, if neither the
+	// credentials nor the repository URL contain a username
+	defaultUsername = "git"
+)
+
+// Credentials are used to authenticate against the remote. Which fields are
+// applicable depends on the protocol of the repository URL:
+//
+// HTTP(S) uses basic auth if a username or password is provided. Access
+// tokens are passed as password, most providers accept any username in
+// this case.
+//
+// SSH uses the private key, the password or the SSH agent in this order.
+// The SSH agent is used by default. Host keys are verified using the known
+// hosts file, which defaults to the SSH_KNOWN_HOSTS environment variable
+// or ~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts.
+type Credentials struct {
+	Username              string
+	Password              string
+	SSHKeyFile            string
+	SSHKeyPassphrase      string
+	SSHAgent              bool
+	KnownHostsFile        string
+	InsecureIgnoreHostKey bool
+}
+
+// AuthMethod validates the credentials and returns the method used to
+// authenticate against the repository at url. If no credentials are
+// required, nil is returned.
+func (c *Credentials) AuthMethod(url string) (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository url: %w", err)
+	}
+	usesSSH := c.SSHKeyFile != "" || c.SSHKeyPassphrase != "" || c.SSHAgent ||
+		c.KnownHostsFile != "" || c.InsecureIgnoreHostKey
+	switch ep.Protocol {
+	case "http", "https":
+		if usesSSH {
+			return nil, fmt.Errorf("ssh credentials require an ssh repository url")
+		}
+		if c.Username == "" && c.Password == "" {
+			return nil, nil
+		}
+		return &githttp.BasicAuth{Username: c.username(ep), Password: c.Password}, nil
+	case "ssh":
+		return c.sshAuthMethod(ep)
+	}
+	if usesSSH || c.Username != "" || c.Password != "" {
+		return nil, fmt.Errorf("credentials are not supported for protocol %s", ep.Protocol)
+	}
+	return nil, nil
+}
+
+func (c *Credentials) sshAuthMethod(ep *transport.Endpoint) (transport.AuthMethod, error) {
+	switch {
+	case c.SSHKeyPassphrase != "" && c.SSHKeyFile == "":
+		return nil, fmt.Errorf("ssh key passphrase requires an ssh key")
+	case c.SSHAgent && (c.SSHKeyFile != "" || c.Password != ""):
+		return nil, fmt.Errorf("ssh agent can not be combined with an ssh key or password")
+	case c.SSHKeyFile != "" && c.Password != "":
+		return nil, fmt.Errorf("ssh key can not be combined with a password")
+	case c.KnownHostsFile != "" && c.InsecureIgnoreHostKey:
+		return nil, fmt.Errorf("known hosts file can not be combined with ignoring host keys")
+	}
+	var hostKeyCallback ssh.HostKeyCallback
+	var err error
+	if c.InsecureIgnoreHostKey {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else if c.KnownHostsFile != "" {
+		hostKeyCallback, err = gitssh.NewKnownHostsCallback(c.KnownHostsFile)
+	} else {
+		hostKeyCallback, err = gitssh.NewKnownHostsCallback()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %w", err)
+	}
+	helper := gitssh.HostKeyCallbackHelper{HostKeyCallback: hostKeyCallback}
+	user := c.username(ep)
+	switch {
+	case c.SSHKeyFile != "":
+		auth, err := gitssh.NewPublicKeysFromFile(user, c.SSHKeyFile, c.SSHKeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ssh key: %w", err)
+		}
+		auth.HostKeyCallbackHelper = helper
+		return auth, nil
+	case c.Password != "":
+		return &gitssh.Password{User: user, Password: c.Password, HostKeyCallbackHelper: helper}, nil
+	}
+	auth, err := gitssh.NewSSHAgentAuth(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh agent: %w", err)
+	}
+	auth.HostKeyCallbackHelper = helper
+	return auth, nil
+}
+
+// username returns the configured username, the username of the endpoint or
+// the default username.
+func (c *Credentials) username(ep *transport.Endpoint) string {
+	if c.Username != "" {
+		return c.Username
+	}
+	if ep.User != "" {
+		return ep.User
+	}
+	return defaultUsername
+}
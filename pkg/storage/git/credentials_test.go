@@ -0,0 +1,163 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/testutil"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Credentials", func() {
+	var (
+		sshServer  *testutil.SSHGitServer
+		dir        string
+		keyFile    string
+		knownHosts string
+		sshURL     string
+		httpURL    string
+		repos      int
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+		// Serve the same repositories as the http server
+		sshServer, err = testutil.NewSSHGitServer(tmpDir)
+		Expect(err).ToNot(HaveOccurred())
+		keyFile = filepath.Join(dir, "id_ecdsa")
+		publicKey, err := testutil.GenerateSSHKey(keyFile, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		sshServer.AuthorizeKey(publicKey)
+		knownHosts = filepath.Join(dir, "known_hosts")
+		Expect(ioutil.WriteFile(knownHosts, []byte(sshServer.KnownHosts()+"\n"), 0600)).To(Succeed())
+		// Use a new repository for each test
+		repos++
+		sshURL = fmt.Sprintf("ssh://git@%s/credentials%d.git", sshServer.GetAddr(), repos)
+		httpURL = fmt.Sprintf("http://%s/credentials%d.git", gitServer.GetAddr(), repos)
+		Expect(testutil.InitRepository(httpURL, map[string]string{
+			"README.md": "# Test",
+		})).To(Succeed())
+	})
+	AfterEach(func() {
+		Expect(sshServer.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+	// roundtrip adds an entry using the credentials and reads it using
+	// another instance.
+	roundtrip := func(url string, c *Credentials) {
+		auth, err := c.AuthMethod(url)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(auth).ToNot(BeNil())
+		s, err := NewStorage(&Options{RepositoryURL: url, Auth: auth})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		publicKey := fmt.Sprintf("key%d", GinkgoRandomSeed())
+		Expect(s.Add(testID, storage.Entry{PublicKey: publicKey})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		other, err := NewStorage(&Options{RepositoryURL: url, Auth: auth})
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		entries, err := other.List(testID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).ToNot(BeEmpty())
+		Expect(other.Delete(testID, publicKey)).To(Succeed())
+		Expect(other.Save()).To(Succeed())
+	}
+	It("validates credentials", func() {
+		invalid := []struct {
+			url string
+			c   Credentials
+		}{
+			{"http://%zz", Credentials{}},
+			{httpURL, Credentials{SSHKeyFile: keyFile}},
+			{httpURL, Credentials{SSHAgent: true}},
+			{httpURL, Credentials{KnownHostsFile: knownHosts}},
+			{"/tmp/repository.git", Credentials{Password: "password"}},
+			{sshURL, Credentials{SSHKeyPassphrase: "secret"}},
+			{sshURL, Credentials{SSHKeyFile: keyFile, SSHAgent: true}},
+			{sshURL, Credentials{SSHKeyFile: keyFile, Password: "password"}},
+			{sshURL, Credentials{Password: "password", KnownHostsFile: knownHosts, InsecureIgnoreHostKey: true}},
+			{sshURL, Credentials{Password: "password", KnownHostsFile: filepath.Join(dir, "unknown")}},
+			{sshURL, Credentials{SSHKeyFile: keyFile, SSHKeyPassphrase: "wrong", KnownHostsFile: knownHosts}},
+			{sshURL, Credentials{SSHKeyFile: filepath.Join(dir, "unknown"), KnownHostsFile: knownHosts}},
+		}
+		for _, test := range invalid {
+			_, err := test.c.AuthMethod(test.url)
+			Expect(err).To(HaveOccurred(), fmt.Sprintf("%s: %+v", test.url, test.c))
+		}
+		auth, err := (&Credentials{}).AuthMethod(httpURL)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(auth).To(BeNil())
+		auth, err = (&Credentials{Password: "token"}).AuthMethod(httpURL)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(auth.String()).To(ContainSubstring(defaultUsername))
+	})
+	It("authenticates using basic auth", func() {
+		gitServer.SetBasicAuth("jane", "token")
+		defer gitServer.SetBasicAuth("", "")
+		_, err := NewStorage(&Options{RepositoryURL: httpURL})
+		Expect(err).To(HaveOccurred())
+		roundtrip(httpURL, &Credentials{Username: "jane", Password: "token"})
+	})
+	It("authenticates using an encrypted ssh key", func() {
+		roundtrip(sshURL, &Credentials{SSHKeyFile: keyFile, SSHKeyPassphrase: "secret", KnownHostsFile: knownHosts})
+	})
+	It("authenticates using a password via ssh", func() {
+		sshServer.SetPassword("password")
+		roundtrip(sshURL, &Credentials{Password: "password", KnownHostsFile: knownHosts})
+	})
+	It("authenticates using an ssh agent", func() {
+		agentKeyFile := filepath.Join(dir, "id_agent")
+		publicKey, err := testutil.GenerateSSHKey(agentKeyFile, "")
+		Expect(err).ToNot(HaveOccurred())
+		sshServer.AuthorizeKey(publicKey)
+		data, err := ioutil.ReadFile(agentKeyFile)
+		Expect(err).ToNot(HaveOccurred())
+		privateKey, err := ssh.ParseRawPrivateKey(data)
+		Expect(err).ToNot(HaveOccurred())
+		socket := filepath.Join(dir, "agent.sock")
+		lis, err := testutil.ServeSSHAgent(socket, privateKey)
+		Expect(err).ToNot(HaveOccurred())
+		defer lis.Close()
+		defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+		Expect(os.Setenv("SSH_AUTH_SOCK", socket)).To(Succeed())
+		roundtrip(sshURL, &Credentials{SSHAgent: true, KnownHostsFile: knownHosts})
+	})
+	It("verifies host keys", func() {
+		// The known hosts file contains a different key for the address
+		otherKey, err := testutil.GenerateSSHKey(filepath.Join(dir, "id_other"), "")
+		Expect(err).ToNot(HaveOccurred())
+		line := knownhosts.Line([]string{knownhosts.Normalize(sshServer.GetAddr())}, otherKey)
+		Expect(ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600)).To(Succeed())
+		auth, err := (&Credentials{SSHKeyFile: keyFile, SSHKeyPassphrase: "secret", KnownHostsFile: knownHosts}).AuthMethod(sshURL)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = NewStorage(&Options{RepositoryURL: sshURL, Auth: auth})
+		Expect(err).To(MatchError(ContainSubstring("key mismatch")))
+		roundtrip(sshURL, &Credentials{SSHKeyFile: keyFile, SSHKeyPassphrase: "secret", InsecureIgnoreHostKey: true})
+	})
+})
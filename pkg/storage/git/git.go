@@ -17,101 +17,449 @@ limitations under the License.
 package git
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"os"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kubism/smorgasbord/pkg/storage"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	gitstorage "github.com/go-git/go-git/v5/storage"
 	"github.com/go-git/go-git/v5/storage/memory"
 )
 
-const stateName = "smorgasbord.json"
+const (
+	authorName  = "smorgasbord"
+	authorEmail = "smorgasbord@localhost"
+	remoteName  = "origin"
+	// Rejected pushes are retried with exponential backoff starting with
+	// initialBackoff until maxAttempts is reached
+	maxAttempts    = 5
+	initialBackoff = 100 * time.Millisecond
+)
+
+type operationKind int
+
+const (
+	opAdd operationKind = iota
+	opUpdate
+	opDelete
+	opDeactivate
+	opReactivate
+	opMigrate
+)
+
+// errNoChange is returned by operation.apply if the state already is as
+// desired, e.g. if a user is deactivated twice.
+var errNoChange = errors.New("no change")
+
+// operation is a single modification of the state, which is kept until it
+// was successfully pushed, so it can be re-applied if the remote changed
+// concurrently.
+type operation struct {
+	kind operationKind
+	id   string
+	// entry contains the public key and for additions and updates the
+	// desired metadata of the entry
+	entry  storage.Entry
+	reason string
+	time   time.Time
+}
 
-type state = map[string][]storage.Entry
+func (o operation) apply(st storage.State, allocator storage.Allocator) error {
+	switch o.kind {
+	case opAdd:
+		return st.Add(o.id, o.entry, allocator, o.time)
+	case opUpdate:
+		return st.Update(o.id, o.entry, o.time)
+	case opDelete:
+		return st.Delete(o.id, o.entry.PublicKey)
+	case opDeactivate:
+		if !st.Deactivate(o.id, o.reason, o.time) {
+			return errNoChange
+		}
+		return nil
+	case opReactivate:
+		if !st.Reactivate(o.id, o.time) {
+			return errNoChange
+		}
+		return nil
+	}
+	// The state was already migrated while reading, it only has to be written
+	// again
+	return nil
+}
+
+func (o operation) String() string {
+	switch o.kind {
+	case opAdd:
+		return fmt.Sprintf("Add public key %s of %s", o.entry.PublicKey, o.id)
+	case opUpdate:
+		return fmt.Sprintf("Update public key %s of %s", o.entry.PublicKey, o.id)
+	case opDelete:
+		return fmt.Sprintf("Delete public key %s of %s", o.entry.PublicKey, o.id)
+	case opDeactivate:
+		return fmt.Sprintf("Deactivate entries of %s: %s", o.id, o.reason)
+	case opMigrate:
+		return fmt.Sprintf("Migrate schema to version %d", storage.CurrentVersion)
+	default:
+		return fmt.Sprintf("Reactivate entries of %s", o.id)
+	}
+}
 
 type gitStorage struct {
-	auth   transport.AuthMethod
-	fs     billy.Filesystem
-	storer gitstorage.Storer
-	repo   *git.Repository
+	mutex        sync.Mutex
+	transactions storage.Transactions
+	auth         transport.AuthMethod
+	allocator    storage.Allocator
+	fs           billy.Filesystem
+	storer       gitstorage.Storer
+	repo         *git.Repository
+	// base is the commit of the remote branch the pending operations are
+	// based on
+	base plumbing.Hash
+	// pending contains all operations, which were not pushed yet
+	pending []operation
+	// committed is the number of pending operations already committed locally
+	committed int
+	// layout is the configured layout, see Layout for details
+	layout Layout
+	// readLayout is the layout of the state read last
+	readLayout Layout
+	// version is the (lowest) schema version of the state read last
+	version int
+	// branch is the configured branch, empty if the default branch is used
+	branch string
+	// subdirectory contains the state, empty if the root is used
+	subdirectory string
+	// author and committer are used for all commits, the time is set when
+	// committing
+	author    object.Signature
+	committer object.Signature
 }
 
-func NewStorage(repositoryURL string, auth transport.AuthMethod) (storage.Storage, error) {
+// NewStorage validates the options, clones the repository and returns a
+// storage.Storage operating on it. See Options for details.
+func NewStorage(opts *Options) (storage.Storage, error) {
+	o := *opts
+	o.complete()
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
 	s := &gitStorage{
-		auth:   auth,
-		fs:     memfs.New(),
-		storer: memory.NewStorage(),
+		auth:         o.Auth,
+		allocator:    o.Allocator,
+		fs:           memfs.New(),
+		storer:       memory.NewStorage(),
+		layout:       o.Layout,
+		branch:       o.Branch,
+		subdirectory: o.Subdirectory,
+		author:       object.Signature{Name: o.AuthorName, Email: o.AuthorEmail},
+		committer:    object.Signature{Name: o.CommitterName, Email: o.CommitterEmail},
 	}
-	return s, s.clone(repositoryURL)
+	return s, s.clone(o.RepositoryURL)
 }
 
-func (s *gitStorage) Add(id, publicKey string) error {
-	return nil
+// Add will add the entry to the user with the provided id. The changes are
+// only written to the worktree, so make sure to call Save to commit and push
+// them.
+func (s *gitStorage) Add(id string, entry storage.Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.do(operation{kind: opAdd, id: id, entry: entry, time: storage.Now()})
 }
 
+// Update will replace the metadata of the entry with the same public key of
+// the user with the provided id. Similar to Add the changes have to be
+// persisted using Save.
+func (s *gitStorage) Update(id string, entry storage.Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.do(operation{kind: opUpdate, id: id, entry: entry, time: storage.Now()})
+}
+
+// Delete will remove the entry with the public key from the user with the
+// provided id. Similar to Add the changes have to be persisted using Save.
 func (s *gitStorage) Delete(id, publicKey string) error {
-	return nil
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.do(operation{kind: opDelete, id: id, entry: storage.Entry{PublicKey: publicKey}})
+}
+
+// Deactivate will mark all active entries of the user with the provided id as
+// deactivated. Similar to Add the changes have to be persisted using Save.
+func (s *gitStorage) Deactivate(id, reason string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.do(operation{kind: opDeactivate, id: id, reason: reason, time: storage.Now()})
+}
+
+// Reactivate will remove the deactivation of all entries of the user with the
+// provided id. Similar to Add the changes have to be persisted using Save.
+func (s *gitStorage) Reactivate(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.do(operation{kind: opReactivate, id: id, time: storage.Now()})
+}
+
+// Migrate will rewrite the state using the current schema version and the
+// configured layout, if the state was written by a previous version or uses
+// another layout. Similar to Add the changes have to be persisted using Save.
+func (s *gitStorage) Migrate() (int, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.load(); err != nil {
+		return 0, false, err
+	}
+	version := s.version
+	if version == storage.CurrentVersion && s.readLayout == s.writeLayout() {
+		return version, false, nil
+	}
+	return version, true, s.do(operation{kind: opMigrate})
 }
 
 func (s *gitStorage) List(id string) ([]storage.Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	st, err := s.load()
 	if err != nil {
 		return nil, err
 	}
-	entries, ok := st[id]
-	if !ok || entries == nil {
-		return []storage.Entry{}, nil
-	}
-	return entries, nil
+	return st.List(id), nil
 }
 
+func (s *gitStorage) ListAll() (storage.State, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.load()
+}
+
+// Save will commit all changes made by Add and Delete and push the commit to
+// the origin of the repository. If the push is rejected, because the remote
+// branch changed in the meantime, the pending changes are re-applied on top
+// of the remote state and pushed again. Changes, which can not be re-applied,
+// because the same public key was modified concurrently, are dropped and
+// returned as *storage.ConflictError.
 func (s *gitStorage) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var conflicts []string
+	backoff := initialBackoff
+	for attempt := 1; len(s.pending) > 0; attempt++ {
+		if s.committed < len(s.pending) {
+			if err := s.commit(); err != nil {
+				return err
+			}
+		}
+		err := s.push()
+		if err == nil {
+			s.pending = nil
+			s.committed = 0
+			break
+		}
+		head, ferr := s.fetch()
+		if ferr != nil {
+			return fmt.Errorf("failed to fetch after push error %q: %w", err, ferr)
+		}
+		if head == s.base || attempt >= maxAttempts {
+			// Remote did not change, so it was not a rejection due to a
+			// concurrent modification or we are out of attempts
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		dropped, err := s.rebase(head)
+		if err != nil {
+			return err
+		}
+		conflicts = append(conflicts, dropped...)
+	}
+	if len(conflicts) > 0 {
+		return &storage.ConflictError{Changes: conflicts}
+	}
+	return nil
+}
+
+// Discard will reset the worktree and local branch to the commit the pending
+// operations are based on.
+func (s *gitStorage) Discard() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	w, err := s.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := w.Reset(&git.ResetOptions{Commit: s.base, Mode: git.HardReset}); err != nil {
+		return err
+	}
+	s.pending = nil
+	s.committed = 0
 	return nil
 }
 
+// Transact will run fn and save or discard its changes, see
+// storage.Storage for details.
+func (s *gitStorage) Transact(fn func() error) error {
+	return s.transactions.Run(s, fn)
+}
+
 func (s *gitStorage) Close() error {
 	return nil
 }
 
 func (s *gitStorage) clone(url string) error {
 	var err error
-	s.repo, err = git.Clone(s.storer, s.fs, &git.CloneOptions{
-		URL:   url,
-		Auth:  s.auth,
-		Depth: 5,
-	})
+	// NOTE: the repository is not cloned shallow, because go-git is unable to
+	// check whether a push is a fast-forward or to fetch concurrent changes if
+	// the history is incomplete
+	opts := &git.CloneOptions{
+		URL:  url,
+		Auth: s.auth,
+	}
+	if s.branch != "" {
+		opts.ReferenceName = plumbing.NewBranchReferenceName(s.branch)
+		opts.SingleBranch = true
+	}
+	s.repo, err = git.Clone(s.storer, s.fs, opts)
+	if err != nil && s.branch != "" {
+		return fmt.Errorf("failed to clone branch %s: %w", s.branch, err)
+	}
 	return err
 }
 
-func (s *gitStorage) load() (state, error) {
-	if err := s.pull(); err != nil {
-		return nil, err
+// do will apply the operation to the current state and write the result to
+// the worktree.
+func (s *gitStorage) do(o operation) error {
+	st, err := s.load()
+	if err != nil {
+		return err
 	}
-	f, err := s.fs.Open(stateName)
-	if os.IsNotExist(err) {
-		return state{}, nil
+	if len(s.pending) == 0 {
+		head, err := s.repo.Head()
+		if err != nil {
+			return err
+		}
+		s.base = head.Hash()
+	}
+	if err := o.apply(st, s.allocator); err == errNoChange {
+		return nil
 	} else if err != nil {
-		return nil, err
+		return err
+	}
+	if err := s.write(st); err != nil {
+		return err
 	}
-	defer func() {
-		_ = f.Close()
-	}()
-	data, err := ioutil.ReadAll(f)
+	s.pending = append(s.pending, o)
+	return nil
+}
+
+func (s *gitStorage) commit() error {
+	w, err := s.repo.Worktree()
 	if err != nil {
+		return err
+	}
+	author, committer := s.author, s.committer
+	author.When = time.Now()
+	committer.When = author.When
+	_, err = w.Commit(commitMessage(s.pending[s.committed:]), &git.CommitOptions{
+		Author:    &author,
+		Committer: &committer,
+	})
+	if err != nil {
+		return err
+	}
+	s.committed = len(s.pending)
+	return nil
+}
+
+func (s *gitStorage) push() error {
+	err := s.repo.Push(&git.PushOptions{
+		RemoteName: remoteName,
+		Auth:       s.auth,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// fetch will update the remote-tracking branch of the current branch and
+// return the commit it points to.
+func (s *gitStorage) fetch() (plumbing.Hash, error) {
+	err := s.repo.Fetch(&git.FetchOptions{
+		RemoteName: remoteName,
+		Auth:       s.auth,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return plumbing.ZeroHash, err
+	}
+	head, err := s.repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	name := plumbing.NewRemoteReferenceName(remoteName, head.Name().Short())
+	ref, err := s.repo.Reference(name, true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return ref.Hash(), nil
+}
+
+// rebase will reset the current branch to the provided commit and re-apply all
+// pending operations. Operations, which can not be applied anymore, are
+// dropped and their descriptions returned.
+func (s *gitStorage) rebase(head plumbing.Hash) ([]string, error) {
+	w, err := s.repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Reset(&git.ResetOptions{Commit: head, Mode: git.HardReset}); err != nil {
 		return nil, err
 	}
-	st := state{}
-	err = json.Unmarshal(data, &st)
+	s.base = head
+	s.committed = 0
+	st, err := s.read()
 	if err != nil {
 		return nil, err
 	}
-	return st, nil
+	var dropped []string
+	pending := s.pending[:0]
+	for _, o := range s.pending {
+		if err := o.apply(st, s.allocator); err == errNoChange {
+			// Somebody else already made the same change
+			continue
+		} else if err != nil {
+			dropped = append(dropped, fmt.Sprintf("%s: %v", o, err))
+			continue
+		}
+		pending = append(pending, o)
+	}
+	s.pending = pending
+	if len(s.pending) == 0 {
+		return dropped, nil
+	}
+	return dropped, s.write(st)
+}
+
+func (s *gitStorage) load() (storage.State, error) {
+	// Pulling is only safe if neither the worktree nor the local branch
+	// contain any changes, otherwise those would be lost or the pull rejected
+	if len(s.pending) == 0 {
+		if err := s.pull(); err != nil {
+			return nil, err
+		}
+	}
+	return s.read()
 }
 
 func (s *gitStorage) pull() error {
@@ -119,9 +467,30 @@ func (s *gitStorage) pull() error {
 	if err != nil {
 		return err
 	}
-	err = w.Pull(&git.PullOptions{RemoteName: "origin"})
+	head, err := s.repo.Head()
+	if err != nil {
+		return err
+	}
+	// Pull the checked out branch instead of the default branch of the remote
+	err = w.Pull(&git.PullOptions{
+		RemoteName:    remoteName,
+		ReferenceName: head.Name(),
+		SingleBranch:  true,
+		Auth:          s.auth,
+	})
 	if err == git.NoErrAlreadyUpToDate {
 		return nil
 	}
 	return err
 }
+
+func commitMessage(operations []operation) string {
+	if len(operations) == 1 {
+		return operations[0].String()
+	}
+	lines := make([]string, len(operations))
+	for i, o := range operations {
+		lines[i] = "- " + o.String()
+	}
+	return fmt.Sprintf("Update %d entries\n\n%s", len(operations), strings.Join(lines, "\n"))
+}
@@ -17,6 +17,18 @@ limitations under the License.
 package git
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/ipam"
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/testutil"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/memory"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -26,5 +38,222 @@ var _ = Describe("GitStorage", func() {
 		entries, err := gitS.List(testID)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(len(entries)).To(BeNumerically(">", 0))
+		// Entries persisted without metadata are still active
+		Expect(entries[0].CreatedAt).To(BeNil())
+		Expect(entries[0].Active()).To(BeTrue())
+	})
+	It("lists entries of all users", func() {
+		st, err := gitS.ListAll()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).To(HaveKeyWithValue(testID, ContainElement(storage.Entry{PublicKey: "...", AllowedIP: "0.0.0.0/0"})))
+	})
+	It("can add, save and delete entries", func() {
+		const id = "add@test.com"
+		Expect(gitS.Add(id, storage.Entry{PublicKey: "add1"})).To(Succeed())
+		Expect(gitS.Add(id, storage.Entry{PublicKey: "add2"})).To(Succeed())
+		Expect(gitS.Save()).To(Succeed())
+		// Changes should be visible for other clones as well
+		other, err := NewStorage(&Options{RepositoryURL: getRemoteURL()})
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		entries, err := other.List(id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(
+			storage.Entry{PublicKey: "add1"},
+			storage.Entry{PublicKey: "add2"},
+		))
+		Expect(other.Delete(id, "add1")).To(Succeed())
+		Expect(other.Save()).To(Succeed())
+		entries, err = gitS.List(id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(storage.Entry{PublicKey: "add2"}))
+	})
+	It("stores and updates metadata", func() {
+		const id = "metadata@test.com"
+		expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		Expect(gitS.Add(id, storage.Entry{
+			PublicKey: "metadata",
+			AllowedIP: "ignored",
+			Name:      "laptop",
+			CreatedBy: "admin@test.com",
+			ExpiresAt: &expiry,
+			Labels:    map[string]string{"os": "linux"},
+		})).To(Succeed())
+		Expect(gitS.Save()).To(Succeed())
+		entries, err := gitS.List(id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		entry := entries[0]
+		Expect(entry.AllowedIP).To(BeEmpty())
+		Expect(entry.Name).To(Equal("laptop"))
+		Expect(entry.CreatedBy).To(Equal("admin@test.com"))
+		Expect(entry.CreatedAt).ToNot(BeNil())
+		Expect(entry.ModifiedAt).To(Equal(entry.CreatedAt))
+		Expect(entry.ExpiresAt.Equal(expiry)).To(BeTrue())
+		Expect(entry.Labels).To(Equal(map[string]string{"os": "linux"}))
+		Expect(entry.Active()).To(BeTrue())
+		createdAt := *entry.CreatedAt
+		time.Sleep(time.Second)
+		Expect(gitS.Update(id, storage.Entry{PublicKey: "metadata", Name: "desktop", Disabled: true})).To(Succeed())
+		Expect(gitS.Save()).To(Succeed())
+		entries, err = gitS.List(id)
+		Expect(err).ToNot(HaveOccurred())
+		entry = entries[0]
+		Expect(entry.Name).To(Equal("desktop"))
+		Expect(entry.CreatedBy).To(Equal("admin@test.com"))
+		Expect(entry.CreatedAt.Equal(createdAt)).To(BeTrue())
+		Expect(entry.ModifiedAt.After(createdAt)).To(BeTrue())
+		Expect(entry.ExpiresAt).To(BeNil())
+		Expect(entry.Labels).To(BeNil())
+		Expect(entry.Active()).To(BeFalse())
+		Expect(gitS.Update(id, storage.Entry{PublicKey: "unknown"})).To(MatchError(storage.ErrKeyNotFound))
+	})
+	It("rejects duplicate public keys", func() {
+		Expect(gitS.Add("dup1@test.com", storage.Entry{PublicKey: "dup"})).To(Succeed())
+		Expect(gitS.Add("dup2@test.com", storage.Entry{PublicKey: "dup"})).To(MatchError(storage.ErrKeyExists))
+		Expect(gitS.Save()).To(Succeed())
+	})
+	It("fails to delete unknown public keys", func() {
+		Expect(gitS.Delete(testID, "unknown")).To(MatchError(storage.ErrKeyNotFound))
+		Expect(gitS.Delete("unknown@test.com", "...")).To(MatchError(storage.ErrKeyNotFound))
+	})
+	It("does nothing if saved without changes", func() {
+		Expect(gitS.Save()).To(Succeed())
+	})
+	It("allocates and releases allowed IPs", func() {
+		const id = "ipam@test.com"
+		p, err := ipam.New([]string{"10.10.0.0/24"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		s, err := NewStorage(&Options{RepositoryURL: getRemoteURL(), Allocator: p})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add(id, storage.Entry{PublicKey: "ipam1"})).To(Succeed())
+		Expect(s.Add(id, storage.Entry{PublicKey: "ipam2"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		entries, err := s.List(id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(
+			storage.Entry{PublicKey: "ipam1", AllowedIP: "10.10.0.1/32"},
+			storage.Entry{PublicKey: "ipam2", AllowedIP: "10.10.0.2/32"},
+		))
+		Expect(s.Delete(id, "ipam1")).To(Succeed())
+		Expect(s.Add(id, storage.Entry{PublicKey: "ipam3"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		entries, err = s.List(id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(
+			storage.Entry{PublicKey: "ipam2", AllowedIP: "10.10.0.2/32"},
+			storage.Entry{PublicKey: "ipam3", AllowedIP: "10.10.0.1/32"},
+		))
+	})
+	It("deactivates and reactivates entries", func() {
+		const id = "deactivate@test.com"
+		Expect(gitS.Add(id, storage.Entry{PublicKey: "deactivate1"})).To(Succeed())
+		Expect(gitS.Add(id, storage.Entry{PublicKey: "deactivate2"})).To(Succeed())
+		Expect(gitS.Save()).To(Succeed())
+		Expect(gitS.Deactivate(id, "refresh token rejected")).To(Succeed())
+		// Deactivating twice is a no-op and keeps the original reason
+		Expect(gitS.Deactivate(id, "other")).To(Succeed())
+		Expect(gitS.Save()).To(Succeed())
+		other, err := NewStorage(&Options{RepositoryURL: getRemoteURL()})
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		entries, err := other.List(id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		for _, entry := range entries {
+			Expect(entry.Active()).To(BeFalse())
+			Expect(entry.Deactivation.Reason).To(Equal("refresh token rejected"))
+			Expect(entry.Deactivation.Time).ToNot(BeZero())
+		}
+		Expect(other.Reactivate(id)).To(Succeed())
+		Expect(other.Save()).To(Succeed())
+		entries, err = gitS.List(id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(
+			storage.Entry{PublicKey: "deactivate1"},
+			storage.Entry{PublicKey: "deactivate2"},
+		))
+		// Unknown users have no entries, which could be deactivated
+		Expect(gitS.Deactivate("unknown@test.com", "test")).To(Succeed())
+		Expect(gitS.Save()).To(Succeed())
+	})
+	It("migrates legacy state in a single commit", func() {
+		url := fmt.Sprintf("http://%s/migrate.git", gitServer.GetAddr())
+		Expect(testutil.InitRepository(url, map[string]string{
+			stateName: `{ "legacy@test.com": [{ "publicKey": "legacy", "allowedIP": "10.0.0.1/32" }] }`,
+		})).To(Succeed())
+		s, err := NewStorage(&Options{RepositoryURL: url})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		// Legacy state can be read without migration
+		entries, err := s.List("legacy@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(ConsistOf(storage.Entry{PublicKey: "legacy", AllowedIP: "10.0.0.1/32"}))
+		version, changed, err := s.(storage.Migrator).Migrate()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version).To(Equal(storage.LegacyVersion))
+		Expect(changed).To(BeTrue())
+		Expect(s.Save()).To(Succeed())
+		// Verify the file and history using a plain clone
+		r, err := git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{URL: url})
+		Expect(err).ToNot(HaveOccurred())
+		head, err := r.Head()
+		Expect(err).ToNot(HaveOccurred())
+		commit, err := r.CommitObject(head.Hash())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(commit.Message).To(ContainSubstring("Migrate schema"))
+		Expect(commit.NumParents()).To(Equal(1))
+		file, err := commit.File(stateName)
+		Expect(err).ToNot(HaveOccurred())
+		content, err := file.Contents()
+		Expect(err).ToNot(HaveOccurred())
+		st, fileVersion, err := storage.Decode([]byte(content))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fileVersion).To(Equal(storage.CurrentVersion))
+		Expect(st).To(HaveKey("legacy@test.com"))
+		// Migrating again does nothing
+		version, changed, err = s.(storage.Migrator).Migrate()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version).To(Equal(storage.CurrentVersion))
+		Expect(changed).To(BeFalse())
+		Expect(s.Save()).To(Succeed())
+		Expect(r.Fetch(&git.FetchOptions{})).To(Equal(git.NoErrAlreadyUpToDate))
+	})
+	It("rebases changes if remote changed concurrently", func() {
+		other, err := NewStorage(&Options{RepositoryURL: getRemoteURL()})
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		Expect(gitS.Add("rebase1@test.com", storage.Entry{PublicKey: "rebase1"})).To(Succeed())
+		Expect(other.Add("rebase2@test.com", storage.Entry{PublicKey: "rebase2"})).To(Succeed())
+		Expect(gitS.Save()).To(Succeed())
+		Expect(other.Save()).To(Succeed())
+		entries, err := gitS.List("rebase2@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(storage.Entry{PublicKey: "rebase2"}))
+		entries, err = other.List("rebase1@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(storage.Entry{PublicKey: "rebase1"}))
+	})
+	It("returns conflict if same key changed concurrently", func() {
+		other, err := NewStorage(&Options{RepositoryURL: getRemoteURL()})
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		Expect(gitS.Add("conflict1@test.com", storage.Entry{PublicKey: "conflict"})).To(Succeed())
+		Expect(other.Add("conflict2@test.com", storage.Entry{PublicKey: "conflict"})).To(Succeed())
+		Expect(other.Add("conflict2@test.com", storage.Entry{PublicKey: "noconflict"})).To(Succeed())
+		Expect(gitS.Save()).To(Succeed())
+		err = other.Save()
+		Expect(err).To(HaveOccurred())
+		var conflictErr *storage.ConflictError
+		Expect(errors.As(err, &conflictErr)).To(BeTrue())
+		Expect(conflictErr.Changes).To(HaveLen(1))
+		// Non-conflicting changes are still persisted
+		entries, err := gitS.List("conflict2@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(storage.Entry{PublicKey: "noconflict"}))
+		entries, err = other.List("conflict1@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(storage.Entry{PublicKey: "conflict"}))
 	})
 })
@@ -0,0 +1,350 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+
+	"github.com/go-git/go-git/v5"
+)
+
+const (
+	// stateName is the file containing the state of all users
+	stateName = "smorgasbord.json"
+	// usersDir is the directory containing one file per user
+	usersDir = "users"
+)
+
+// Layout defines how the state is persisted in the repository.
+type Layout string
+
+const (
+	// LayoutAuto detects the layout of the repository. Empty repositories use
+	// LayoutSingleFile.
+	LayoutAuto Layout = ""
+	// LayoutSingleFile persists the state of all users in smorgasbord.json.
+	LayoutSingleFile Layout = "single-file"
+	// LayoutPerUser persists the state of each user in its own file, e.g.
+	// users/jane.doe@example.com.json. Changes of different users therefore
+	// never conflict and the history of a single user can be inspected using
+	// git log.
+	LayoutPerUser Layout = "per-user"
+)
+
+// ParseLayout returns the layout with the provided name, "auto" or an empty
+// string resolve to LayoutAuto.
+func ParseLayout(name string) (Layout, error) {
+	if name == "auto" {
+		return LayoutAuto, nil
+	}
+	layout := Layout(name)
+	return layout, layout.validate()
+}
+
+func (l Layout) validate() error {
+	switch l {
+	case LayoutAuto, LayoutSingleFile, LayoutPerUser:
+		return nil
+	}
+	return fmt.Errorf("unknown layout %q", string(l))
+}
+
+// userDocument is the content of a file of LayoutPerUser. The id is stored as
+// part of the document, as the file name is sanitized.
+type userDocument struct {
+	Version int             `json:"version"`
+	ID      string          `json:"id"`
+	Entries []storage.Entry `json:"entries"`
+}
+
+// userFileName returns the file name of the user. All characters, which might
+// not be safe to use in file names, are percent-encoded, so file names are
+// unique. This includes upper case letters, as ids only differing in case
+// would collide on case-insensitive file systems.
+func userFileName(id string) string {
+	var b strings.Builder
+	for _, c := range []byte(id) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '@', c == '.', c == '_', c == '-':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	name := b.String()
+	// Avoid hidden files and special directory names
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return path.Join(usersDir, name+".json")
+}
+
+// detectLayout returns the layout of the worktree. As git does not track
+// empty directories, the worktree is only considered to use LayoutPerUser if
+// it contains at least one file of a user.
+func (s *gitStorage) detectLayout() (Layout, error) {
+	names, err := s.stateFiles()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if name != stateName {
+			return LayoutPerUser, nil
+		}
+	}
+	return LayoutSingleFile, nil
+}
+
+// writeLayout returns the layout used to write the state. If the layout is
+// detected automatically, the layout of the current state is kept.
+func (s *gitStorage) writeLayout() Layout {
+	if s.layout == LayoutAuto {
+		return s.readLayout
+	}
+	return s.layout
+}
+
+// read will read the state from the worktree regardless of the configured
+// layout, so repositories can be converted to another layout.
+func (s *gitStorage) read() (storage.State, error) {
+	layout, err := s.detectLayout()
+	if err != nil {
+		return nil, err
+	}
+	s.readLayout = layout
+	if layout == LayoutPerUser {
+		return s.readBoth()
+	}
+	return s.readSingleFile()
+}
+
+// readBoth reads the files of LayoutPerUser and merges smorgasbord.json into
+// the state, if it exists as well. This happens if the repository is only
+// partially converted or a replica using LayoutSingleFile pushed in between.
+// As write removes the files of the other layout, users only present in
+// smorgasbord.json would be lost otherwise. Users present in both layouts
+// with different entries can not be merged safely, e.g. a deleted key could
+// be restored, so an error is returned instead.
+func (s *gitStorage) readBoth() (storage.State, error) {
+	st, err := s.readPerUser()
+	if err != nil {
+		return nil, err
+	}
+	version := s.version
+	single, err := s.readSingleFile()
+	if err != nil {
+		return nil, err
+	}
+	if s.version > version {
+		s.version = version
+	}
+	for id, entries := range single {
+		if len(entries) == 0 {
+			continue
+		}
+		current, ok := st[id]
+		if !ok {
+			st[id] = entries
+			continue
+		}
+		if !reflect.DeepEqual(current, entries) {
+			return nil, fmt.Errorf("entries of user %q differ between %s and %s, resolve the conflict manually", id, stateName, userFileName(id))
+		}
+	}
+	return st, nil
+}
+
+func (s *gitStorage) readSingleFile() (storage.State, error) {
+	data, err := s.readFile(stateName)
+	if os.IsNotExist(err) {
+		s.version = storage.CurrentVersion
+		return storage.State{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	st, version, err := storage.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", stateName, err)
+	}
+	s.version = version
+	return st, nil
+}
+
+func (s *gitStorage) readPerUser() (storage.State, error) {
+	names, err := s.stateFiles()
+	if err != nil {
+		return nil, err
+	}
+	st := storage.State{}
+	s.version = storage.CurrentVersion
+	for _, name := range names {
+		if name == stateName {
+			continue
+		}
+		data, err := s.readFile(name)
+		if err != nil {
+			return nil, err
+		}
+		doc := &userDocument{}
+		if err := json.Unmarshal(data, doc); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", name, err)
+		}
+		if doc.Version > storage.CurrentVersion {
+			return nil, fmt.Errorf("schema version %d of %s is newer than supported version %d", doc.Version, name, storage.CurrentVersion)
+		}
+		if doc.Version < s.version {
+			s.version = doc.Version
+		}
+		if doc.ID == "" {
+			return nil, fmt.Errorf("no id in %s", name)
+		}
+		if len(doc.Entries) > 0 {
+			st[doc.ID] = append(st[doc.ID], doc.Entries...)
+		}
+	}
+	return st, nil
+}
+
+// write will write the state to the worktree using the layout returned by
+// writeLayout and stage the changes, so they will be part of the next commit.
+// Files of the other layout are removed.
+func (s *gitStorage) write(st storage.State) error {
+	w, err := s.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{}
+	if s.writeLayout() == LayoutPerUser {
+		for id, entries := range st {
+			if len(entries) == 0 {
+				continue
+			}
+			data, err := json.MarshalIndent(&userDocument{
+				Version: storage.CurrentVersion,
+				ID:      id,
+				Entries: entries,
+			}, "", "  ")
+			if err != nil {
+				return err
+			}
+			files[userFileName(id)] = data
+		}
+	} else {
+		data, err := storage.Encode(st)
+		if err != nil {
+			return err
+		}
+		files[stateName] = data
+	}
+	// Remove all files, which are no longer required
+	existing, err := s.stateFiles()
+	if err != nil {
+		return err
+	}
+	for _, name := range existing {
+		if _, ok := files[name]; ok {
+			continue
+		}
+		if _, err := w.Remove(s.path(name)); err != nil {
+			return err
+		}
+	}
+	// Only write files, which changed, to keep the history readable
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		current, err := s.readFile(name)
+		if err == nil && string(current) == string(files[name]) {
+			continue
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := s.writeFile(w, name, files[name]); err != nil {
+			return err
+		}
+	}
+	s.version = storage.CurrentVersion
+	return nil
+}
+
+// stateFiles returns the names of all files of both layouts in the worktree.
+func (s *gitStorage) stateFiles() ([]string, error) {
+	names := []string{}
+	if _, err := s.fs.Stat(s.path(stateName)); err == nil {
+		names = append(names, stateName)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	files, err := s.fs.ReadDir(s.path(usersDir))
+	if os.IsNotExist(err) {
+		return names, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".json") {
+			names = append(names, path.Join(usersDir, fi.Name()))
+		}
+	}
+	return names, nil
+}
+
+// path returns the path of the file relative to the root of the worktree.
+// All names used for the state are relative to the configured subdirectory.
+func (s *gitStorage) path(name string) string {
+	return path.Join(s.subdirectory, name)
+}
+
+func (s *gitStorage) readFile(name string) ([]byte, error) {
+	f, err := s.fs.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return ioutil.ReadAll(f)
+}
+
+func (s *gitStorage) writeFile(w *git.Worktree, name string, data []byte) error {
+	f, err := s.fs.Create(s.path(name))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	_, err = w.Add(s.path(name))
+	return err
+}
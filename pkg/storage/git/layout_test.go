@@ -0,0 +1,224 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/testutil"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// headFiles returns the files of the latest commit of the repository as well
+// as the files changed by it.
+func headFiles(url string) (map[string]string, []string) {
+	r, err := git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{URL: url})
+	Expect(err).ToNot(HaveOccurred())
+	head, err := r.Head()
+	Expect(err).ToNot(HaveOccurred())
+	commit, err := r.CommitObject(head.Hash())
+	Expect(err).ToNot(HaveOccurred())
+	files := map[string]string{}
+	iter, err := commit.Files()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(iter.ForEach(func(f *object.File) error {
+		content, err := f.Contents()
+		files[f.Name] = content
+		return err
+	})).To(Succeed())
+	stats, err := commit.Stats()
+	Expect(err).ToNot(HaveOccurred())
+	changed := []string{}
+	for _, stat := range stats {
+		changed = append(changed, stat.Name)
+	}
+	return files, changed
+}
+
+var _ = Describe("Layout", func() {
+	var (
+		url   string
+		repos int
+	)
+	BeforeEach(func() {
+		// Use a new repository for each test
+		repos++
+		url = fmt.Sprintf("http://%s/layout%d.git", gitServer.GetAddr(), repos)
+		Expect(testutil.InitRepository(url, map[string]string{
+			"README.md": "# Test",
+		})).To(Succeed())
+	})
+	It("sanitizes file names of users", func() {
+		Expect(userFileName("jane.doe@example.com")).To(Equal("users/jane.doe@example.com.json"))
+		Expect(userFileName("../a/b")).To(Equal("users/%2E.%2Fa%2Fb.json"))
+		Expect(userFileName("a+b")).ToNot(Equal(userFileName("a_b")))
+		Expect(userFileName("Jane.Doe@example.com")).To(Equal("users/%4Aane.%44oe@example.com.json"))
+		Expect(strings.ToLower(userFileName("Jane.Doe@example.com"))).ToNot(Equal(strings.ToLower(userFileName("jane.doe@example.com"))))
+	})
+	It("parses layouts", func() {
+		Expect(ParseLayout("auto")).To(Equal(LayoutAuto))
+		Expect(ParseLayout("per-user")).To(Equal(LayoutPerUser))
+		_, err := ParseLayout("invalid")
+		Expect(err).To(HaveOccurred())
+		_, err = NewStorage(&Options{RepositoryURL: url, Layout: Layout("invalid")})
+		Expect(err).To(HaveOccurred())
+	})
+	It("stores each user in its own file", func() {
+		s, err := NewStorage(&Options{RepositoryURL: url, Layout: LayoutPerUser})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		files, _ := headFiles(url)
+		Expect(files).To(HaveKey("users/a@test.com.json"))
+		Expect(files).To(HaveKey("users/b@test.com.json"))
+		Expect(files).ToNot(HaveKey(stateName))
+		// Changes only touch the file of the user
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a2"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		_, changed := headFiles(url)
+		Expect(changed).To(Equal([]string{"users/a@test.com.json"}))
+		// Layout is detected automatically
+		other, err := NewStorage(&Options{RepositoryURL: url})
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		st, err := other.ListAll()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).To(HaveLen(2))
+		Expect(withoutMetadata(st["a@test.com"])).To(ConsistOf(
+			storage.Entry{PublicKey: "a"},
+			storage.Entry{PublicKey: "a2"},
+		))
+		Expect(other.Add("c@test.com", storage.Entry{PublicKey: "c"})).To(Succeed())
+		Expect(other.Delete("b@test.com", "b")).To(Succeed())
+		Expect(other.Save()).To(Succeed())
+		files, _ = headFiles(url)
+		Expect(files).To(HaveKey("users/c@test.com.json"))
+		Expect(files).ToNot(HaveKey("users/b@test.com.json"))
+		Expect(files).ToNot(HaveKey(stateName))
+	})
+	It("renames files of users with upper case letters", func() {
+		// Previous versions did not encode upper case letters
+		url = fmt.Sprintf("http://%s/layout%d-case.git", gitServer.GetAddr(), repos)
+		Expect(testutil.InitRepository(url, map[string]string{
+			"users/Jane@test.com.json": `{"version":1,"id":"Jane@test.com","entries":[{"publicKey":"a"}]}`,
+		})).To(Succeed())
+		s, err := NewStorage(&Options{RepositoryURL: url})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("Jane@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		files, _ := headFiles(url)
+		Expect(files).To(HaveKey("users/%4Aane@test.com.json"))
+		Expect(files).ToNot(HaveKey("users/Jane@test.com.json"))
+		entries, err := s.List("Jane@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(
+			storage.Entry{PublicKey: "a"},
+			storage.Entry{PublicKey: "b"},
+		))
+	})
+	It("merges users present in both layouts", func() {
+		url = fmt.Sprintf("http://%s/layout%d-both.git", gitServer.GetAddr(), repos)
+		Expect(testutil.InitRepository(url, map[string]string{
+			stateName:               `{"version":2,"users":{"a@test.com":[{"publicKey":"a"}],"b@test.com":[{"publicKey":"b"}]}}`,
+			"users/a@test.com.json": `{"version":1,"id":"a@test.com","entries":[{"publicKey":"a"}]}`,
+		})).To(Succeed())
+		s, err := NewStorage(&Options{RepositoryURL: url})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("c@test.com", storage.Entry{PublicKey: "c"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		files, _ := headFiles(url)
+		Expect(files).To(HaveKey("users/a@test.com.json"))
+		Expect(files).To(HaveKey("users/b@test.com.json"))
+		Expect(files).To(HaveKey("users/c@test.com.json"))
+		Expect(files).ToNot(HaveKey(stateName))
+		entries, err := s.List("b@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(storage.Entry{PublicKey: "b"}))
+	})
+	It("fails if users differ between both layouts", func() {
+		url = fmt.Sprintf("http://%s/layout%d-conflict.git", gitServer.GetAddr(), repos)
+		Expect(testutil.InitRepository(url, map[string]string{
+			stateName:               `{"version":2,"users":{"a@test.com":[{"publicKey":"a"},{"publicKey":"a2"}]}}`,
+			"users/a@test.com.json": `{"version":1,"id":"a@test.com","entries":[{"publicKey":"a"}]}`,
+		})).To(Succeed())
+		s, err := NewStorage(&Options{RepositoryURL: url})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		_, err = s.ListAll()
+		Expect(err).To(MatchError(ContainSubstring(`entries of user "a@test.com" differ`)))
+		Expect(s.Add("b@test.com", storage.Entry{PublicKey: "b"})).ToNot(Succeed())
+	})
+	It("rebases concurrent changes of different users", func() {
+		s, err := NewStorage(&Options{RepositoryURL: url, Layout: LayoutPerUser})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		other, err := NewStorage(&Options{RepositoryURL: url, Layout: LayoutPerUser})
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(other.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		Expect(other.Save()).To(Succeed())
+		files, _ := headFiles(url)
+		Expect(files).To(HaveKey("users/a@test.com.json"))
+		Expect(files).To(HaveKey("users/b@test.com.json"))
+	})
+	It("converts between layouts", func() {
+		s, err := NewStorage(&Options{RepositoryURL: url, Layout: LayoutSingleFile})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		files, _ := headFiles(url)
+		Expect(files).To(HaveKey(stateName))
+		// Convert to per-user layout
+		perUser, err := NewStorage(&Options{RepositoryURL: url, Layout: LayoutPerUser})
+		Expect(err).ToNot(HaveOccurred())
+		defer perUser.Close()
+		_, changed, err := perUser.(storage.Migrator).Migrate()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(perUser.Save()).To(Succeed())
+		files, _ = headFiles(url)
+		Expect(files).To(HaveKey("users/a@test.com.json"))
+		Expect(files).ToNot(HaveKey(stateName))
+		// Convert back to single file
+		_, changed, err = s.(storage.Migrator).Migrate()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(s.Save()).To(Succeed())
+		files, _ = headFiles(url)
+		Expect(files).To(HaveKey(stateName))
+		Expect(files).ToNot(HaveKey("users/a@test.com.json"))
+		entries, err := perUser.List("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withoutMetadata(entries)).To(ConsistOf(storage.Entry{PublicKey: "a"}))
+	})
+})
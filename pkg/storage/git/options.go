@@ -0,0 +1,150 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"fmt"
+	"net/mail"
+	"path"
+	"strings"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Options configure the git storage. Only the repository URL is required.
+type Options struct {
+	// RepositoryURL is the URL of the repository to clone
+	RepositoryURL string
+	// Auth is used to authenticate against the remote, if provided
+	Auth transport.AuthMethod
+	// Allocator assigns allowed IPs to new entries and releases them once the
+	// entries are deleted, if provided
+	Allocator storage.Allocator
+	// Layout defines how the state is persisted, see Layout for details
+	Layout Layout
+	// Branch to operate on, defaults to the default branch of the remote
+	Branch string
+	// Subdirectory of the repository containing the state, defaults to the
+	// root of the repository
+	Subdirectory string
+	// AuthorName and AuthorEmail identify the author of the commits, default
+	// to smorgasbord and smorgasbord@localhost
+	AuthorName  string
+	AuthorEmail string
+	// CommitterName and CommitterEmail identify the committer of the
+	// commits, default to the author
+	CommitterName  string
+	CommitterEmail string
+}
+
+// complete sets the defaults of all omitted optional fields.
+func (o *Options) complete() {
+	if o.AuthorName == "" {
+		o.AuthorName = authorName
+	}
+	if o.AuthorEmail == "" {
+		o.AuthorEmail = authorEmail
+	}
+	if o.CommitterName == "" {
+		o.CommitterName = o.AuthorName
+	}
+	if o.CommitterEmail == "" {
+		o.CommitterEmail = o.AuthorEmail
+	}
+	if o.Subdirectory != "" {
+		o.Subdirectory = path.Clean(strings.Trim(o.Subdirectory, "/"))
+		if o.Subdirectory == "." {
+			o.Subdirectory = ""
+		}
+	}
+}
+
+// validate returns an error if the options are invalid. It is expected to
+// be called after complete.
+func (o *Options) validate() error {
+	if o.RepositoryURL == "" {
+		return fmt.Errorf("repository url is required")
+	}
+	if err := o.Layout.validate(); err != nil {
+		return err
+	}
+	if o.Branch != "" {
+		if err := validateBranch(o.Branch); err != nil {
+			return err
+		}
+	}
+	if o.Subdirectory == ".." || strings.HasPrefix(o.Subdirectory, "../") {
+		return fmt.Errorf("subdirectory %q is outside of the repository", o.Subdirectory)
+	}
+	for _, part := range strings.Split(o.Subdirectory, "/") {
+		if part == ".git" {
+			return fmt.Errorf("subdirectory %q must not be within .git", o.Subdirectory)
+		}
+	}
+	if err := validateIdentity("author", o.AuthorName, o.AuthorEmail); err != nil {
+		return err
+	}
+	return validateIdentity("committer", o.CommitterName, o.CommitterEmail)
+}
+
+// validateBranch checks the name of the branch using a subset of the rules
+// of git check-ref-format.
+func validateBranch(name string) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid branch name %q: %s", name, reason)
+	}
+	switch {
+	case strings.HasPrefix(name, "refs/"):
+		return invalid("expected short name without refs/ prefix")
+	case strings.HasPrefix(name, "-"):
+		return invalid("must not start with -")
+	case strings.HasPrefix(name, "/"), strings.HasSuffix(name, "/"), strings.Contains(name, "//"):
+		return invalid("must not contain empty components")
+	case strings.HasSuffix(name, "."), strings.HasSuffix(name, ".lock"):
+		return invalid("must not end with . or .lock")
+	case strings.Contains(name, ".."), strings.Contains(name, "@{"):
+		return invalid("must not contain .. or @{")
+	case name == "@":
+		return invalid("must not be @")
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return invalid(fmt.Sprintf("must not contain %q", c))
+		}
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return invalid("components must not start with .")
+		}
+	}
+	return nil
+}
+
+func validateIdentity(kind, name, email string) error {
+	if strings.ContainsAny(name, "<>\n") {
+		return fmt.Errorf("invalid %s name %q", kind, name)
+	}
+	// Addresses like smorgasbord@localhost are fine, but the address must not
+	// contain a display name or angle brackets
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("invalid %s email %q", kind, email)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"fmt"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/testutil"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// branchCommit returns the latest commit of the branch of the repository.
+func branchCommit(url, branch string) *object.Commit {
+	r, err := git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{
+		URL:           url,
+		ReferenceName: plumbing.NewBranchReferenceName(branch),
+		SingleBranch:  true,
+	})
+	Expect(err).ToNot(HaveOccurred())
+	head, err := r.Head()
+	Expect(err).ToNot(HaveOccurred())
+	commit, err := r.CommitObject(head.Hash())
+	Expect(err).ToNot(HaveOccurred())
+	return commit
+}
+
+var _ = Describe("Options", func() {
+	It("validates options", func() {
+		valid := func(modify func(o *Options)) error {
+			o := &Options{RepositoryURL: "http://localhost/test.git"}
+			modify(o)
+			o.complete()
+			return o.validate()
+		}
+		Expect(valid(func(o *Options) {})).To(Succeed())
+		Expect(valid(func(o *Options) { o.RepositoryURL = "" })).ToNot(Succeed())
+		Expect(valid(func(o *Options) { o.Layout = Layout("invalid") })).ToNot(Succeed())
+		for _, branch := range []string{"main", "infra/vpn", "release-1.0"} {
+			Expect(valid(func(o *Options) { o.Branch = branch })).To(Succeed(), branch)
+		}
+		for _, branch := range []string{"refs/heads/main", "-main", "a..b", "a b", "a/", ".a", "a.lock", "a:b", "@"} {
+			Expect(valid(func(o *Options) { o.Branch = branch })).ToNot(Succeed(), branch)
+		}
+		for _, dir := range []string{"/vpn/", "vpn/smorgasbord", "./vpn", "vpn/../other"} {
+			Expect(valid(func(o *Options) { o.Subdirectory = dir })).To(Succeed(), dir)
+		}
+		for _, dir := range []string{"..", "../vpn", "vpn/../../other", ".git", "vpn/.git/hooks"} {
+			Expect(valid(func(o *Options) { o.Subdirectory = dir })).ToNot(Succeed(), dir)
+		}
+		Expect(valid(func(o *Options) { o.AuthorEmail = "invalid" })).ToNot(Succeed())
+		Expect(valid(func(o *Options) { o.AuthorEmail = "Jane <jane@example.com>" })).ToNot(Succeed())
+		Expect(valid(func(o *Options) { o.AuthorName = "Jane <jane@example.com>" })).ToNot(Succeed())
+		Expect(valid(func(o *Options) { o.CommitterEmail = "invalid" })).ToNot(Succeed())
+	})
+	It("defaults the committer to the author", func() {
+		o := &Options{AuthorName: "Jane", AuthorEmail: "jane@example.com", Subdirectory: "/vpn/"}
+		o.complete()
+		Expect(o.CommitterName).To(Equal("Jane"))
+		Expect(o.CommitterEmail).To(Equal("jane@example.com"))
+		Expect(o.Subdirectory).To(Equal("vpn"))
+	})
+	It("uses the configured branch, subdirectory and identity", func() {
+		url := fmt.Sprintf("http://%s/options.git", gitServer.GetAddr())
+		Expect(testutil.InitRepository(url, map[string]string{
+			"README.md": "# Test",
+		})).To(Succeed())
+		// Create the branch from the default branch
+		r, err := git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{URL: url})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r.Push(&git.PushOptions{
+			RemoteName: remoteName,
+			RefSpecs:   []config.RefSpec{"refs/heads/master:refs/heads/infra"},
+		})).To(Succeed())
+		s, err := NewStorage(&Options{
+			RepositoryURL:  url,
+			Branch:         "infra",
+			Subdirectory:   "vpn",
+			AuthorName:     "Jane Doe",
+			AuthorEmail:    "jane@example.com",
+			CommitterName:  "Bot",
+			CommitterEmail: "bot@example.com",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		commit := branchCommit(url, "infra")
+		Expect(commit.Author.Name).To(Equal("Jane Doe"))
+		Expect(commit.Author.Email).To(Equal("jane@example.com"))
+		Expect(commit.Committer.Name).To(Equal("Bot"))
+		Expect(commit.Committer.Email).To(Equal("bot@example.com"))
+		_, err = commit.File("vpn/" + stateName)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = commit.File(stateName)
+		Expect(err).To(Equal(object.ErrFileNotFound))
+		// The default branch is not modified
+		Expect(branchCommit(url, "master").Message).To(Equal("first commit"))
+		// Another instance reads the state from the branch and subdirectory
+		other, err := NewStorage(&Options{RepositoryURL: url, Branch: "infra", Subdirectory: "/vpn/"})
+		Expect(err).ToNot(HaveOccurred())
+		defer other.Close()
+		Expect(other.List("a@test.com")).To(HaveLen(1))
+		Expect(other.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(other.Save()).To(Succeed())
+		// Pulling only considers the configured branch
+		Expect(s.ListAll()).To(HaveLen(2))
+		// Unknown branches fail at startup
+		_, err = NewStorage(&Options{RepositoryURL: url, Branch: "unknown"})
+		Expect(err).To(HaveOccurred())
+	})
+})
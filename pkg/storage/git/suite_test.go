@@ -18,22 +18,14 @@ package git
 
 import (
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"testing"
-	"time"
 
 	_ "github.com/kubism/smorgasbord/internal/flags"
 	"github.com/kubism/smorgasbord/pkg/storage"
 	"github.com/kubism/smorgasbord/pkg/testutil"
 
-	"github.com/go-git/go-billy/v5/memfs"
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/config"
-	"github.com/go-git/go-git/v5/plumbing/object"
-	"github.com/go-git/go-git/v5/storage/memory"
-
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -58,36 +50,11 @@ var _ = BeforeSuite(func(done Done) {
 	gitServer, err = testutil.NewGitServer(tmpDir)
 	Expect(err).ToNot(HaveOccurred())
 	// Let's setup the repository for first use
-	fs := memfs.New()
-	r, err := git.Init(memory.NewStorage(), fs)
-	Expect(err).ToNot(HaveOccurred())
-	_, err = r.CreateRemote(&config.RemoteConfig{
-		Name: "origin",
-		URLs: []string{getRemoteURL()},
-	})
-	Expect(err).ToNot(HaveOccurred())
-	f, err := fs.Create(stateName)
-	Expect(err).ToNot(HaveOccurred())
-	_, err = io.WriteString(f, `{ "test@test.com": [{ "publicKey": "...", "allowedIP": "0.0.0.0/0" }] }`)
-	Expect(err).ToNot(HaveOccurred())
-	Expect(f.Close()).To(Succeed())
-	w, err := r.Worktree()
-	Expect(err).ToNot(HaveOccurred())
-	_, err = w.Add(stateName)
-	Expect(err).ToNot(HaveOccurred())
-	_, err = w.Commit("first commit", &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "John Doe",
-			Email: "john@doe.org",
-			When:  time.Now(),
-		},
-	})
-	Expect(err).ToNot(HaveOccurred())
-	Expect(r.Push(&git.PushOptions{
-		RemoteName: "origin",
+	Expect(testutil.InitRepository(getRemoteURL(), map[string]string{
+		stateName: `{ "test@test.com": [{ "publicKey": "...", "allowedIP": "0.0.0.0/0" }] }`,
 	})).To(Succeed())
 	// Lastly setup gitStorage
-	gitS, err = NewStorage(getRemoteURL(), nil)
+	gitS, err = NewStorage(&Options{RepositoryURL: getRemoteURL()})
 	Expect(err).ToNot(HaveOccurred())
 	close(done)
 }, 240)
@@ -104,3 +71,16 @@ var _ = AfterSuite(func() {
 func getRemoteURL() string {
 	return fmt.Sprintf("http://%s/test.git", gitServer.GetAddr())
 }
+
+// withoutMetadata removes the metadata set by the storage, so entries can be
+// compared easily.
+func withoutMetadata(entries []storage.Entry) []storage.Entry {
+	result := make([]storage.Entry, len(entries))
+	for i, entry := range entries {
+		entry.CreatedAt = nil
+		entry.CreatedBy = ""
+		entry.ModifiedAt = nil
+		result[i] = entry
+	}
+	return result
+}
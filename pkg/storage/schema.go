@@ -0,0 +1,156 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// LegacyVersion is the version of documents without envelope, which
+	// directly map the ids of users to their entries.
+	LegacyVersion = 1
+	// CurrentVersion is the schema version written by Encode.
+	CurrentVersion = 2
+)
+
+// Document is the envelope of the persisted state. The version allows to
+// detect and migrate documents written by older versions.
+type Document struct {
+	Version int   `json:"version"`
+	Users   State `json:"users"`
+}
+
+// Migration upgrades a raw document from version From to From+1.
+type Migration struct {
+	From        int
+	Description string
+	Migrate     func(data []byte) ([]byte, error)
+}
+
+var (
+	migrationsMutex sync.RWMutex
+	migrations      = map[int]Migration{}
+)
+
+// RegisterMigration adds the migration to the registry used by Decode. It
+// panics if a migration for the same version is already registered.
+func RegisterMigration(m Migration) {
+	migrationsMutex.Lock()
+	defer migrationsMutex.Unlock()
+	if _, ok := migrations[m.From]; ok {
+		panic(fmt.Sprintf("migration from version %d already registered", m.From))
+	}
+	migrations[m.From] = m
+}
+
+func init() {
+	RegisterMigration(Migration{
+		From:        LegacyVersion,
+		Description: "Wrap users in versioned envelope",
+		Migrate: func(data []byte) ([]byte, error) {
+			return json.Marshal(&struct {
+				Version int             `json:"version"`
+				Users   json.RawMessage `json:"users"`
+			}{Version: LegacyVersion + 1, Users: data})
+		},
+	})
+}
+
+// Version returns the schema version of the raw document. Empty documents
+// are considered to be of the current version.
+func Version(data []byte) (int, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return CurrentVersion, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return 0, err
+	}
+	// Legacy documents might contain a user called "version", but its value
+	// would be a list of entries
+	var version int
+	if raw, ok := fields["version"]; !ok || json.Unmarshal(raw, &version) != nil {
+		return LegacyVersion, nil
+	}
+	return version, nil
+}
+
+// Decode migrates the raw document to the current version if required and
+// returns the contained state as well as the version of the raw document.
+func Decode(data []byte) (State, int, error) {
+	version, err := Version(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to detect schema version: %w", err)
+	}
+	if version > CurrentVersion {
+		return nil, version, fmt.Errorf("schema version %d is newer than supported version %d", version, CurrentVersion)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return State{}, version, nil
+	}
+	migrated := data
+	migrationsMutex.RLock()
+	defer migrationsMutex.RUnlock()
+	for v := version; v < CurrentVersion; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			return nil, version, fmt.Errorf("no migration from schema version %d registered", v)
+		}
+		migrated, err = m.Migrate(migrated)
+		if err != nil {
+			return nil, version, fmt.Errorf("failed to migrate from schema version %d: %w", v, err)
+		}
+	}
+	doc := &Document{}
+	if err := json.Unmarshal(migrated, doc); err != nil {
+		return nil, version, err
+	}
+	if doc.Users == nil {
+		doc.Users = State{}
+	}
+	return doc.Users, version, nil
+}
+
+// Encode returns the document of the state using the current version.
+func Encode(st State) ([]byte, error) {
+	if st == nil {
+		st = State{}
+	}
+	return json.MarshalIndent(&Document{Version: CurrentVersion, Users: st}, "", "  ")
+}
+
+// Migrator is implemented by storages persisting a versioned document.
+type Migrator interface {
+	// Migrate rewrites the persisted document using the current schema
+	// version and returns the previous version as well as whether anything
+	// has to be rewritten. Similar to Add the changes have to be persisted
+	// using Save.
+	Migrate() (int, bool, error)
+}
+
+// Exporter is implemented by storages, which can export a consistent snapshot
+// of the persisted state while in use.
+type Exporter interface {
+	// Export writes the persisted state without pending changes to w using
+	// the format written by Encode.
+	Export(w io.Writer) error
+}
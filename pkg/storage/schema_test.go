@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema", func() {
+	It("decodes and migrates legacy documents", func() {
+		st, version, err := Decode([]byte(`{"version":[{"publicKey":"a"}]}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version).To(Equal(LegacyVersion))
+		Expect(st).To(Equal(State{"version": {{PublicKey: "a"}}}))
+	})
+	It("encodes and decodes current documents", func() {
+		data, err := Encode(State{"a@test.com": {{PublicKey: "a"}}})
+		Expect(err).ToNot(HaveOccurred())
+		var doc map[string]json.RawMessage
+		Expect(json.Unmarshal(data, &doc)).To(Succeed())
+		Expect(string(doc["version"])).To(Equal("2"))
+		st, version, err := Decode(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version).To(Equal(CurrentVersion))
+		Expect(st).To(Equal(State{"a@test.com": {{PublicKey: "a"}}}))
+	})
+	It("decodes empty documents", func() {
+		st, version, err := Decode([]byte("  "))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version).To(Equal(CurrentVersion))
+		Expect(st).To(BeEmpty())
+		st, _, err = Decode([]byte(`{"version":2}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).ToNot(BeNil())
+	})
+	It("rejects newer and invalid documents", func() {
+		_, _, err := Decode([]byte(`{"version":99,"users":{}}`))
+		Expect(err).To(MatchError(ContainSubstring("newer")))
+		_, _, err = Decode([]byte(`[]`))
+		Expect(err).To(HaveOccurred())
+	})
+	It("rejects duplicate migrations", func() {
+		Expect(func() {
+			RegisterMigration(Migration{From: LegacyVersion})
+		}).To(Panic())
+	})
+})
@@ -0,0 +1,42 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sql_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+	"github.com/kubism/smorgasbord/pkg/storage/sql"
+	"github.com/kubism/smorgasbord/pkg/storage/storagetest"
+
+	. "github.com/onsi/gomega"
+)
+
+var _ = storagetest.DescribeBackend("sql", storagetest.Backend{
+	Setup: func() (storagetest.Opener, func()) {
+		dir, err := ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+		open := func(allocator storage.Allocator) (storage.Storage, error) {
+			return sql.NewStorage(&sql.Options{DSN: filepath.Join(dir, "smorgasbord.db"), Allocator: allocator})
+		}
+		return open, func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		}
+	},
+})
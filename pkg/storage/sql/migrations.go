@@ -0,0 +1,191 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sql
+
+import (
+	dbsql "database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is a single step of the schema, which is applied in its own
+// transaction.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+	// migrate is called after the statements were executed, e.g. to migrate
+	// data, which can not be migrated using SQL only
+	migrate func(tx *dbsql.Tx) error
+}
+
+// migrations contains all steps of the schema in order. Steps must never be
+// modified once released, add a new step instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Create entries and audit log",
+		statements: []string{
+			`CREATE TABLE entries (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				public_key TEXT NOT NULL UNIQUE,
+				user_id TEXT NOT NULL,
+				allowed_ip TEXT UNIQUE,
+				name TEXT NOT NULL DEFAULT '',
+				created_at TEXT,
+				created_by TEXT NOT NULL DEFAULT '',
+				modified_at TEXT,
+				expires_at TEXT,
+				disabled BOOLEAN NOT NULL DEFAULT FALSE,
+				labels TEXT NOT NULL DEFAULT '{}',
+				deactivation_reason TEXT,
+				deactivated_at TEXT
+			)`,
+			`CREATE INDEX entries_user_id ON entries (user_id)`,
+			`CREATE TABLE audit_log (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				time TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				public_key TEXT NOT NULL DEFAULT '',
+				action TEXT NOT NULL,
+				details TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX audit_log_user_id ON audit_log (user_id)`,
+		},
+	},
+	{
+		version:     2,
+		description: "Add network of entries",
+		statements: []string{
+			`ALTER TABLE entries ADD COLUMN network TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     3,
+		description: "Index each prefix of allowed IPs",
+		statements: []string{
+			`CREATE TABLE allowed_ips (
+				prefix TEXT PRIMARY KEY,
+				public_key TEXT NOT NULL
+			)`,
+			`CREATE INDEX allowed_ips_public_key ON allowed_ips (public_key)`,
+		},
+		migrate: indexAllowedIPs,
+	},
+	{
+		version:     4,
+		description: "Record redeemed handoff codes",
+		statements: []string{
+			`CREATE TABLE handoff_redemptions (
+				code TEXT PRIMARY KEY,
+				expiry INTEGER NOT NULL
+			)`,
+		},
+	},
+}
+
+// indexAllowedIPs adds the prefixes of the allowed IPs of all entries to
+// allowed_ips.
+func indexAllowedIPs(tx *dbsql.Tx) error {
+	rows, err := tx.Query(`SELECT public_key, allowed_ip FROM entries WHERE allowed_ip IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	allowedIPs := map[string]string{}
+	for rows.Next() {
+		var publicKey, allowedIP string
+		if err := rows.Scan(&publicKey, &allowedIP); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		allowedIPs[publicKey] = allowedIP
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for publicKey, allowedIP := range allowedIPs {
+		if err := insertAllowedIPs(tx, publicKey, allowedIPPrefixes(allowedIP)); err != nil {
+			return fmt.Errorf("failed to index allowed IPs of %s: %w", publicKey, err)
+		}
+	}
+	return nil
+}
+
+// latestVersion returns the version of the last migration.
+func latestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate applies all migrations, which were not applied yet, and returns
+// the version of the schema.
+func migrate(db *dbsql.DB) (int, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	var current dbsql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&current); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	version := int(current.Int64)
+	if version > latestVersion() {
+		return 0, fmt.Errorf("schema version %d is newer than supported version %d", version, latestVersion())
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return 0, fmt.Errorf("failed to migrate schema to version %d: %w", m.version, err)
+		}
+		version = m.version
+	}
+	return version, nil
+}
+
+func applyMigration(db *dbsql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range m.statements {
+		if _, err := tx.Exec(statement); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if m.migrate != nil {
+		if err := m.migrate(tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.description, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,593 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sql
+
+import (
+	dbsql "database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/storage"
+
+	// Register the pure Go SQLite driver, so no cgo is required
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// DriverSQLite is the name of the registered SQLite driver
+	DriverSQLite = "sqlite"
+	// busyTimeout is added to SQLite data source names, so concurrent
+	// transactions wait for each other instead of failing right away
+	busyTimeout = "_pragma=busy_timeout(5000)"
+
+	entryColumns = `user_id, public_key, allowed_ip, network, name, created_at, created_by, modified_at,
+		expires_at, disabled, labels, deactivation_reason, deactivated_at`
+)
+
+// Audit actions recorded in the audit_log table.
+const (
+	actionAdd        = "add"
+	actionUpdate     = "update"
+	actionDelete     = "delete"
+	actionDeactivate = "deactivate"
+	actionReactivate = "reactivate"
+)
+
+// Options configure the SQL storage.
+type Options struct {
+	// Driver is the name of the database/sql driver, defaults to
+	// DriverSQLite. The schema is written for SQLite.
+	Driver string
+	// DSN is the data source name, e.g. the path of the SQLite database
+	DSN string
+	// Allocator assigns allowed IPs to new entries, if provided
+	Allocator storage.Allocator
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (dbsql.Result, error)
+	Query(query string, args ...interface{}) (*dbsql.Rows, error)
+	QueryRow(query string, args ...interface{}) *dbsql.Row
+}
+
+type sqlStorage struct {
+	mutex        sync.Mutex
+	transactions storage.Transactions
+	db           *dbsql.DB
+	allocator    storage.Allocator
+	// tx contains all changes, which were not saved yet
+	tx *dbsql.Tx
+}
+
+// NewStorage opens the database, applies all pending schema migrations and
+// returns a storage.Storage operating on it. Public keys and allowed IPs are
+// unique by constraint. All changes made between two calls of Save are part
+// of a single transaction and recorded in the audit_log table.
+func NewStorage(opts *Options) (storage.Storage, error) {
+	driver := opts.Driver
+	if driver == "" {
+		driver = DriverSQLite
+	}
+	if opts.DSN == "" {
+		return nil, fmt.Errorf("data source name is required")
+	}
+	dsn := opts.DSN
+	if driver == DriverSQLite && !strings.Contains(dsn, "busy_timeout") {
+		if strings.Contains(dsn, "?") {
+			dsn += "&" + busyTimeout
+		} else {
+			dsn += "?" + busyTimeout
+		}
+	}
+	db, err := dbsql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrate(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &sqlStorage{db: db, allocator: opts.Allocator}, nil
+}
+
+// Add will add the entry to the user with the provided id. The changes are
+// only persisted once Save is called.
+func (s *sqlStorage) Add(id string, entry storage.Entry) error {
+	t := storage.Now()
+	return s.update(func(tx *dbsql.Tx) error {
+		var exists int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM entries WHERE public_key = ?`, entry.PublicKey).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return storage.ErrKeyExists
+		}
+		var allocator storage.Allocator
+		if s.allocator != nil {
+			used, err := allowedIPs(tx)
+			if err != nil {
+				return err
+			}
+			allocator = storage.AllocatorFunc(func([]string) (string, error) {
+				return storage.Allocate(s.allocator, entry.Network, used)
+			})
+		}
+		st := storage.State{}
+		if err := st.Add(id, entry, allocator, t); err != nil {
+			return err
+		}
+		entry = st[id][0]
+		// The primary key of allowed_ips only compares the stored values, so
+		// each prefix is canonicalized first
+		var prefixes []string
+		if entry.AllowedIP != "" {
+			prefixes, err = storage.AllowedIPPrefixes(entry.AllowedIP)
+			if err != nil {
+				return err
+			}
+			entry.AllowedIP = strings.Join(prefixes, ", ")
+		}
+		for _, prefix := range prefixes {
+			err = tx.QueryRow(`SELECT COUNT(*) FROM allowed_ips WHERE prefix = ?`, prefix).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if exists > 0 {
+				return fmt.Errorf("%w: %s", storage.ErrAllowedIPExists, prefix)
+			}
+		}
+		args, err := entryArgs(id, entry)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO entries (`+entryColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...)
+		if err != nil {
+			return err
+		}
+		if err := insertAllowedIPs(tx, entry.PublicKey, prefixes); err != nil {
+			return err
+		}
+		return audit(tx, t, id, entry.PublicKey, actionAdd, entry)
+	})
+}
+
+// Update will replace the metadata of the entry with the same public key of
+// the user with the provided id. Similar to Add the changes have to be
+// persisted using Save.
+func (s *sqlStorage) Update(id string, entry storage.Entry) error {
+	t := storage.Now()
+	return s.update(func(tx *dbsql.Tx) error {
+		entries, err := listEntries(tx, `WHERE user_id = ? AND public_key = ?`, id, entry.PublicKey)
+		if err != nil {
+			return err
+		}
+		st := storage.State{id: entries}
+		if err := st.Update(id, entry, t); err != nil {
+			return err
+		}
+		if err := updateEntry(tx, id, st[id][0]); err != nil {
+			return err
+		}
+		return audit(tx, t, id, entry.PublicKey, actionUpdate, st[id][0])
+	})
+}
+
+// Delete will remove the entry with the public key from the user with the
+// provided id. Similar to Add the changes have to be persisted using Save.
+func (s *sqlStorage) Delete(id, publicKey string) error {
+	t := storage.Now()
+	return s.update(func(tx *dbsql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM entries WHERE user_id = ? AND public_key = ?`, id, publicKey)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return storage.ErrKeyNotFound
+		}
+		if _, err := tx.Exec(`DELETE FROM allowed_ips WHERE public_key = ?`, publicKey); err != nil {
+			return err
+		}
+		return audit(tx, t, id, publicKey, actionDelete, nil)
+	})
+}
+
+// Deactivate will mark all active entries of the user with the provided id as
+// deactivated. Similar to Add the changes have to be persisted using Save.
+func (s *sqlStorage) Deactivate(id, reason string) error {
+	t := storage.Now()
+	return s.updateUser(id, actionDeactivate, reason, t, func(st storage.State) bool {
+		return st.Deactivate(id, reason, t)
+	})
+}
+
+// Reactivate will remove the deactivation of all entries of the user with the
+// provided id. Similar to Add the changes have to be persisted using Save.
+func (s *sqlStorage) Reactivate(id string) error {
+	t := storage.Now()
+	return s.updateUser(id, actionReactivate, "", t, func(st storage.State) bool {
+		return st.Reactivate(id, t)
+	})
+}
+
+// List returns the entries of the user including pending changes.
+func (s *sqlStorage) List(id string) ([]storage.Entry, error) {
+	var entries []storage.Entry
+	err := s.view(func(q querier) error {
+		var err error
+		entries, err = listEntries(q, `WHERE user_id = ?`, id)
+		return err
+	})
+	return entries, err
+}
+
+// ListAll returns the entries of all users including pending changes.
+func (s *sqlStorage) ListAll() (storage.State, error) {
+	var st storage.State
+	err := s.view(func(q querier) error {
+		var err error
+		st, err = listState(q)
+		return err
+	})
+	return st, err
+}
+
+// Export writes the persisted state without pending changes to w using the
+// format of the file and git storage.
+func (s *sqlStorage) Export(w io.Writer) error {
+	st, err := listState(s.db)
+	if err != nil {
+		return err
+	}
+	data, err := storage.Encode(st)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Save will commit all changes made since the last call in a single
+// transaction.
+func (s *sqlStorage) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Commit()
+	if err != nil {
+		_ = s.tx.Rollback()
+	}
+	s.tx = nil
+	return err
+}
+
+// Discard will roll back the pending transaction.
+func (s *sqlStorage) Discard() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Rollback()
+	s.tx = nil
+	return err
+}
+
+// Transact will run fn and save or discard its changes, see
+// storage.Storage for details.
+func (s *sqlStorage) Transact(fn func() error) error {
+	return s.transactions.Run(s, fn)
+}
+
+// Redeem records a redeemed handoff code until it expires and returns false
+// if it was already redeemed, so replicas sharing the database redeem each
+// code only once. It is independent of pending changes and implements
+// auth.Redemptions.
+func (s *sqlStorage) Redeem(code string, expiry time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM handoff_redemptions WHERE expiry < ?`, storage.Now().Unix()); err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	res, err := tx.Exec(`INSERT OR IGNORE INTO handoff_redemptions (code, expiry) VALUES (?, ?)`, code, expiry.Unix())
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return inserted == 1, nil
+}
+
+// Close will drop all pending changes and close the database.
+func (s *sqlStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx != nil {
+		_ = s.tx.Rollback()
+		s.tx = nil
+	}
+	return s.db.Close()
+}
+
+// update runs fn within the pending transaction, which is started if
+// necessary. Each call is wrapped in a savepoint, so a failed operation is
+// rolled back without affecting the operations applied before.
+func (s *sqlStorage) update(fn func(tx *dbsql.Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		s.tx = tx
+	}
+	if _, err := s.tx.Exec(`SAVEPOINT operation`); err != nil {
+		return err
+	}
+	if err := fn(s.tx); err != nil {
+		// ROLLBACK TO keeps the savepoint, so it has to be released as well
+		_, rerr := s.tx.Exec(`ROLLBACK TO SAVEPOINT operation`)
+		if rerr == nil {
+			_, rerr = s.tx.Exec(`RELEASE SAVEPOINT operation`)
+		}
+		if rerr != nil {
+			// The pending changes can not be trusted anymore
+			_ = s.tx.Rollback()
+			s.tx = nil
+			return fmt.Errorf("failed to roll back operation after error %q, dropped all pending changes: %w", err, rerr)
+		}
+		return err
+	}
+	_, err := s.tx.Exec(`RELEASE SAVEPOINT operation`)
+	return err
+}
+
+// updateUser applies fn to the entries of the user and writes back all
+// entries, if fn returns that any entry changed.
+func (s *sqlStorage) updateUser(id, action, details string, t time.Time, fn func(st storage.State) bool) error {
+	return s.update(func(tx *dbsql.Tx) error {
+		entries, err := listEntries(tx, `WHERE user_id = ?`, id)
+		if err != nil {
+			return err
+		}
+		st := storage.State{id: entries}
+		if !fn(st) {
+			return nil
+		}
+		for _, entry := range st[id] {
+			if err := updateEntry(tx, id, entry); err != nil {
+				return err
+			}
+		}
+		return audit(tx, t, id, "", action, details)
+	})
+}
+
+// view runs fn within the pending transaction, so pending changes are
+// visible, or directly on the database otherwise.
+func (s *sqlStorage) view(fn func(q querier) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return fn(s.db)
+}
+
+func updateEntry(tx *dbsql.Tx, id string, entry storage.Entry) error {
+	args, err := entryArgs(id, entry)
+	if err != nil {
+		return err
+	}
+	// The user and public key are used to identify the row instead
+	args = append(args[2:], id, entry.PublicKey)
+	_, err = tx.Exec(`UPDATE entries SET allowed_ip = ?, network = ?, name = ?, created_at = ?, created_by = ?,
+		modified_at = ?, expires_at = ?, disabled = ?, labels = ?, deactivation_reason = ?,
+		deactivated_at = ? WHERE user_id = ? AND public_key = ?`, args...)
+	return err
+}
+
+// audit records the action in the audit log. Details are encoded as JSON,
+// unless they are a string.
+func audit(tx *dbsql.Tx, t time.Time, id, publicKey, action string, details interface{}) error {
+	var text string
+	switch d := details.(type) {
+	case nil:
+	case string:
+		text = d
+	default:
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	_, err := tx.Exec(`INSERT INTO audit_log (time, user_id, public_key, action, details) VALUES (?, ?, ?, ?, ?)`,
+		formatTime(&t), id, publicKey, action, text)
+	return err
+}
+
+// entryArgs returns the values of entryColumns.
+func entryArgs(id string, entry storage.Entry) ([]interface{}, error) {
+	labels, err := json.Marshal(entry.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Labels == nil {
+		labels = []byte("{}")
+	}
+	var allowedIP interface{}
+	if entry.AllowedIP != "" {
+		allowedIP = entry.AllowedIP
+	}
+	var reason, deactivatedAt interface{}
+	if entry.Deactivation != nil {
+		reason = entry.Deactivation.Reason
+		deactivatedAt = formatTime(&entry.Deactivation.Time)
+	}
+	return []interface{}{
+		id, entry.PublicKey, allowedIP, entry.Network, entry.Name, formatTime(entry.CreatedAt), entry.CreatedBy,
+		formatTime(entry.ModifiedAt), formatTime(entry.ExpiresAt), entry.Disabled, string(labels),
+		reason, deactivatedAt,
+	}, nil
+}
+
+// listEntries returns the entries matching the condition in the order they
+// were added.
+func listEntries(q querier, condition string, args ...interface{}) ([]storage.Entry, error) {
+	entries := []storage.Entry{}
+	err := scanEntries(q, condition, args, func(id string, entry storage.Entry) {
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+func listState(q querier) (storage.State, error) {
+	st := storage.State{}
+	err := scanEntries(q, "", nil, func(id string, entry storage.Entry) {
+		st[id] = append(st[id], entry)
+	})
+	return st, err
+}
+
+func scanEntries(q querier, condition string, args []interface{}, fn func(id string, entry storage.Entry)) error {
+	rows, err := q.Query(`SELECT `+entryColumns+` FROM entries `+condition+` ORDER BY id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id                                              string
+			entry                                           storage.Entry
+			allowedIP, reason                               dbsql.NullString
+			createdAt, modifiedAt, expiresAt, deactivatedAt dbsql.NullString
+			labels                                          string
+		)
+		err := rows.Scan(&id, &entry.PublicKey, &allowedIP, &entry.Network, &entry.Name, &createdAt, &entry.CreatedBy,
+			&modifiedAt, &expiresAt, &entry.Disabled, &labels, &reason, &deactivatedAt)
+		if err != nil {
+			return err
+		}
+		entry.AllowedIP = allowedIP.String
+		for _, t := range []struct {
+			src dbsql.NullString
+			dst **time.Time
+		}{{createdAt, &entry.CreatedAt}, {modifiedAt, &entry.ModifiedAt}, {expiresAt, &entry.ExpiresAt}} {
+			if *t.dst, err = parseTime(t.src); err != nil {
+				return err
+			}
+		}
+		if err := json.Unmarshal([]byte(labels), &entry.Labels); err != nil {
+			return fmt.Errorf("failed to decode labels of %s: %w", entry.PublicKey, err)
+		}
+		if len(entry.Labels) == 0 {
+			entry.Labels = nil
+		}
+		if reason.Valid {
+			deactivated, err := parseTime(deactivatedAt)
+			if err != nil {
+				return err
+			}
+			entry.Deactivation = &storage.Deactivation{Reason: reason.String}
+			if deactivated != nil {
+				entry.Deactivation.Time = *deactivated
+			}
+		}
+		fn(id, entry)
+	}
+	return rows.Err()
+}
+
+// insertAllowedIPs adds the prefixes of the entry to allowed_ips, whose
+// primary key enforces the uniqueness of each prefix.
+func insertAllowedIPs(tx *dbsql.Tx, publicKey string, prefixes []string) error {
+	for _, prefix := range prefixes {
+		if _, err := tx.Exec(`INSERT INTO allowed_ips (prefix, public_key) VALUES (?, ?)`, prefix, publicKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowedIPPrefixes returns the canonical prefixes of the allowed IPs.
+// Invalid values, which might have been stored by previous versions, are
+// used as they are.
+func allowedIPPrefixes(allowedIP string) []string {
+	prefixes, err := storage.AllowedIPPrefixes(allowedIP)
+	if err != nil {
+		return []string{allowedIP}
+	}
+	return prefixes
+}
+
+func allowedIPs(q querier) ([]string, error) {
+	rows, err := q.Query(`SELECT allowed_ip FROM entries WHERE allowed_ip IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	used := []string{}
+	for rows.Next() {
+		var allowedIP string
+		if err := rows.Scan(&allowedIP); err != nil {
+			return nil, err
+		}
+		used = append(used, allowedIP)
+	}
+	return used, rows.Err()
+}
+
+// formatTime encodes times as RFC 3339 in UTC, so they are readable and can
+// be compared in queries.
+func formatTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(s dbsql.NullString) (*time.Time, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sql
+
+import (
+	"bytes"
+	dbsql "database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kubism/smorgasbord/pkg/ipam"
+	"github.com/kubism/smorgasbord/pkg/storage"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// staticAllocator always returns the same allowed IP.
+type staticAllocator string
+
+func (a staticAllocator) Allocate(used []string) (string, error) {
+	return string(a), nil
+}
+
+var _ = Describe("Storage", func() {
+	var (
+		dir  string
+		path string
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "smorgasbord.db")
+	})
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+	It("persists entries in the order they were added", func() {
+		allocator, err := ipam.New([]string{"10.0.0.0/24"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		s, err := NewStorage(&Options{DSN: path, Allocator: allocator})
+		Expect(err).ToNot(HaveOccurred())
+		for _, key := range []string{"c", "a", "b"} {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: key})).To(Succeed())
+		}
+		Expect(s.Add("b@test.com", storage.Entry{PublicKey: "a"})).To(Equal(storage.ErrKeyExists))
+		Expect(s.Add("b@test.com", storage.Entry{PublicKey: "d", Name: "laptop", Labels: map[string]string{"os": "linux"}})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+		s, err = NewStorage(&Options{DSN: path, Allocator: allocator})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		entries, err := s.List("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(3))
+		for i, key := range []string{"c", "a", "b"} {
+			Expect(entries[i].PublicKey).To(Equal(key))
+			Expect(entries[i].CreatedBy).To(Equal("a@test.com"))
+			Expect(entries[i].CreatedAt).ToNot(BeNil())
+			Expect(entries[i].Labels).To(BeNil())
+		}
+		st, err := s.ListAll()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).To(HaveLen(2))
+		Expect(st["b@test.com"][0].Name).To(Equal("laptop"))
+		Expect(st["b@test.com"][0].Labels).To(Equal(map[string]string{"os": "linux"}))
+		Expect(st.AllowedIPs()).To(ConsistOf("10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32", "10.0.0.4/32"))
+		Expect(s.List("unknown@test.com")).To(BeEmpty())
+	})
+	It("updates, deactivates and deletes entries", func() {
+		s, err := NewStorage(&Options{DSN: path})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(s.Update("a@test.com", storage.Entry{PublicKey: "a", Name: "laptop", Disabled: true})).To(Succeed())
+		Expect(s.Update("b@test.com", storage.Entry{PublicKey: "a"})).To(Equal(storage.ErrKeyNotFound))
+		Expect(s.Deactivate("a@test.com", "test")).To(Succeed())
+		entries, err := s.List("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[0].Name).To(Equal("laptop"))
+		Expect(entries[0].Disabled).To(BeTrue())
+		Expect(entries[0].Deactivation.Reason).To(Equal("test"))
+		Expect(entries[0].Deactivation.Time.IsZero()).To(BeFalse())
+		Expect(entries[1].Deactivation.Reason).To(Equal("test"))
+		Expect(s.Reactivate("a@test.com")).To(Succeed())
+		Expect(s.List("a@test.com")).To(ConsistOf(
+			WithTransform(func(e storage.Entry) bool { return e.Deactivation == nil }, BeTrue()),
+			WithTransform(func(e storage.Entry) bool { return e.Deactivation == nil }, BeTrue()),
+		))
+		Expect(s.Delete("b@test.com", "a")).To(Equal(storage.ErrKeyNotFound))
+		Expect(s.Delete("a@test.com", "a")).To(Succeed())
+		Expect(s.Delete("a@test.com", "b")).To(Succeed())
+		Expect(s.Delete("a@test.com", "b")).To(Equal(storage.ErrKeyNotFound))
+		Expect(s.Save()).To(Succeed())
+		Expect(s.ListAll()).To(BeEmpty())
+	})
+	It("commits all pending changes in a single transaction", func() {
+		s, err := NewStorage(&Options{DSN: path})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		// Pending changes are visible, but not exported
+		Expect(s.ListAll()).To(HaveLen(2))
+		var buf bytes.Buffer
+		Expect(s.(storage.Exporter).Export(&buf)).To(Succeed())
+		st, _, err := storage.Decode(buf.Bytes())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).To(BeEmpty())
+		// Closing drops the pending changes
+		Expect(s.Close()).To(Succeed())
+		s, err = NewStorage(&Options{DSN: path})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.ListAll()).To(BeEmpty())
+	})
+	It("enforces unique allowed IPs", func() {
+		s, err := NewStorage(&Options{DSN: path, Allocator: staticAllocator("10.0.0.1/32")})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(MatchError(storage.ErrAllowedIPExists))
+		// The failed addition did not modify the transaction
+		Expect(s.List("a@test.com")).To(HaveLen(1))
+		Expect(s.Delete("a@test.com", "a")).To(Succeed())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		entries, err := s.List("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].AllowedIP).To(Equal("10.0.0.1/32"))
+	})
+	It("canonicalizes allowed IPs", func() {
+		allowedIP := "10.0.0.1/32"
+		s, err := NewStorage(&Options{DSN: path, Allocator: storage.AllocatorFunc(func([]string) (string, error) {
+			return allowedIP, nil
+		})})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		for _, allowedIP = range []string{" 10.0.0.1/32 ", "10.0.0.1"} {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(MatchError(storage.ErrAllowedIPExists))
+		}
+		allowedIP = "10.0.0.2"
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		entries, err := s.List("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[1].AllowedIP).To(Equal("10.0.0.2/32"))
+	})
+	It("enforces unique prefixes of dual-stack allowed IPs", func() {
+		allowedIP := "10.0.0.1/32, fd00::1/128"
+		s, err := NewStorage(&Options{DSN: path, Allocator: storage.AllocatorFunc(func([]string) (string, error) {
+			return allowedIP, nil
+		})})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		for _, allowedIP = range []string{"10.0.0.2/32, FD00:0::1", "10.0.0.1, fd00::2/128"} {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(MatchError(storage.ErrAllowedIPExists))
+		}
+		allowedIP = "10.0.0.2, fd00::2"
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+		entries, err := s.List("a@test.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[1].AllowedIP).To(Equal("10.0.0.2/32, fd00::2/128"))
+		// Prefixes of deleted entries can be used again
+		Expect(s.Delete("a@test.com", "a")).To(Succeed())
+		allowedIP = "10.0.0.1, fd00::1"
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "c"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+	})
+	It("indexes allowed IPs of existing entries", func() {
+		db, err := dbsql.Open(DriverSQLite, path)
+		Expect(err).ToNot(HaveOccurred())
+		defer db.Close()
+		_, err = db.Exec(`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, description TEXT NOT NULL, applied_at TEXT NOT NULL)`)
+		Expect(err).ToNot(HaveOccurred())
+		for _, m := range migrations[:2] {
+			Expect(applyMigration(db, m)).To(Succeed())
+		}
+		_, err = db.Exec(`INSERT INTO entries (user_id, public_key, allowed_ip) VALUES (?, ?, ?)`, "a@test.com", "a", "10.0.0.1/32, fd00::1/128")
+		Expect(err).ToNot(HaveOccurred())
+		s, err := NewStorage(&Options{DSN: path, Allocator: staticAllocator("10.0.0.2/32, fd00::1/128")})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(MatchError(storage.ErrAllowedIPExists))
+	})
+	It("enforces unique public keys and allowed IPs by constraints", func() {
+		s, err := NewStorage(&Options{DSN: path})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Close()).To(Succeed())
+		db, err := dbsql.Open(DriverSQLite, path)
+		Expect(err).ToNot(HaveOccurred())
+		defer db.Close()
+		insert := `INSERT INTO entries (user_id, public_key, allowed_ip) VALUES (?, ?, ?)`
+		_, err = db.Exec(insert, "a@test.com", "a", "10.0.0.1/32")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = db.Exec(insert, "b@test.com", "a", "10.0.0.2/32")
+		Expect(err).To(MatchError(ContainSubstring("UNIQUE")))
+		_, err = db.Exec(insert, "b@test.com", "b", "10.0.0.1/32")
+		Expect(err).To(MatchError(ContainSubstring("UNIQUE")))
+		insert = `INSERT INTO allowed_ips (prefix, public_key) VALUES (?, ?)`
+		_, err = db.Exec(insert, "fd00::1/128", "a")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = db.Exec(insert, "fd00::1/128", "b")
+		Expect(err).To(MatchError(ContainSubstring("UNIQUE")))
+		// Entries without allowed IP do not conflict
+		insert = `INSERT INTO entries (user_id, public_key, allowed_ip) VALUES (?, ?, ?)`
+		_, err = db.Exec(insert, "b@test.com", "c", nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = db.Exec(insert, "b@test.com", "d", nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+	It("records changes in the audit log", func() {
+		s, err := NewStorage(&Options{DSN: path})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		Expect(s.Update("a@test.com", storage.Entry{PublicKey: "a", Name: "laptop"})).To(Succeed())
+		Expect(s.Deactivate("a@test.com", "left")).To(Succeed())
+		// Nothing changed, so nothing is recorded
+		Expect(s.Deactivate("a@test.com", "left")).To(Succeed())
+		Expect(s.Reactivate("a@test.com")).To(Succeed())
+		Expect(s.Delete("a@test.com", "a")).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+		db, err := dbsql.Open(DriverSQLite, path)
+		Expect(err).ToNot(HaveOccurred())
+		defer db.Close()
+		rows, err := db.Query(`SELECT user_id, action, details FROM audit_log ORDER BY id`)
+		Expect(err).ToNot(HaveOccurred())
+		defer rows.Close()
+		actions := []string{}
+		for rows.Next() {
+			var id, action, details string
+			Expect(rows.Scan(&id, &action, &details)).To(Succeed())
+			Expect(id).To(Equal("a@test.com"))
+			if action == actionDeactivate {
+				Expect(details).To(Equal("left"))
+			}
+			actions = append(actions, action)
+		}
+		Expect(rows.Err()).ToNot(HaveOccurred())
+		Expect(actions).To(Equal([]string{actionAdd, actionUpdate, actionDeactivate, actionReactivate, actionDelete}))
+	})
+	It("drops partial changes of failed operations", func() {
+		s, err := NewStorage(&Options{DSN: path})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+		// Operations failing after writing, e.g. while recording the audit
+		// log, are rolled back, while previous operations are kept
+		err = s.(*sqlStorage).update(func(tx *dbsql.Tx) error {
+			args, err := entryArgs("b@test.com", storage.Entry{PublicKey: "b"})
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT INTO entries (`+entryColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...); err != nil {
+				return err
+			}
+			return fmt.Errorf("failed")
+		})
+		Expect(err).To(MatchError("failed"))
+		Expect(s.Add("c@test.com", storage.Entry{PublicKey: "c"})).To(Succeed())
+		Expect(s.Save()).To(Succeed())
+		st, err := s.ListAll()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st).To(HaveLen(2))
+		Expect(st).To(HaveKey("a@test.com"))
+		Expect(st).To(HaveKey("c@test.com"))
+	})
+	It("redeems handoff codes once across storages", func() {
+		s, err := NewStorage(&Options{DSN: path})
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		replica, err := NewStorage(&Options{DSN: path})
+		Expect(err).ToNot(HaveOccurred())
+		defer replica.Close()
+		expiry := time.Now().Add(time.Minute)
+		Expect(s.(*sqlStorage).Redeem("code", expiry)).To(BeTrue())
+		Expect(replica.(*sqlStorage).Redeem("code", expiry)).To(BeFalse())
+		Expect(s.(*sqlStorage).Redeem("code", expiry)).To(BeFalse())
+		// Expired redemptions are removed by later redemptions
+		Expect(s.(*sqlStorage).Redeem("expired", time.Now().Add(-time.Minute))).To(BeTrue())
+		Expect(replica.(*sqlStorage).Redeem("other", expiry)).To(BeTrue())
+		db := s.(*sqlStorage).db
+		var count int
+		Expect(db.QueryRow(`SELECT COUNT(*) FROM handoff_redemptions`).Scan(&count)).To(Succeed())
+		Expect(count).To(Equal(2))
+	})
+	It("applies migrations once", func() {
+		s, err := NewStorage(&Options{DSN: path})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Close()).To(Succeed())
+		db, err := dbsql.Open(DriverSQLite, path)
+		Expect(err).ToNot(HaveOccurred())
+		defer db.Close()
+		Expect(migrate(db)).To(Equal(latestVersion()))
+		var count int
+		Expect(db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&count)).To(Succeed())
+		Expect(count).To(Equal(len(migrations)))
+		// Schemas of newer versions are rejected
+		_, err = db.Exec(`INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`,
+			latestVersion()+1, "future", "")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = NewStorage(&Options{DSN: path})
+		Expect(err).To(MatchError(ContainSubstring("newer")))
+		_, err = NewStorage(&Options{})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,192 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// State maps the ids of users to their entries. Its methods implement the
+// semantics of the modifications of Storage, so all implementations behave
+// alike.
+type State map[string][]Entry
+
+// AllowedIPs returns the allowed IPs of all entries, which are not empty.
+func (s State) AllowedIPs() []string {
+	allowedIPs := []string{}
+	for _, entries := range s {
+		for _, entry := range entries {
+			if entry.AllowedIP != "" {
+				allowedIPs = append(allowedIPs, entry.AllowedIP)
+			}
+		}
+	}
+	return allowedIPs
+}
+
+// allowedIPPrefixes returns the canonical prefixes of the allowed IPs of all
+// entries. Invalid allowed IPs are ignored.
+func (s State) allowedIPPrefixes() map[string]bool {
+	used := map[string]bool{}
+	for _, allowedIP := range s.AllowedIPs() {
+		prefixes, _ := AllowedIPPrefixes(allowedIP)
+		for _, prefix := range prefixes {
+			used[prefix] = true
+		}
+	}
+	return used
+}
+
+// Add appends the entry to the user with the provided id and sets its
+// metadata, see Storage for details. ErrKeyExists is returned if any user
+// already owns an entry with the same public key.
+//
+// If an allocator is provided, the allowed IP is allocated within the
+// network of the entry and canonicalized. ErrAllowedIPExists is returned if
+// any of its prefixes is already in use.
+func (s State) Add(id string, entry Entry, allocator Allocator, t time.Time) error {
+	for _, entries := range s {
+		for _, e := range entries {
+			if e.PublicKey == entry.PublicKey {
+				return ErrKeyExists
+			}
+		}
+	}
+	entry.AllowedIP = ""
+	entry.Deactivation = nil
+	entry.CreatedAt = timePtr(t)
+	entry.ModifiedAt = timePtr(t)
+	if entry.CreatedBy == "" {
+		entry.CreatedBy = id
+	}
+	if allocator != nil {
+		allowedIP, err := Allocate(allocator, entry.Network, s.AllowedIPs())
+		if err != nil {
+			return fmt.Errorf("failed to allocate allowed IP: %w", err)
+		}
+		if allowedIP != "" {
+			prefixes, err := AllowedIPPrefixes(allowedIP)
+			if err != nil {
+				return fmt.Errorf("failed to allocate allowed IP: %w", err)
+			}
+			used := s.allowedIPPrefixes()
+			for _, prefix := range prefixes {
+				if used[prefix] {
+					return fmt.Errorf("%w: %s", ErrAllowedIPExists, prefix)
+				}
+			}
+			allowedIP = strings.Join(prefixes, ", ")
+		}
+		entry.AllowedIP = allowedIP
+	}
+	s[id] = append(s[id], entry)
+	return nil
+}
+
+// Update replaces the metadata of the entry of the user with the same public
+// key, see Storage for details. ErrKeyNotFound is returned if the user does
+// not own such an entry.
+func (s State) Update(id string, entry Entry, t time.Time) error {
+	for i, e := range s[id] {
+		if e.PublicKey != entry.PublicKey {
+			continue
+		}
+		e.Name = entry.Name
+		e.ExpiresAt = entry.ExpiresAt
+		e.Disabled = entry.Disabled
+		e.Labels = entry.Labels
+		e.ModifiedAt = timePtr(t)
+		s[id][i] = e
+		return nil
+	}
+	return ErrKeyNotFound
+}
+
+// Delete removes the entry with the public key from the user. Users without
+// entries are removed. ErrKeyNotFound is returned if the user does not own
+// such an entry.
+func (s State) Delete(id, publicKey string) error {
+	entries := s[id]
+	for i, e := range entries {
+		if e.PublicKey != publicKey {
+			continue
+		}
+		entries = append(entries[:i], entries[i+1:]...)
+		if len(entries) == 0 {
+			delete(s, id)
+		} else {
+			s[id] = entries
+		}
+		return nil
+	}
+	return ErrKeyNotFound
+}
+
+// Deactivate marks all entries of the user, which are not deactivated yet,
+// as deactivated and returns whether any entry changed.
+func (s State) Deactivate(id, reason string, t time.Time) bool {
+	changed := false
+	for i, e := range s[id] {
+		if e.Deactivation != nil {
+			continue
+		}
+		e.Deactivation = &Deactivation{Reason: reason, Time: t}
+		e.ModifiedAt = timePtr(t)
+		s[id][i] = e
+		changed = true
+	}
+	return changed
+}
+
+// Reactivate removes the deactivation of all entries of the user and returns
+// whether any entry changed.
+func (s State) Reactivate(id string, t time.Time) bool {
+	changed := false
+	for i, e := range s[id] {
+		if e.Deactivation == nil {
+			continue
+		}
+		e.Deactivation = nil
+		e.ModifiedAt = timePtr(t)
+		s[id][i] = e
+		changed = true
+	}
+	return changed
+}
+
+// List returns the entries of the user or an empty slice, if the user does
+// not own any entries.
+func (s State) List(id string) []Entry {
+	entries, ok := s[id]
+	if !ok || entries == nil {
+		return []Entry{}
+	}
+	return entries
+}
+
+// Now returns the current time truncated to seconds, which is used by the
+// implementations for the metadata of entries to keep the persisted state
+// readable.
+func Now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
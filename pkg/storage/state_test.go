@@ -0,0 +1,96 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type testAllocator struct {
+	next int
+}
+
+func (a *testAllocator) Allocate(used []string) (string, error) {
+	a.next++
+	return fmt.Sprintf("10.0.0.%d/32", a.next), nil
+}
+
+// networkAllocator returns a fixed allowed IP per network and none for the
+// default network.
+type networkAllocator struct{}
+
+func (networkAllocator) Allocate(used []string) (string, error) {
+	return "", fmt.Errorf("network is required")
+}
+
+func (networkAllocator) AllocateFor(network string, used []string) (string, error) {
+	return map[string]string{"office": "10.1.0.1/32"}[network], nil
+}
+
+var _ = Describe("State", func() {
+	t := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	It("adds, updates and deletes entries", func() {
+		st := State{}
+		Expect(st.Add("a@test.com", Entry{PublicKey: "a", AllowedIP: "ignored", Name: "laptop"}, &testAllocator{}, t)).To(Succeed())
+		Expect(st.List("a@test.com")).To(Equal([]Entry{{
+			PublicKey:  "a",
+			AllowedIP:  "10.0.0.1/32",
+			Name:       "laptop",
+			CreatedAt:  &t,
+			CreatedBy:  "a@test.com",
+			ModifiedAt: &t,
+		}}))
+		Expect(st.Add("b@test.com", Entry{PublicKey: "a"}, nil, t)).To(Equal(ErrKeyExists))
+		later := t.Add(time.Hour)
+		Expect(st.Update("a@test.com", Entry{PublicKey: "a", Disabled: true}, later)).To(Succeed())
+		entry := st.List("a@test.com")[0]
+		Expect(entry.Name).To(BeEmpty())
+		Expect(entry.Disabled).To(BeTrue())
+		Expect(*entry.ModifiedAt).To(Equal(later))
+		Expect(*entry.CreatedAt).To(Equal(t))
+		Expect(st.Update("b@test.com", Entry{PublicKey: "a"}, later)).To(Equal(ErrKeyNotFound))
+		Expect(st.Delete("b@test.com", "a")).To(Equal(ErrKeyNotFound))
+		Expect(st.Delete("a@test.com", "a")).To(Succeed())
+		Expect(st).To(BeEmpty())
+		Expect(st.List("a@test.com")).To(Equal([]Entry{}))
+	})
+	It("allocates allowed IPs within the network", func() {
+		st := State{}
+		Expect(st.Add("a@test.com", Entry{PublicKey: "a", Network: "office"}, networkAllocator{}, t)).To(Succeed())
+		Expect(st.Add("a@test.com", Entry{PublicKey: "b"}, networkAllocator{}, t)).To(Succeed())
+		Expect(st.List("a@test.com")[0].AllowedIP).To(Equal("10.1.0.1/32"))
+		Expect(st.List("a@test.com")[1].AllowedIP).To(BeEmpty())
+		Expect(st.List("a@test.com")[1].NetworkName()).To(Equal(DefaultNetwork))
+		// The network is kept by updates
+		Expect(st.Update("a@test.com", Entry{PublicKey: "a"}, t)).To(Succeed())
+		Expect(st.List("a@test.com")[0].Network).To(Equal("office"))
+	})
+	It("deactivates and reactivates entries", func() {
+		st := State{}
+		Expect(st.Add("a@test.com", Entry{PublicKey: "a"}, nil, t)).To(Succeed())
+		Expect(st.Deactivate("a@test.com", "test", t)).To(BeTrue())
+		Expect(st.Deactivate("a@test.com", "again", t)).To(BeFalse())
+		Expect(st.List("a@test.com")[0].Deactivation).To(Equal(&Deactivation{Reason: "test", Time: t}))
+		Expect(st.Reactivate("a@test.com", t)).To(BeTrue())
+		Expect(st.Reactivate("a@test.com", t)).To(BeFalse())
+		Expect(st.Deactivate("unknown@test.com", "test", t)).To(BeFalse())
+	})
+})
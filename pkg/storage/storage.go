@@ -16,15 +16,213 @@ limitations under the License.
 
 package storage
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNetwork is the name of the network of entries without network.
+const DefaultNetwork = "default"
+
+var (
+	// ErrKeyExists is returned if a public key is added, which is already
+	// known to the storage (regardless of the user it belongs to).
+	ErrKeyExists = errors.New("public key already exists")
+	// ErrKeyNotFound is returned if a public key is supposed to be removed or
+	// modified, but the user does not own an entry with the public key.
+	ErrKeyNotFound = errors.New("public key not found")
+	// ErrAllowedIPExists is returned if an entry is added, whose allowed IP
+	// is already used by another entry.
+	ErrAllowedIPExists = errors.New("allowed IP already in use")
+)
+
+// ConflictError is returned by Save if some of the changes could not be
+// applied, because the same public keys were modified concurrently, e.g. by
+// another server replica. All other changes were persisted successfully.
+type ConflictError struct {
+	Changes []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflicting concurrent changes: %s", strings.Join(e.Changes, "; "))
+}
+
+// Entry is a single peer of a user. Besides the public key and allowed IP,
+// which are required to configure wireguard, it contains metadata helping
+// admins and users to identify the device. All metadata is optional, so
+// entries persisted by previous versions can still be decoded.
 type Entry struct {
 	PublicKey string `json:"publicKey"`
 	AllowedIP string `json:"allowedIP"`
+	// Network the entry belongs to. Entries without network, e.g. persisted
+	// by previous versions, belong to DefaultNetwork.
+	Network string `json:"network,omitempty"`
+	// Name of the device, e.g. the hostname of a laptop
+	Name string `json:"name,omitempty"`
+	// CreatedAt is the time the entry was added
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	// CreatedBy is the identity, which added the entry
+	CreatedBy string `json:"createdBy,omitempty"`
+	// ModifiedAt is the time the entry was changed last
+	ModifiedAt *time.Time `json:"modifiedAt,omitempty"`
+	// ExpiresAt is the time after which the entry is no longer active
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Disabled entries are kept, but not active
+	Disabled bool `json:"disabled,omitempty"`
+	// Labels are free-form key-value pairs, e.g. to group devices
+	Labels map[string]string `json:"labels,omitempty"`
+	// Deactivation is set if the entry was deactivated, e.g. because the
+	// user was removed from the identity provider. Deactivated entries are
+	// kept, but not active.
+	Deactivation *Deactivation `json:"deactivation,omitempty"`
+}
+
+// Active returns whether the entry is neither disabled, expired nor
+// deactivated and should therefore be configured by the agent.
+func (e Entry) Active() bool {
+	if e.Disabled || e.Deactivation != nil {
+		return false
+	}
+	return e.ExpiresAt == nil || time.Now().Before(*e.ExpiresAt)
+}
+
+// NetworkName returns the name of the network the entry belongs to.
+func (e Entry) NetworkName() string {
+	if e.Network == "" {
+		return DefaultNetwork
+	}
+	return e.Network
+}
+
+// Deactivation describes why and when an entry was deactivated.
+type Deactivation struct {
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// Allocator assigns the allowed IP of new entries based on the allowed IPs,
+// which are already in use. It is implemented by ipam.IPAM.
+type Allocator interface {
+	Allocate(used []string) (string, error)
+}
+
+// NetworkAllocator is implemented by allocators, which assign allowed IPs
+// depending on the network of the entry, e.g. network.Networks.
+type NetworkAllocator interface {
+	AllocateFor(network string, used []string) (string, error)
+}
+
+// Allocate assigns an allowed IP for a new entry of the network using the
+// allocator. The network is only considered if the allocator implements
+// NetworkAllocator.
+func Allocate(a Allocator, network string, used []string) (string, error) {
+	if na, ok := a.(NetworkAllocator); ok {
+		return na.AllocateFor(network, used)
+	}
+	return a.Allocate(used)
+}
+
+// AllocatorFunc allows to use a function as Allocator.
+type AllocatorFunc func(used []string) (string, error)
+
+// Allocate calls f.
+func (f AllocatorFunc) Allocate(used []string) (string, error) {
+	return f(used)
+}
+
+// CanonicalAllowedIP returns the canonical form of the allowed IPs of an
+// entry, which might contain multiple comma-separated prefixes, e.g.
+// "10.0.0.1/32, fd00::1/128" as allocated by ipam.IPAM. See
+// AllowedIPPrefixes for how each prefix is canonicalized.
+func CanonicalAllowedIP(allowedIP string) (string, error) {
+	prefixes, err := AllowedIPPrefixes(allowedIP)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(prefixes, ", "), nil
+}
+
+// AllowedIPPrefixes splits the comma-separated allowed IPs of an entry and
+// returns the canonical form of each prefix, so different notations of the
+// same network, e.g. with surrounding whitespace, host bits set or
+// non-canonical IPv6 addresses, are considered equal. Single addresses are
+// treated as host networks.
+func AllowedIPPrefixes(allowedIP string) ([]string, error) {
+	values := strings.Split(allowedIP, ",")
+	prefixes := make([]string, 0, len(values))
+	for _, value := range values {
+		s := strings.TrimSpace(value)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allowed IP %q", allowedIP)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed IP %q", allowedIP)
+		}
+		prefixes = append(prefixes, ipNet.String())
+	}
+	return prefixes, nil
 }
 
 type Storage interface {
-	Add(id, publicKey string) error
+	// Add adds the entry to the user with the provided id. The allowed IP,
+	// creation and modification time are set by the storage. If CreatedBy is
+	// empty, the id is used.
+	Add(id string, entry Entry) error
+	// Update replaces the name, expiry, disabled flag and labels of the entry
+	// of the user with the same public key.
+	Update(id string, entry Entry) error
 	Delete(id, publicKey string) error
 	List(id string) ([]Entry, error)
+	// ListAll returns the entries of all users, e.g. to derive the
+	// configuration of the wireguard server.
+	ListAll() (State, error)
+	// Deactivate marks all active entries of the user as deactivated. Similar
+	// to Add and Delete the changes have to be persisted using Save.
+	Deactivate(id, reason string) error
+	// Reactivate removes the deactivation of all entries of the user.
+	Reactivate(id string) error
 	Save() error
+	// Discard drops all changes, which were not saved yet.
+	Discard() error
+	// Transact runs fn, which is expected to change the storage, and saves
+	// the changes. Transactions are serialized, so the changes of concurrent
+	// transactions do not interfere. If fn or Save fails, all changes, which
+	// were not saved, are discarded.
+	Transact(fn func() error) error
 	Close() error
 }
+
+// Transactions serializes the transactions of a storage and can be embedded
+// to implement Storage.Transact based on Save and Discard.
+type Transactions struct {
+	mutex sync.Mutex
+}
+
+// Run runs fn as transaction of the storage, see Storage.Transact.
+func (t *Transactions) Run(s Storage, fn func() error) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	err := fn()
+	if err == nil {
+		err = s.Save()
+	}
+	if err != nil {
+		if derr := s.Discard(); derr != nil {
+			return fmt.Errorf("%w (failed to discard changes: %v)", err, derr)
+		}
+	}
+	return err
+}
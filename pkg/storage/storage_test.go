@@ -0,0 +1,69 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Entry", func() {
+	It("decodes entries without metadata", func() {
+		st := State{}
+		Expect(json.Unmarshal([]byte(`{"a@test.com":[{"publicKey":"a","allowedIP":"10.0.0.1/32"}]}`), &st)).To(Succeed())
+		Expect(st).To(Equal(State{"a@test.com": {{PublicKey: "a", AllowedIP: "10.0.0.1/32"}}}))
+		Expect(st["a@test.com"][0].Active()).To(BeTrue())
+		// Omitted metadata is not added when encoded again
+		data, err := json.Marshal(st)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"a@test.com":[{"publicKey":"a","allowedIP":"10.0.0.1/32"}]}`))
+	})
+	It("is only active if not disabled, expired or deactivated", func() {
+		past := time.Now().Add(-time.Minute)
+		future := time.Now().Add(time.Minute)
+		Expect(Entry{ExpiresAt: &future}.Active()).To(BeTrue())
+		Expect(Entry{ExpiresAt: &past}.Active()).To(BeFalse())
+		Expect(Entry{Disabled: true}.Active()).To(BeFalse())
+		Expect(Entry{Deactivation: &Deactivation{Reason: "test"}}.Active()).To(BeFalse())
+	})
+})
+
+var _ = Describe("CanonicalAllowedIP", func() {
+	It("canonicalizes allowed IPs", func() {
+		for allowedIP, expected := range map[string]string{
+			"10.0.0.1/32":           "10.0.0.1/32",
+			" 10.0.0.1/32 ":         "10.0.0.1/32",
+			"10.0.0.1":              "10.0.0.1/32",
+			"10.0.0.5/24":           "10.0.0.0/24",
+			"fd00::1":               "fd00::1/128",
+			"FD00::1/128":           "fd00::1/128",
+			"10.0.0.1/32,fd00:0::1": "10.0.0.1/32, fd00::1/128",
+		} {
+			Expect(CanonicalAllowedIP(allowedIP)).To(Equal(expected), allowedIP)
+		}
+		_, err := CanonicalAllowedIP("invalid")
+		Expect(err).To(HaveOccurred())
+		_, err = CanonicalAllowedIP("10.0.0.1/33")
+		Expect(err).To(HaveOccurred())
+		_, err = CanonicalAllowedIP("10.0.0.1/32, ")
+		Expect(err).To(HaveOccurred())
+		Expect(AllowedIPPrefixes(" 10.0.0.1/32, FD00::1/128")).To(Equal([]string{"10.0.0.1/32", "fd00::1/128"}))
+	})
+})
@@ -0,0 +1,361 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package storagetest provides a conformance test suite, which verifies that
+// implementations of storage.Storage behave alike.
+package storagetest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kubism/smorgasbord/pkg/ipam"
+	"github.com/kubism/smorgasbord/pkg/storage"
+
+	"github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Opener returns a new storage instance using the optional allocator.
+type Opener func(allocator storage.Allocator) (storage.Storage, error)
+
+// Backend describes how the conformance tests can set up storages.
+type Backend struct {
+	// Setup prepares a new empty location, e.g. a repository or file, and
+	// returns an Opener for storages operating on it as well as a function
+	// removing the location. It is called before each test.
+	Setup func() (Opener, func())
+	// ConcurrentChanges must be set if multiple storages can have pending
+	// changes on the same location at the same time, e.g. because each
+	// one is used by another server replica.
+	ConcurrentChanges bool
+}
+
+// DescribeBackend registers the conformance tests of the backend in the
+// ginkgo suite of the calling package.
+func DescribeBackend(name string, b Backend) bool {
+	return ginkgo.Describe(fmt.Sprintf("%s conformance", name), func() {
+		var (
+			open    Opener
+			cleanup func()
+			s       storage.Storage
+		)
+		ginkgo.BeforeEach(func() {
+			open, cleanup = b.Setup()
+			s = mustOpen(open, nil)
+		})
+		ginkgo.AfterEach(func() {
+			Expect(s.Close()).To(Succeed())
+			cleanup()
+		})
+		ginkgo.It("adds and lists entries in the order they were added", func() {
+			for _, key := range []string{"c", "a", "b"} {
+				Expect(s.Add("a@test.com", storage.Entry{PublicKey: key})).To(Succeed())
+			}
+			Expect(s.Add("b@test.com", storage.Entry{PublicKey: "d", Name: "laptop", CreatedBy: "admin@test.com"})).To(Succeed())
+			entries, err := s.List("a@test.com")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys(entries)).To(Equal([]string{"c", "a", "b"}))
+			for _, entry := range entries {
+				Expect(entry.CreatedBy).To(Equal("a@test.com"))
+				Expect(entry.CreatedAt).ToNot(BeNil())
+				Expect(entry.ModifiedAt).To(Equal(entry.CreatedAt))
+				Expect(entry.Active()).To(BeTrue())
+			}
+			st, err := s.ListAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st).To(HaveLen(2))
+			Expect(st["a@test.com"]).To(Equal(entries))
+			Expect(st["b@test.com"]).To(HaveLen(1))
+			Expect(st["b@test.com"][0].Name).To(Equal("laptop"))
+			Expect(st["b@test.com"][0].CreatedBy).To(Equal("admin@test.com"))
+		})
+		ginkgo.It("rejects duplicate public keys", func() {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(MatchError(storage.ErrKeyExists))
+			Expect(s.Add("b@test.com", storage.Entry{PublicKey: "a"})).To(MatchError(storage.ErrKeyExists))
+			Expect(s.Save()).To(Succeed())
+			Expect(s.Add("b@test.com", storage.Entry{PublicKey: "a"})).To(MatchError(storage.ErrKeyExists))
+			Expect(s.ListAll()).To(Equal(storage.State{"a@test.com": mustList(s, "a@test.com")}))
+		})
+		ginkgo.It("handles unknown users", func() {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+			Expect(s.List("unknown@test.com")).To(BeEmpty())
+			Expect(s.Update("unknown@test.com", storage.Entry{PublicKey: "a"})).To(MatchError(storage.ErrKeyNotFound))
+			Expect(s.Delete("unknown@test.com", "a")).To(MatchError(storage.ErrKeyNotFound))
+			Expect(s.Deactivate("unknown@test.com", "test")).To(Succeed())
+			Expect(s.Reactivate("unknown@test.com")).To(Succeed())
+			Expect(s.ListAll()).ToNot(HaveKey("unknown@test.com"))
+		})
+		ginkgo.It("deletes only entries owned by the user", func() {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			Expect(s.Delete("b@test.com", "a")).To(MatchError(storage.ErrKeyNotFound))
+			Expect(s.Delete("a@test.com", "unknown")).To(MatchError(storage.ErrKeyNotFound))
+			Expect(s.Delete("a@test.com", "a")).To(Succeed())
+			Expect(s.Delete("a@test.com", "a")).To(MatchError(storage.ErrKeyNotFound))
+			Expect(keys(mustList(s, "a@test.com"))).To(Equal([]string{"b"}))
+			// Deleted public keys can be added again
+			Expect(s.Add("b@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			Expect(keys(mustList(s, "b@test.com"))).To(Equal([]string{"a"}))
+		})
+		ginkgo.It("updates metadata", func() {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a", Network: "office", Name: "laptop", Labels: map[string]string{"os": "linux"}})).To(Succeed())
+			created := mustList(s, "a@test.com")[0]
+			Expect(created.Labels).To(Equal(map[string]string{"os": "linux"}))
+			Expect(s.Update("a@test.com", storage.Entry{PublicKey: "a", Name: "desktop", Disabled: true})).To(Succeed())
+			Expect(s.Update("b@test.com", storage.Entry{PublicKey: "a"})).To(MatchError(storage.ErrKeyNotFound))
+			Expect(s.Save()).To(Succeed())
+			entry := mustList(s, "a@test.com")[0]
+			Expect(entry.Name).To(Equal("desktop"))
+			Expect(entry.Network).To(Equal("office"))
+			Expect(entry.Labels).To(BeNil())
+			Expect(entry.Disabled).To(BeTrue())
+			Expect(entry.Active()).To(BeFalse())
+			Expect(entry.CreatedAt).To(Equal(created.CreatedAt))
+			Expect(entry.CreatedBy).To(Equal(created.CreatedBy))
+		})
+		ginkgo.It("deactivates and reactivates entries", func() {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+			Expect(s.Add("b@test.com", storage.Entry{PublicKey: "c"})).To(Succeed())
+			Expect(s.Deactivate("a@test.com", "test")).To(Succeed())
+			// Deactivating twice keeps the original reason
+			Expect(s.Deactivate("a@test.com", "other")).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			for _, entry := range mustList(s, "a@test.com") {
+				Expect(entry.Active()).To(BeFalse())
+				Expect(entry.Deactivation).ToNot(BeNil())
+				Expect(entry.Deactivation.Reason).To(Equal("test"))
+				Expect(entry.Deactivation.Time.IsZero()).To(BeFalse())
+			}
+			Expect(mustList(s, "b@test.com")[0].Active()).To(BeTrue())
+			Expect(s.Reactivate("a@test.com")).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			for _, entry := range mustList(s, "a@test.com") {
+				Expect(entry.Active()).To(BeTrue())
+			}
+		})
+		ginkgo.It("allocates unique allowed IPs", func() {
+			allocator, err := ipam.New([]string{"10.0.0.0/30"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Close()).To(Succeed())
+			s = mustOpen(open, allocator)
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a", AllowedIP: "ignored"})).To(Succeed())
+			Expect(s.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+			// The range is exhausted
+			Expect(s.Add("b@test.com", storage.Entry{PublicKey: "c"})).ToNot(Succeed())
+			Expect(s.Save()).To(Succeed())
+			st, err := s.ListAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st.AllowedIPs()).To(ConsistOf("10.0.0.1/32", "10.0.0.2/32"))
+			// Allowed IPs of deleted entries are released
+			released := st["a@test.com"][0].AllowedIP
+			Expect(s.Delete("a@test.com", "a")).To(Succeed())
+			Expect(s.Add("b@test.com", storage.Entry{PublicKey: "c"})).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			Expect(mustList(s, "b@test.com")[1].AllowedIP).To(Equal(released))
+		})
+		ginkgo.It("allocates unique dual-stack allowed IPs", func() {
+			allocator, err := ipam.New([]string{"10.0.0.0/30", "fd00::/126"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Close()).To(Succeed())
+			s = mustOpen(open, allocator)
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+			Expect(s.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			st, err := s.ListAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st.AllowedIPs()).To(ConsistOf("10.0.0.1/32, fd00::1/128", "10.0.0.2/32, fd00::2/128"))
+			// Allowed IPs only differing in notation are duplicates
+			allowedIP := ""
+			Expect(s.Close()).To(Succeed())
+			s = mustOpen(open, storage.AllocatorFunc(func([]string) (string, error) {
+				return allowedIP, nil
+			}))
+			for _, allowedIP = range []string{"10.0.0.3/32, FD00:0::1", "10.0.0.2, fd00::3/128"} {
+				Expect(s.Add("c@test.com", storage.Entry{PublicKey: "c"})).To(MatchError(storage.ErrAllowedIPExists))
+			}
+			allowedIP = " 10.0.0.3, FD00::3 "
+			Expect(s.Add("c@test.com", storage.Entry{PublicKey: "c"})).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			Expect(mustList(s, "c@test.com")[0].AllowedIP).To(Equal("10.0.0.3/32, fd00::3/128"))
+		})
+		ginkgo.It("saves without changes", func() {
+			Expect(s.Save()).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			Expect(s.ListAll()).To(BeEmpty())
+		})
+		ginkgo.It("persists saved changes across reopen", func() {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a", Network: "office", Name: "laptop", Labels: map[string]string{"os": "linux"}})).To(Succeed())
+			Expect(s.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+			Expect(s.Deactivate("b@test.com", "test")).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			st, err := s.ListAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Close()).To(Succeed())
+			s = mustOpen(open, nil)
+			Expect(s.ListAll()).To(Equal(st))
+		})
+		ginkgo.It("drops unsaved changes on close", func() {
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+			Expect(s.Delete("a@test.com", "a")).To(Succeed())
+			Expect(s.Close()).To(Succeed())
+			s = mustOpen(open, nil)
+			Expect(keys(mustList(s, "a@test.com"))).To(Equal([]string{"a"}))
+		})
+		ginkgo.It("discards unsaved changes", func() {
+			Expect(s.Discard()).To(Succeed())
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+			Expect(s.Delete("a@test.com", "a")).To(Succeed())
+			Expect(s.Discard()).To(Succeed())
+			Expect(keys(mustList(s, "a@test.com"))).To(Equal([]string{"a"}))
+			Expect(s.Save()).To(Succeed())
+			Expect(s.Add("a@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+			Expect(s.Save()).To(Succeed())
+			Expect(s.Close()).To(Succeed())
+			s = mustOpen(open, nil)
+			Expect(keys(mustList(s, "a@test.com"))).To(Equal([]string{"a", "b"}))
+		})
+		ginkgo.It("saves or discards transactions as a whole", func() {
+			Expect(s.Transact(func() error {
+				return s.Add("a@test.com", storage.Entry{PublicKey: "a"})
+			})).To(Succeed())
+			err := s.Transact(func() error {
+				if err := s.Add("a@test.com", storage.Entry{PublicKey: "b"}); err != nil {
+					return err
+				}
+				return s.Add("b@test.com", storage.Entry{PublicKey: "a"})
+			})
+			Expect(err).To(MatchError(storage.ErrKeyExists))
+			Expect(keys(mustList(s, "a@test.com"))).To(Equal([]string{"a"}))
+			// Failed transactions do not leak into the next one
+			Expect(s.Transact(func() error {
+				return s.Add("b@test.com", storage.Entry{PublicKey: "c"})
+			})).To(Succeed())
+			Expect(s.Close()).To(Succeed())
+			s = mustOpen(open, nil)
+			st, err := s.ListAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st).To(HaveLen(2))
+			Expect(keys(st["a@test.com"])).To(Equal([]string{"a"}))
+			Expect(keys(st["b@test.com"])).To(Equal([]string{"c"}))
+		})
+		ginkgo.It("serializes transactions", func() {
+			const n = 10
+			var wg sync.WaitGroup
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer ginkgo.GinkgoRecover()
+					defer wg.Done()
+					// Every other transaction fails after adding an entry
+					errs <- s.Transact(func() error {
+						if err := s.Add("a@test.com", storage.Entry{PublicKey: fmt.Sprint(i)}); err != nil {
+							return err
+						}
+						if i%2 == 1 {
+							return fmt.Errorf("failed")
+						}
+						return nil
+					})
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			failed := 0
+			for err := range errs {
+				if err != nil {
+					Expect(err).To(MatchError("failed"))
+					failed++
+				}
+			}
+			Expect(failed).To(Equal(n / 2))
+			Expect(s.Close()).To(Succeed())
+			s = mustOpen(open, nil)
+			Expect(keys(mustList(s, "a@test.com"))).To(ConsistOf("0", "2", "4", "6", "8"))
+		})
+		ginkgo.It("handles concurrent access", func() {
+			const n = 10
+			var wg sync.WaitGroup
+			errs := make(chan error, 2*n)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer ginkgo.GinkgoRecover()
+					defer wg.Done()
+					errs <- s.Add(fmt.Sprintf("%d@test.com", i%2), storage.Entry{PublicKey: fmt.Sprint(i)})
+					_, err := s.ListAll()
+					errs <- err
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(s.Save()).To(Succeed())
+			st, err := s.ListAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st).To(HaveLen(2))
+			Expect(append(st["0@test.com"], st["1@test.com"]...)).To(HaveLen(n))
+		})
+		if b.ConcurrentChanges {
+			ginkgo.It("merges changes of concurrent storages", func() {
+				other := mustOpen(open, nil)
+				defer other.Close()
+				Expect(s.Add("a@test.com", storage.Entry{PublicKey: "a"})).To(Succeed())
+				Expect(other.Add("b@test.com", storage.Entry{PublicKey: "b"})).To(Succeed())
+				Expect(s.Save()).To(Succeed())
+				Expect(other.Save()).To(Succeed())
+				// Both changes are persisted without conflicts
+				for _, instance := range []storage.Storage{s, other} {
+					st, err := instance.ListAll()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(st).To(HaveKey("a@test.com"))
+					Expect(st).To(HaveKey("b@test.com"))
+				}
+			})
+		}
+	})
+}
+
+func mustOpen(open Opener, allocator storage.Allocator) storage.Storage {
+	s, err := open(allocator)
+	Expect(err).ToNot(HaveOccurred())
+	return s
+}
+
+func mustList(s storage.Storage, id string) []storage.Entry {
+	entries, err := s.List(id)
+	Expect(err).ToNot(HaveOccurred())
+	return entries
+}
+
+func keys(entries []storage.Entry) []string {
+	result := []string{}
+	for _, entry := range entries {
+		result = append(result, entry.PublicKey)
+	}
+	return result
+}
@@ -90,8 +90,9 @@ func NewDex(redirectURL string) (*Dex, error) {
 		return nil, err
 	}
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	issuer := fmt.Sprintf("http://%s/dex", addr)
 	c := Config{
-		Issuer: fmt.Sprintf("http://%s/dex", addr),
+		Issuer: issuer,
 		Storage: Storage{
 			Type:   "memory",
 			Config: &memory.Config{},
@@ -109,7 +110,7 @@ func NewDex(redirectURL string) (*Dex, error) {
 		StaticClients: []storage.Client{
 			{
 				ID:           DexClientID,
-				RedirectURIs: []string{redirectURL},
+				RedirectURIs: []string{redirectURL, issuer + "/device/callback"},
 				Name:         "Smorgasbord",
 				Secret:       DexClientSecret,
 			},
@@ -157,7 +158,7 @@ func NewDex(redirectURL string) (*Dex, error) {
 	if err != nil {
 		return nil, err
 	}
-	httpServer := &http.Server{Addr: c.Web.HTTP, Handler: handler}
+	httpServer := &http.Server{Addr: c.Web.HTTP, Handler: newDeviceFlow(issuer, handler)}
 	httpServerLis, err := net.Listen("tcp", httpServer.Addr)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,219 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+type deviceAuth struct {
+	deviceCode string
+	scopes     []string
+	token      map[string]interface{}
+}
+
+// deviceFlow emulates the device authorization grant (RFC 8628) on top of dex,
+// because the vendored version of dex does not support it. Authorizing a
+// device is done by visiting the verification URI, which will run the auth
+// code flow against dex using the mock connector and store the token.
+type deviceFlow struct {
+	mutex    sync.Mutex
+	issuer   string
+	next     http.Handler
+	pending  map[string]*deviceAuth // by user code
+	byDevice map[string]*deviceAuth // by device code
+}
+
+func newDeviceFlow(issuer string, next http.Handler) *deviceFlow {
+	return &deviceFlow{
+		issuer:   issuer,
+		next:     next,
+		pending:  map[string]*deviceAuth{},
+		byDevice: map[string]*deviceAuth{},
+	}
+}
+
+func (d *deviceFlow) callbackURL() string {
+	return d.issuer + "/device/callback"
+}
+
+func (d *deviceFlow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/dex")
+	switch {
+	case path == "/.well-known/openid-configuration":
+		d.discovery(w, r)
+	case path == "/device/code" && r.Method == http.MethodPost:
+		d.code(w, r)
+	case path == "/device/verify":
+		d.verify(w, r)
+	case path == "/device/callback":
+		d.callback(w, r)
+	case path == "/token" && r.Method == http.MethodPost:
+		d.token(w, r)
+	default:
+		d.next.ServeHTTP(w, r)
+	}
+}
+
+func (d *deviceFlow) discovery(w http.ResponseWriter, r *http.Request) {
+	rec := httptest.NewRecorder()
+	d.next.ServeHTTP(rec, r)
+	metadata := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	metadata["device_authorization_endpoint"] = d.issuer + "/device/code"
+	writeJSON(w, http.StatusOK, metadata)
+}
+
+func (d *deviceFlow) code(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("client_id") != DexClientID {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	a := &deviceAuth{
+		deviceCode: randomString(16),
+		scopes:     strings.Fields(r.FormValue("scope")),
+	}
+	userCode := strings.ToUpper(randomString(4))
+	d.mutex.Lock()
+	d.pending[userCode] = a
+	d.byDevice[a.deviceCode] = a
+	d.mutex.Unlock()
+	verificationURI := d.issuer + "/device/verify"
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_code":               a.deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + userCode,
+		"expires_in":                300,
+		"interval":                  1,
+	})
+}
+
+func (d *deviceFlow) verify(w http.ResponseWriter, r *http.Request) {
+	userCode := r.FormValue("user_code")
+	d.mutex.Lock()
+	a, ok := d.pending[userCode]
+	d.mutex.Unlock()
+	if !ok {
+		http.Error(w, "unknown user code", http.StatusBadRequest)
+		return
+	}
+	authCodeURL := d.oauth2Config(a.scopes).AuthCodeURL(userCode) + "&connector_id=mock"
+	http.Redirect(w, r, authCodeURL, http.StatusFound)
+}
+
+func (d *deviceFlow) callback(w http.ResponseWriter, r *http.Request) {
+	userCode := r.FormValue("state")
+	d.mutex.Lock()
+	a, ok := d.pending[userCode]
+	delete(d.pending, userCode)
+	d.mutex.Unlock()
+	if !ok {
+		http.Error(w, "unknown user code", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	token, err := d.oauth2Config(a.scopes).Exchange(ctx, r.FormValue("code"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.mutex.Lock()
+	a.token = map[string]interface{}{
+		"access_token":  token.AccessToken,
+		"token_type":    token.TokenType,
+		"refresh_token": token.RefreshToken,
+		"expires_in":    int(time.Until(token.Expiry).Seconds()),
+		"id_token":      token.Extra("id_token"),
+	}
+	d.mutex.Unlock()
+	fmt.Fprintf(w, "Device authorized.")
+}
+
+func (d *deviceFlow) token(w http.ResponseWriter, r *http.Request) {
+	// The body has to be restored, so other grants can be passed to dex
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil || form.Get("grant_type") != deviceCodeGrantType {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		d.next.ServeHTTP(w, r)
+		return
+	}
+	d.mutex.Lock()
+	a, ok := d.byDevice[form.Get("device_code")]
+	if ok && a.token != nil {
+		delete(d.byDevice, a.deviceCode)
+	}
+	d.mutex.Unlock()
+	switch {
+	case !ok:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expired_token"})
+	case a.token == nil:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "authorization_pending"})
+	default:
+		writeJSON(w, http.StatusOK, a.token)
+	}
+}
+
+func (d *deviceFlow) oauth2Config(scopes []string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     DexClientID,
+		ClientSecret: DexClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  d.issuer + "/auth",
+			TokenURL: d.issuer + "/token",
+		},
+		Scopes:      scopes,
+		RedirectURL: d.callbackURL(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(obj)
+}
+
+func randomString(n int) string {
+	data := make([]byte, n)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"io"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// InitRepository creates an initial commit with the provided files and
+// pushes it to the repository at url, e.g. served by GitServer.
+func InitRepository(url string, files map[string]string) error {
+	fs := memfs.New()
+	r, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		return err
+	}
+	_, err = r.CreateRemote(&config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{url},
+	})
+	if err != nil {
+		return err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	for name, content := range files {
+		f, err := fs.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, content); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if _, err := w.Add(name); err != nil {
+			return err
+		}
+	}
+	_, err = w.Commit("first commit", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "John Doe",
+			Email: "john@doe.org",
+			When:  time.Now(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return r.Push(&git.PushOptions{
+		RemoteName: "origin",
+	})
+}
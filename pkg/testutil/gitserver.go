@@ -17,6 +17,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/kubism/smorgasbord/pkg/util"
 )
@@ -95,6 +96,9 @@ type GitServer struct {
 	serverLis net.Listener
 	rootDir   string
 	routes    []gitRouteMatcher
+	mutex     sync.Mutex
+	username  string
+	password  string
 }
 
 func NewGitServer(rootDir string) (*GitServer, error) {
@@ -111,6 +115,11 @@ func NewGitServer(rootDir string) (*GitServer, error) {
 		{Matcher: regexp.MustCompile("(.*)"), Params: []string{"go-get"}, Handler: g.goGettable},
 	}
 	g.server = &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 		parsedRoute := g.matchRoute(r)
 		if parsedRoute != nil {
 			parsedRoute.Dispatch(w, r)
@@ -135,6 +144,25 @@ func (g *GitServer) Close() error {
 	return g.serverLis.Close()
 }
 
+// SetBasicAuth requires clients to authenticate using basic auth. An empty
+// username disables authentication again.
+func (g *GitServer) SetBasicAuth(username, password string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.username = username
+	g.password = password
+}
+
+func (g *GitServer) authorized(r *http.Request) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.username == "" {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	return ok && username == g.username && password == g.password
+}
+
 func (g *GitServer) GetAddr() string {
 	return g.server.Addr
 }
@@ -64,7 +64,7 @@ var _ = Describe("License", func() {
 			if err != nil {
 				return nil
 			}
-			if !bytes.HasPrefix(content, []byte(prefix)) {
+			if !bytes.HasPrefix(withoutBuildConstraints(content), []byte(prefix)) {
 				return fmt.Errorf("%s: license header missing", path)
 			}
 			return nil
@@ -72,3 +72,19 @@ var _ = Describe("License", func() {
 		Expect(err).ToNot(HaveOccurred())
 	})
 })
+
+// withoutBuildConstraints removes the build constraints, which have to
+// precede the license header.
+func withoutBuildConstraints(content []byte) []byte {
+	for {
+		line := content
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			line = content[:i+1]
+		}
+		trimmed := bytes.TrimSpace(line)
+		if len(line) == 0 || (len(trimmed) > 0 && !bytes.HasPrefix(trimmed, []byte("//go:build")) && !bytes.HasPrefix(trimmed, []byte("// +build"))) {
+			return content
+		}
+		content = content[len(line):]
+	}
+}
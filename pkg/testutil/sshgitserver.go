@@ -0,0 +1,282 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHGitServer serves the bare repositories in rootDir via SSH using the git
+// binary, similar to GitServer. Clients authenticate using one of the
+// authorized keys or the password, if set.
+type SSHGitServer struct {
+	lis      net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+	rootDir  string
+	password string
+	mutex    sync.Mutex
+	keys     map[string]bool
+	wg       sync.WaitGroup
+}
+
+// NewSSHGitServer starts a SSH server on a free port. The host key is
+// generated, use KnownHosts to retrieve a matching known_hosts line.
+func NewSSHGitServer(rootDir string) (*SSHGitServer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	g := &SSHGitServer{
+		hostKey: hostKey,
+		rootDir: rootDir,
+		keys:    map[string]bool{},
+	}
+	g.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			if g.keys[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key")
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			if g.password != "" && string(password) == g.password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("invalid password")
+		},
+	}
+	g.config.AddHostKey(hostKey)
+	g.lis, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	g.wg.Add(1)
+	go g.serve()
+	return g, nil
+}
+
+// AuthorizeKey allows clients to authenticate using the key.
+func (g *SSHGitServer) AuthorizeKey(key ssh.PublicKey) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.keys[string(key.Marshal())] = true
+}
+
+// SetPassword allows clients to authenticate using the password. An empty
+// password disables password authentication.
+func (g *SSHGitServer) SetPassword(password string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.password = password
+}
+
+// GetAddr returns the address the server listens on.
+func (g *SSHGitServer) GetAddr() string {
+	return g.lis.Addr().String()
+}
+
+// KnownHosts returns a line of a known_hosts file matching the host key of
+// the server.
+func (g *SSHGitServer) KnownHosts() string {
+	return knownhosts.Line([]string{knownhosts.Normalize(g.GetAddr())}, g.hostKey.PublicKey())
+}
+
+// Close stops the server and waits until all connections are closed.
+func (g *SSHGitServer) Close() error {
+	err := g.lis.Close()
+	g.wg.Wait()
+	return err
+}
+
+func (g *SSHGitServer) serve() {
+	defer g.wg.Done()
+	for {
+		conn, err := g.lis.Accept()
+		if err != nil {
+			return
+		}
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.handleConn(conn)
+		}()
+	}
+}
+
+func (g *SSHGitServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, g.config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go g.handleSession(channel, requests)
+	}
+}
+
+func (g *SSHGitServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			_ = req.Reply(false, nil)
+			return
+		}
+		_ = req.Reply(true, nil)
+		status := uint32(0)
+		if err := g.exec(channel, payload.Command); err != nil {
+			fmt.Fprintln(channel.Stderr(), err)
+			status = 1
+		}
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, status)
+		_, _ = channel.SendRequest("exit-status", false, data)
+		return
+	}
+}
+
+// exec runs the git command, e.g. git-upload-pack '/test.git', using the
+// channel as stdin and stdout.
+func (g *SSHGitServer) exec(channel ssh.Channel, command string) error {
+	parts := strings.SplitN(command, " ", 2)
+	if len(parts) != 2 || (parts[0] != "git-upload-pack" && parts[0] != "git-receive-pack") {
+		return fmt.Errorf("unsupported command: %s", command)
+	}
+	repo, err := g.absoluteRepoPath(strings.Trim(parts[1], "'"))
+	if err != nil {
+		return err
+	}
+	if !repoExists(repo) {
+		if _, err := (&gitCommand{Args: []string{"init", "--bare", repo}}).Run(true); err != nil {
+			return err
+		}
+	}
+	cmd := exec.Command("git", strings.TrimPrefix(parts[0], "git-"), repo)
+	cmd.Stdin = channel
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	return cmd.Run()
+}
+
+func (g *SSHGitServer) absoluteRepoPath(relativePath string) (string, error) {
+	if strings.Contains(relativePath, "..") {
+		return "", errors.New("invalid repo path")
+	}
+	if !strings.HasSuffix(relativePath, ".git") {
+		relativePath += ".git"
+	}
+	return filepath.Abs(filepath.Join(g.rootDir, relativePath))
+}
+
+// GenerateSSHKey writes a new private key to path and returns the public key.
+// If a passphrase is provided, the private key is encrypted.
+func GenerateSSHKey(path, passphrase string) (ssh.PublicKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	if passphrase != "" {
+		// Legacy PEM encryption is used, as it is supported by go-git
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, der, []byte(passphrase), x509.PEMCipherAES256) //nolint:staticcheck
+		if err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, block); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	return ssh.NewPublicKey(&key.PublicKey)
+}
+
+// ServeSSHAgent serves an SSH agent holding the private keys on a unix
+// socket at path, e.g. used as SSH_AUTH_SOCK, until the returned listener is
+// closed.
+func ServeSSHAgent(path string, keys ...interface{}) (net.Listener, error) {
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			return nil, err
+		}
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return lis, nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SSHGitServer", func() {
+	var (
+		dir string
+		gs  *SSHGitServer
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "smorgasbord")
+		Expect(err).ToNot(HaveOccurred())
+		gs, err = NewSSHGitServer(filepath.Join(dir, "git"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		Expect(gs.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+	It("serves repositories to authorized keys", func() {
+		keyFile := filepath.Join(dir, "id_ecdsa")
+		publicKey, err := GenerateSSHKey(keyFile, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		knownHosts := filepath.Join(dir, "known_hosts")
+		Expect(ioutil.WriteFile(knownHosts, []byte(gs.KnownHosts()+"\n"), 0600)).To(Succeed())
+		auth, err := gitssh.NewPublicKeysFromFile("git", keyFile, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		auth.HostKeyCallback, err = gitssh.NewKnownHostsCallback(knownHosts)
+		Expect(err).ToNot(HaveOccurred())
+		url := fmt.Sprintf("ssh://git@%s/foo.git", gs.GetAddr())
+		// Not authorized yet
+		_, err = git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{URL: url, Auth: auth})
+		Expect(err).To(HaveOccurred())
+		gs.AuthorizeKey(publicKey)
+		// The repository is created, but empty
+		_, err = git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{URL: url, Auth: auth})
+		Expect(err).To(MatchError(ContainSubstring("empty")))
+		gs.SetPassword("password")
+		_, err = git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{URL: url, Auth: &gitssh.Password{
+			User:                  "git",
+			Password:              "password",
+			HostKeyCallbackHelper: auth.HostKeyCallbackHelper,
+		}})
+		Expect(err).To(MatchError(ContainSubstring("empty")))
+	})
+})
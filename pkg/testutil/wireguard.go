@@ -0,0 +1,139 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// FakeDevice emulates the wireguard devices of a wgctrl.Client in memory, so
+// code configuring devices can be tested without kernel support. All applied
+// configurations are recorded.
+type FakeDevice struct {
+	mutex   sync.Mutex
+	devices map[string]*wgtypes.Device
+	// Configs contains all configurations passed to ConfigureDevice
+	Configs []wgtypes.Config
+}
+
+// NewFakeDevice creates a FakeDevice with empty devices of the provided
+// names.
+func NewFakeDevice(names ...string) *FakeDevice {
+	f := &FakeDevice{devices: map[string]*wgtypes.Device{}}
+	for _, name := range names {
+		f.devices[name] = &wgtypes.Device{Name: name, Type: wgtypes.Userspace}
+	}
+	return f
+}
+
+// Device returns a copy of the device with the provided name.
+func (f *FakeDevice) Device(name string) (*wgtypes.Device, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	device, ok := f.devices[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	copied := *device
+	copied.Peers = make([]wgtypes.Peer, len(device.Peers))
+	for i, peer := range device.Peers {
+		copied.Peers[i] = peer
+		copied.Peers[i].AllowedIPs = append(peer.AllowedIPs[:0:0], peer.AllowedIPs...)
+	}
+	return &copied, nil
+}
+
+// ConfigureDevice applies the configuration similar to the kernel
+// implementation.
+func (f *FakeDevice) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	device, ok := f.devices[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	f.Configs = append(f.Configs, cfg)
+	if cfg.PrivateKey != nil {
+		device.PrivateKey = *cfg.PrivateKey
+		device.PublicKey = cfg.PrivateKey.PublicKey()
+	}
+	if cfg.ListenPort != nil {
+		device.ListenPort = *cfg.ListenPort
+	}
+	if cfg.ReplacePeers {
+		device.Peers = nil
+	}
+	for _, pc := range cfg.Peers {
+		i := -1
+		for j := range device.Peers {
+			if device.Peers[j].PublicKey == pc.PublicKey {
+				i = j
+				break
+			}
+		}
+		switch {
+		case pc.Remove:
+			if i >= 0 {
+				device.Peers = append(device.Peers[:i], device.Peers[i+1:]...)
+			}
+			continue
+		case i < 0 && pc.UpdateOnly:
+			continue
+		case i < 0:
+			device.Peers = append(device.Peers, wgtypes.Peer{PublicKey: pc.PublicKey})
+			i = len(device.Peers) - 1
+		}
+		peer := &device.Peers[i]
+		if pc.PresharedKey != nil {
+			peer.PresharedKey = *pc.PresharedKey
+		}
+		if pc.Endpoint != nil {
+			peer.Endpoint = pc.Endpoint
+		}
+		if pc.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+		}
+		if pc.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, pc.AllowedIPs...)
+	}
+	return nil
+}
+
+// Peers returns the public keys and allowed IPs of the device's peers, which
+// is convenient for assertions.
+func (f *FakeDevice) Peers(name string) map[string][]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	peers := map[string][]string{}
+	device, ok := f.devices[name]
+	if !ok {
+		return peers
+	}
+	for _, peer := range device.Peers {
+		allowedIPs := []string{}
+		for _, allowedIP := range peer.AllowedIPs {
+			allowedIPs = append(allowedIPs, allowedIP.String())
+		}
+		peers[peer.PublicKey.String()] = allowedIPs
+	}
+	return peers
+}
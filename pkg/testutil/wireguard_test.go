@@ -0,0 +1,56 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var _ = Describe("FakeDevice", func() {
+	It("applies configurations like wgctrl", func() {
+		key, err := wgtypes.GeneratePrivateKey()
+		Expect(err).ToNot(HaveOccurred())
+		other, err := wgtypes.GeneratePrivateKey()
+		Expect(err).ToNot(HaveOccurred())
+		_, prefix1, _ := net.ParseCIDR("10.0.0.1/32")
+		_, prefix2, _ := net.ParseCIDR("10.0.0.2/32")
+		f := NewFakeDevice("wg0")
+		Expect(f.ConfigureDevice("wg0", wgtypes.Config{Peers: []wgtypes.PeerConfig{
+			{PublicKey: key.PublicKey(), AllowedIPs: []net.IPNet{*prefix1}},
+			{PublicKey: other.PublicKey(), UpdateOnly: true},
+		}})).To(Succeed())
+		Expect(f.Peers("wg0")).To(Equal(map[string][]string{
+			key.PublicKey().String(): {"10.0.0.1/32"},
+		}))
+		// Allowed IPs are appended unless replaced
+		Expect(f.ConfigureDevice("wg0", wgtypes.Config{Peers: []wgtypes.PeerConfig{
+			{PublicKey: key.PublicKey(), AllowedIPs: []net.IPNet{*prefix2}},
+		}})).To(Succeed())
+		Expect(f.Peers("wg0")[key.PublicKey().String()]).To(Equal([]string{"10.0.0.1/32", "10.0.0.2/32"}))
+		Expect(f.ConfigureDevice("wg0", wgtypes.Config{Peers: []wgtypes.PeerConfig{
+			{PublicKey: key.PublicKey(), Remove: true},
+		}})).To(Succeed())
+		Expect(f.Peers("wg0")).To(BeEmpty())
+		Expect(f.Configs).To(HaveLen(3))
+		_, err = f.Device("wg1")
+		Expect(err).To(HaveOccurred())
+	})
+})
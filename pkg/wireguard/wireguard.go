@@ -0,0 +1,96 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wireguard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Interface is the [Interface] section of a configuration. Address and DNS
+// are only understood by wg-quick.
+type Interface struct {
+	PrivateKey string
+	ListenPort int
+	Address    []string
+	DNS        []string
+}
+
+// Peer is a [Peer] section of a configuration.
+type Peer struct {
+	PublicKey           string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+}
+
+// Config is a wireguard configuration as understood by wg-quick. If Interface
+// is nil, only the peers are rendered, e.g. to be included in an existing
+// configuration or used by `wg syncconf`.
+type Config struct {
+	Interface *Interface
+	Peers     []Peer
+}
+
+// Render writes the configuration in the INI-like format of wireguard.
+func (c *Config) Render(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	if i := c.Interface; i != nil {
+		fmt.Fprintf(b, "[Interface]\n")
+		fmt.Fprintf(b, "PrivateKey = %s\n", i.PrivateKey)
+		if i.ListenPort > 0 {
+			fmt.Fprintf(b, "ListenPort = %d\n", i.ListenPort)
+		}
+		if len(i.Address) > 0 {
+			fmt.Fprintf(b, "Address = %s\n", strings.Join(i.Address, ", "))
+		}
+		if len(i.DNS) > 0 {
+			fmt.Fprintf(b, "DNS = %s\n", strings.Join(i.DNS, ", "))
+		}
+	}
+	for n, p := range c.Peers {
+		if n > 0 || c.Interface != nil {
+			fmt.Fprintf(b, "\n")
+		}
+		fmt.Fprintf(b, "[Peer]\n")
+		fmt.Fprintf(b, "PublicKey = %s\n", p.PublicKey)
+		if p.Endpoint != "" {
+			fmt.Fprintf(b, "Endpoint = %s\n", p.Endpoint)
+		}
+		if len(p.AllowedIPs) > 0 {
+			fmt.Fprintf(b, "AllowedIPs = %s\n", strings.Join(p.AllowedIPs, ", "))
+		}
+		if p.PersistentKeepalive > 0 {
+			fmt.Fprintf(b, "PersistentKeepalive = %d\n", p.PersistentKeepalive)
+		}
+	}
+	return b.Flush()
+}
+
+// SplitList splits a comma-separated list as used by wireguard, e.g. for
+// allowed IPs, and trims the values.
+func SplitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2020 Smorgasbord Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wireguard
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	It("renders interface and peers", func() {
+		c := &Config{
+			Interface: &Interface{
+				PrivateKey: "priv",
+				Address:    []string{"10.0.0.2/32", "fd00::2/128"},
+				DNS:        []string{"10.0.0.1"},
+			},
+			Peers: []Peer{{
+				PublicKey:           "pub",
+				Endpoint:            "vpn.example.com:51820",
+				AllowedIPs:          []string{"0.0.0.0/0"},
+				PersistentKeepalive: 25,
+			}},
+		}
+		var buf bytes.Buffer
+		Expect(c.Render(&buf)).To(Succeed())
+		Expect(buf.String()).To(Equal(`[Interface]
+PrivateKey = priv
+Address = 10.0.0.2/32, fd00::2/128
+DNS = 10.0.0.1
+
+[Peer]
+PublicKey = pub
+Endpoint = vpn.example.com:51820
+AllowedIPs = 0.0.0.0/0
+PersistentKeepalive = 25
+`))
+	})
+	It("renders only peers without interface", func() {
+		c := &Config{
+			Peers: []Peer{
+				{PublicKey: "a", AllowedIPs: []string{"10.0.0.2/32"}},
+				{PublicKey: "b"},
+			},
+		}
+		var buf bytes.Buffer
+		Expect(c.Render(&buf)).To(Succeed())
+		Expect(buf.String()).To(Equal("[Peer]\nPublicKey = a\nAllowedIPs = 10.0.0.2/32\n\n[Peer]\nPublicKey = b\n"))
+	})
+	It("splits lists", func() {
+		Expect(SplitList("10.0.0.2/32, fd00::2/128,")).To(Equal([]string{"10.0.0.2/32", "fd00::2/128"}))
+		Expect(SplitList("")).To(BeEmpty())
+	})
+})